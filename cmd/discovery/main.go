@@ -5,6 +5,7 @@ import (
 
 	"github.com/soda92/vpn-share-tool/discovery/api"
 	"github.com/soda92/vpn-share-tool/discovery/proxy"
+	"github.com/soda92/vpn-share-tool/discovery/registry"
 	"github.com/soda92/vpn-share-tool/discovery/store"
 	"github.com/soda92/vpn-share-tool/discovery/transport"
 )
@@ -14,6 +15,8 @@ func main() {
 	flag.Parse()
 
 	store.LoadTaggedURLs()
+	store.LoadRules()
+	registry.OnRegister = api.PushRulesToNewInstance
 	// Start TCP server for vpn-share-tool instances
 	go transport.StartTCPServer()
 	// Start the automatic proxy creator
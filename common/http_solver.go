@@ -0,0 +1,55 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPSolver posts the raw image to a solver endpoint and reads the text from the response
+// body. The discovery server's /solve-captcha endpoint speaks the same protocol.
+type HTTPSolver struct {
+	BackendName string
+	// URL returns the endpoint; an empty URL means the backend is currently unavailable.
+	URL    func() string
+	Client func() *http.Client
+}
+
+func (s *HTTPSolver) Name() string { return s.BackendName }
+
+func (s *HTTPSolver) Solve(ctx context.Context, imgData []byte) (string, error) {
+	url := s.URL()
+	if url == "" {
+		return "", fmt.Errorf("no endpoint configured")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(imgData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	client := http.DefaultClient
+	if s.Client != nil {
+		if c := s.Client(); c != nil {
+			client = c
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("solver returned %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
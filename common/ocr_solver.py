@@ -15,6 +15,47 @@ def is_valid(s):
     return len(s) == 4 and s.isalnum()
 
 
+_ocr = None
+_ocr_beta = None
+
+
+def classify(img_bytes):
+    """Returns the best OCR result, reusing the models between calls."""
+    global _ocr, _ocr_beta
+    if _ocr is None:
+        _ocr = ddddocr.DdddOcr(show_ad=False)
+    res = str(_ocr.classification(img_bytes))
+    if is_valid(res):
+        return res
+
+    # Retry with beta
+    if _ocr_beta is None:
+        _ocr_beta = ddddocr.DdddOcr(show_ad=False, beta=True)
+    res_beta = str(_ocr_beta.classification(img_bytes))
+    if is_valid(res_beta):
+        return res_beta
+
+    # Neither looks like a valid captcha; return empty string to indicate failure
+    return ""
+
+
+def worker():
+    """Line protocol: base64 image per line in, "OK <text>" or "ERR <message>" per line out."""
+    import base64
+
+    for line in sys.stdin:
+        line = line.strip()
+        if not line:
+            continue
+        try:
+            res = classify(base64.b64decode(line))
+            sys.stdout.write("OK " + res + "\n")
+        except Exception as e:
+            msg = str(e).replace("\n", " ")
+            sys.stdout.write("ERR " + msg + "\n")
+        sys.stdout.flush()
+
+
 def solve():
     try:
         # Read raw bytes from stdin buffer
@@ -24,34 +65,7 @@ def solve():
             print("Error: No image data received.", file=sys.stderr)
             sys.exit(1)
 
-        ocr = ddddocr.DdddOcr(show_ad=False)
-        res = ocr.classification(img_bytes)
-
-        if is_valid(res):
-            res = str(res)
-            sys.stdout.write(res)
-            return
-
-        # Retry with beta
-        ocr_beta = ddddocr.DdddOcr(show_ad=False, beta=True)
-        res_beta = ocr_beta.classification(img_bytes)
-
-        if is_valid(res_beta):
-            res_beta = str(res_beta)
-            sys.stdout.write(res_beta)
-            return
-
-        # If neither is valid, return empty string to indicate failure
-        if not is_valid(res) and not is_valid(res_beta):
-            sys.stdout.write("")
-            return
-        # Fallback to original result if neither is "perfect",
-        # as it might just be a hard captcha but correct OCR.
-        # Or maybe beta is better on average for hard ones?
-        # Let's return the one that looks "more" valid?
-        # Hard to say. Return original.
-        res = str(res)
-        sys.stdout.write(res)
+        sys.stdout.write(classify(img_bytes))
 
     except Exception as e:
         print(f"Error: {e}", file=sys.stderr)
@@ -59,4 +73,7 @@ def solve():
 
 
 if __name__ == "__main__":
-    solve()
+    if "--worker" in sys.argv:
+        worker()
+    else:
+        solve()
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workerStallTimeout is how long the worker may take to answer an image its caller stopped
+// waiting for before it is considered stuck and restarted.
+var workerStallTimeout = time.Minute
+
+// PythonWorkerSolver keeps one Python process running ocr_solver.py in worker mode, so the
+// OCR models are loaded once instead of for every image.
+//
+// Line protocol: each request is the base64-encoded image followed by a newline; the worker
+// answers with "OK <text>" or "ERR <message>" on a single line.
+type PythonWorkerSolver struct {
+	// PythonPath and Args start the worker; the script path is appended to Args.
+	PythonPath string
+	Args       []string
+	Script     []byte
+
+	sem        chan struct{} // One-slot semaphore held by the request using the worker
+	semOnce    sync.Once
+	scriptPath string
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     *bufio.Reader
+	// pending is the answer to an image whose caller stopped waiting, still to be read
+	// before the next request so requests and answers stay in step.
+	pending      <-chan workerReply
+	pendingSince time.Time
+}
+
+// workerReply is a line read from the worker, or the error that ended its output.
+type workerReply struct {
+	line string
+	err  error
+}
+
+// NewPythonWorkerSolver returns a worker for the embedded ocr_solver.py. The process is
+// started on first use.
+func NewPythonWorkerSolver() *PythonWorkerSolver {
+	pythonPath, err := GetPythonPath()
+	if err != nil {
+		log.Printf("Failed to get python path: %v", err)
+		pythonPath = "python"
+	}
+	return &PythonWorkerSolver{
+		PythonPath: pythonPath,
+		Args:       []string{"-u"},
+		Script:     ocrSolverScript,
+	}
+}
+
+func (w *PythonWorkerSolver) Name() string { return SolverPython }
+
+func (w *PythonWorkerSolver) Solve(ctx context.Context, imgData []byte) (string, error) {
+	if err := w.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer w.release()
+
+	if err := w.skipPending(ctx); err != nil {
+		return "", err
+	}
+	if w.cmd == nil {
+		if err := w.start(); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w.stdin, "%s\n", base64.StdEncoding.EncodeToString(imgData)); err != nil {
+		w.stop()
+		return "", fmt.Errorf("failed to send image to worker: %w", err)
+	}
+
+	reply := w.readReply()
+	select {
+	case r := <-reply:
+		if r.err != nil {
+			w.stop()
+			return "", fmt.Errorf("worker exited: %w", r.err)
+		}
+		line := strings.TrimRight(r.line, "\r\n")
+		if solution, ok := strings.CutPrefix(line, "OK "); ok {
+			solution = strings.TrimSpace(solution)
+			log.Printf("Captcha solved by worker: '%s'", solution)
+			return solution, nil
+		}
+		if line == "OK" {
+			return "", nil
+		}
+		return "", fmt.Errorf("worker error: %s", strings.TrimPrefix(line, "ERR "))
+	case <-ctx.Done():
+		// The worker still answers this image; the next request skips that answer
+		w.pending, w.pendingSince = reply, time.Now()
+		return "", ctx.Err()
+	}
+}
+
+// acquire waits for the worker to be free, or for ctx to end.
+func (w *PythonWorkerSolver) acquire(ctx context.Context) error {
+	w.semOnce.Do(func() { w.sem = make(chan struct{}, 1) })
+	select {
+	case w.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *PythonWorkerSolver) release() { <-w.sem }
+
+// readReply reads the worker's next line in the background.
+func (w *PythonWorkerSolver) readReply() <-chan workerReply {
+	reply := make(chan workerReply, 1)
+	stdout := w.stdout
+	go func() {
+		line, err := stdout.ReadString('\n')
+		reply <- workerReply{line, err}
+	}()
+	return reply
+}
+
+// skipPending reads and drops the answer to an abandoned image. The worker is only restarted
+// if its output ended or it stalls on that image for workerStallTimeout.
+func (w *PythonWorkerSolver) skipPending(ctx context.Context) error {
+	if w.pending == nil {
+		return nil
+	}
+	stall := time.NewTimer(workerStallTimeout - time.Since(w.pendingSince))
+	defer stall.Stop()
+	select {
+	case r := <-w.pending:
+		w.pending = nil
+		if r.err != nil {
+			w.stop()
+		}
+	case <-stall.C:
+		log.Printf("Captcha worker stalled on an image, restarting it")
+		w.stop()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (w *PythonWorkerSolver) start() error {
+	if w.scriptPath == "" {
+		tmpFile, err := os.CreateTemp("", "ocr_solver_*.py")
+		if err != nil {
+			return fmt.Errorf("failed to create solver script: %w", err)
+		}
+		if _, err := tmpFile.Write(w.Script); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return fmt.Errorf("failed to write solver script: %w", err)
+		}
+		tmpFile.Close()
+		w.scriptPath = tmpFile.Name()
+	}
+
+	args := append(append([]string{}, w.Args...), w.scriptPath, "--worker")
+	cmd := exec.Command(w.PythonPath, args...)
+	cmd.Stderr = logWriter{prefix: "ocr worker: "}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start worker: %w", err)
+	}
+	log.Printf("Started captcha worker (pid %d)", cmd.Process.Pid)
+
+	w.cmd = cmd
+	w.stdin = stdin
+	w.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+func (w *PythonWorkerSolver) stop() {
+	w.pending = nil
+	if w.cmd == nil {
+		return
+	}
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+	w.cmd = nil
+}
+
+// Close stops the worker and removes its script.
+func (w *PythonWorkerSolver) Close() {
+	w.acquire(context.Background())
+	defer w.release()
+	w.stop()
+	if w.scriptPath != "" {
+		os.Remove(w.scriptPath)
+		w.scriptPath = ""
+	}
+}
+
+// logWriter forwards a process's stderr to the log.
+type logWriter struct {
+	prefix string
+}
+
+func (l logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Print(l.prefix + line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// Names of the built-in solver backends.
+const (
+	SolverPython    = "python"
+	SolverHTTP      = "http"
+	SolverDiscovery = "discovery"
+)
+
+// Solver turns a captcha image into its text.
+type Solver interface {
+	Name() string
+	Solve(ctx context.Context, imgData []byte) (string, error)
+}
+
+// SolverStats summarizes the results of one backend.
+type SolverStats struct {
+	Backend       string  `json:"backend"`
+	Attempts      int64   `json:"attempts"`
+	Successes     int64   `json:"successes"`
+	Failures      int64   `json:"failures"`
+	Timeouts      int64   `json:"timeouts"`
+	CacheHits     int64   `json:"cache_hits"` // Images answered from the cache instead of this backend
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+
+	totalDuration time.Duration
+}
+
+// SolverChain tries its backends in order until one returns a solution. Results are cached by
+// image hash so repeated images (e.g. reloads of the same captcha) are answered immediately.
+type SolverChain struct {
+	mu       sync.RWMutex
+	timeout  time.Duration // Per-backend timeout
+	backends []Solver
+	stats    map[string]*SolverStats
+	cache    *lru.Cache[string, cachedSolution]
+}
+
+type cachedSolution struct {
+	backend  string
+	solution string
+}
+
+func NewSolverChain(timeout time.Duration, backends ...Solver) *SolverChain {
+	cache, err := lru.New[string, cachedSolution](512)
+	if err != nil {
+		// This should not happen with a static size
+		panic(err)
+	}
+	return &SolverChain{
+		timeout:  timeout,
+		backends: backends,
+		stats:    make(map[string]*SolverStats),
+		cache:    cache,
+	}
+}
+
+// Configure replaces the timeout and backends, keeping stats and cached results.
+func (c *SolverChain) Configure(timeout time.Duration, backends ...Solver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+	c.backends = backends
+}
+
+// SolveResult describes how an image was solved.
+type SolveResult struct {
+	Text     string
+	Backend  string
+	Duration time.Duration
+	Cached   bool // Answered from the cache; Backend is the one that solved it originally
+}
+
+// Solve returns the text of the captcha image, or an error if no backend solved it.
+func (c *SolverChain) Solve(imgData []byte) (string, error) {
+	result, err := c.SolveWith(imgData)
+	return result.Text, err
+}
+
+// ImageKey returns the key solutions for imgData are cached under.
+func ImageKey(imgData []byte) string {
+	sum := sha256.Sum256(imgData)
+	return hex.EncodeToString(sum[:])
+}
+
+// Forget evicts the cached solution for the image with the given key, e.g. after a login
+// rejected it, so the next occurrence of the image is solved afresh.
+func (c *SolverChain) Forget(key string) {
+	c.cache.Remove(key)
+}
+
+// SolveWith is like Solve but tries the given backends instead of the configured ones (when
+// any are given), and reports which backend answered. The cache and stats are shared with Solve.
+func (c *SolverChain) SolveWith(imgData []byte, backends ...Solver) (SolveResult, error) {
+	start := time.Now()
+	key := ImageKey(imgData)
+	if cached, ok := c.cache.Get(key); ok {
+		c.record(cached.backend, func(s *SolverStats) { s.CacheHits++ })
+		log.Printf("Captcha solution served from cache (%s): '%s'", cached.backend, cached.solution)
+		return SolveResult{Text: cached.solution, Backend: cached.backend, Duration: time.Since(start), Cached: true}, nil
+	}
+
+	c.mu.RLock()
+	timeout := c.timeout
+	if len(backends) == 0 {
+		backends = c.backends
+	}
+	c.mu.RUnlock()
+
+	var errs []error
+	for _, backend := range backends {
+		solution, err := c.try(backend, imgData, timeout)
+		if err != nil {
+			log.Printf("Captcha backend %s failed: %v", backend.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend.Name(), err))
+			continue
+		}
+		c.cache.Add(key, cachedSolution{backend: backend.Name(), solution: solution})
+		return SolveResult{Text: solution, Backend: backend.Name(), Duration: time.Since(start)}, nil
+	}
+	if len(errs) == 0 {
+		return SolveResult{}, fmt.Errorf("no captcha solver backends configured")
+	}
+	return SolveResult{}, errors.Join(errs...)
+}
+
+func (c *SolverChain) try(backend Solver, imgData []byte, timeout time.Duration) (string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	solution, err := backend.Solve(ctx, imgData)
+	duration := time.Since(start)
+	if err == nil && solution == "" {
+		err = fmt.Errorf("empty solution")
+	}
+
+	c.record(backend.Name(), func(s *SolverStats) {
+		s.Attempts++
+		s.totalDuration += duration
+		switch {
+		case err == nil:
+			s.Successes++
+		case errors.Is(err, context.DeadlineExceeded):
+			s.Timeouts++
+		default:
+			s.Failures++
+		}
+	})
+	return solution, err
+}
+
+func (c *SolverChain) record(backend string, update func(s *SolverStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stats[backend]
+	if !ok {
+		s = &SolverStats{Backend: backend}
+		c.stats[backend] = s
+	}
+	update(s)
+}
+
+// Stats returns a snapshot of the per-backend stats, sorted by backend name.
+func (c *SolverChain) Stats() []SolverStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]SolverStats, 0, len(c.stats))
+	for _, s := range c.stats {
+		snapshot := *s
+		if s.Attempts > 0 {
+			snapshot.AvgDurationMs = float64(s.totalDuration.Microseconds()) / 1000 / float64(s.Attempts)
+		}
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Backend < result[j].Backend })
+	return result
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+type fakeSolver struct {
+	name     string
+	solution string
+	delay    time.Duration
+	calls    int
+}
+
+func (f *fakeSolver) Name() string { return f.name }
+
+func (f *fakeSolver) Solve(ctx context.Context, imgData []byte) (string, error) {
+	f.calls++
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if f.solution == "" {
+		return "", fmt.Errorf("cannot read image")
+	}
+	return f.solution, nil
+}
+
+func TestSolverChainFallbackCacheAndStats(t *testing.T) {
+	slow := &fakeSolver{name: "slow", solution: "zzzz", delay: time.Second}
+	broken := &fakeSolver{name: "broken"}
+	good := &fakeSolver{name: "good", solution: "ab12"}
+	chain := NewSolverChain(50*time.Millisecond, slow, broken, good)
+
+	for i := 0; i < 2; i++ {
+		solution, err := chain.Solve([]byte("image-1"))
+		if err != nil || solution != "ab12" {
+			t.Fatalf("Expected ab12, got %q (err: %v)", solution, err)
+		}
+	}
+	if good.calls != 1 {
+		t.Errorf("Expected the second solve to be cached, backend called %d times", good.calls)
+	}
+
+	stats := map[string]SolverStats{}
+	for _, s := range chain.Stats() {
+		stats[s.Backend] = s
+	}
+	if stats["slow"].Timeouts != 1 || stats["broken"].Failures != 1 {
+		t.Errorf("Unexpected failure stats: %+v", stats)
+	}
+	if stats["good"].Successes != 1 || stats["good"].CacheHits != 1 {
+		t.Errorf("Unexpected success stats: %+v", stats["good"])
+	}
+
+	chain.Configure(time.Second, broken)
+	if _, err := chain.Solve([]byte("image-2")); err == nil {
+		t.Errorf("Expected an error when no backend solves the image")
+	}
+}
+
+func TestSolverChainForgetRejectedSolution(t *testing.T) {
+	good := &fakeSolver{name: "good", solution: "ab12"}
+	chain := NewSolverChain(time.Second, good)
+
+	img := []byte("image-1")
+	chain.Solve(img)
+	chain.Forget(ImageKey(img))
+	if result, _ := chain.SolveWith(img); result.Cached || good.calls != 2 {
+		t.Errorf("Expected a forgotten image to be solved again, cached: %v, calls: %d", result.Cached, good.calls)
+	}
+}
+
+func TestPythonWorkerLineProtocol(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	// Stand-in worker: answers every request line, failing on the second one
+	worker := &PythonWorkerSolver{
+		PythonPath: sh,
+		Script: []byte(`n=0
+while read line; do
+  n=$((n+1))
+  if [ $n -eq 2 ]; then echo "ERR bad image"; else echo "OK  x${n}y "; fi
+done`),
+	}
+	defer worker.Close()
+
+	ctx := context.Background()
+	if solution, err := worker.Solve(ctx, []byte{1, 2, 3}); err != nil || solution != "x1y" {
+		t.Errorf("Expected x1y, got %q (err: %v)", solution, err)
+	}
+	if _, err := worker.Solve(ctx, []byte{4}); err == nil {
+		t.Errorf("Expected the worker error to be returned")
+	}
+	// The same process keeps serving requests
+	if solution, err := worker.Solve(ctx, []byte{5}); err != nil || solution != "x3y" {
+		t.Errorf("Expected x3y from the same worker, got %q (err: %v)", solution, err)
+	}
+}
+
+func TestPythonWorkerTimeoutKeepsWorker(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	// Stand-in worker that is slow to answer the first image
+	worker := &PythonWorkerSolver{
+		PythonPath: sh,
+		Script: []byte(`n=0
+while read line; do
+  n=$((n+1))
+  if [ $n -eq 1 ]; then sleep 0.3; fi
+  echo "OK x${n}y"
+done`),
+	}
+	defer worker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := worker.Solve(ctx, []byte{1}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the slow image to time out, got %v", err)
+	}
+	pid := worker.cmd.Process.Pid
+
+	// The late answer to the first image is skipped, not taken for the second
+	if solution, err := worker.Solve(context.Background(), []byte{2}); err != nil || solution != "x2y" {
+		t.Errorf("Expected x2y, got %q (err: %v)", solution, err)
+	}
+	if worker.cmd.Process.Pid != pid {
+		t.Errorf("Expected the worker to keep running after a caller timed out")
+	}
+
+	// A caller waiting for a busy worker gives up when its context ends
+	worker.acquire(context.Background())
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = worker.Solve(ctx, []byte{3})
+	worker.release()
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait for the worker to time out, got %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// Entry is one request served by a proxy.
+type Entry struct {
+	Time         time.Time `json:"time"`
+	ClientIP     string    `json:"client_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Method       string    `json:"method"`
+	Host         string    `json:"host"`
+	URL          string    `json:"url"`
+	Proto        string    `json:"proto"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	DurationMs   float64   `json:"duration_ms"`
+	Referer      string    `json:"referer,omitempty"`
+	UserAgent    string    `json:"user_agent"`
+	ProxyID      string    `json:"proxy_id"` // Listener port of the proxy
+	Upstream     string    `json:"upstream"` // OriginalURL of the proxy
+}
+
+// FileInfo describes a log file in the access log directory.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// queuedLine is a formatted entry waiting for the writer goroutine. Lines with a done
+// channel are Flush requests.
+type queuedLine struct {
+	name string
+	line []byte
+	cfg  config.AccessLogConfig
+	done chan struct{}
+}
+
+var (
+	queue     chan queuedLine
+	queueOnce sync.Once
+)
+
+// enqueue hands a line to the writer goroutine, starting it on first use. Requests only pay
+// for formatting the entry; file I/O happens on the writer.
+func enqueue(l queuedLine) {
+	queueOnce.Do(func() {
+		queue = make(chan queuedLine, 4096)
+		go writeLoop()
+	})
+	queue <- l
+}
+
+// writeLoop owns the log files. Writes are buffered and flushed whenever the queue drains.
+func writeLoop() {
+	writers := map[string]*rotatingFile{}
+	flush := func() {
+		for name, w := range writers {
+			if err := w.flush(); err != nil {
+				log.Printf("Failed to write access log %s: %v", name, err)
+			}
+		}
+	}
+	for l := range queue {
+		if l.done != nil {
+			flush()
+			close(l.done)
+			continue
+		}
+		w, ok := writers[l.name]
+		if !ok {
+			w = &rotatingFile{name: l.name}
+			writers[l.name] = w
+		}
+		if err := w.write(l.line, l.cfg); err != nil {
+			log.Printf("Failed to write access log %s: %v", l.name, err)
+		}
+		if len(queue) == 0 {
+			flush()
+		}
+	}
+}
+
+// Flush waits until all entries logged so far are written to disk.
+func Flush() {
+	done := make(chan struct{})
+	enqueue(queuedLine{done: done})
+	<-done
+}
+
+// Dir returns the directory holding access logs, creating it if needed.
+func Dir() (string, error) {
+	dir, err := config.FilePath("access_logs")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Record logs a request served by proxy p if access logging is enabled.
+func Record(r *http.Request, rec *ResponseRecorder, start time.Time, p *models.SharedProxy) {
+	cfg := config.Get().AccessLog
+	if !cfg.Enabled {
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	Log(cfg, Entry{
+		Time:         start,
+		ClientIP:     clientIP,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Method:       r.Method,
+		Host:         r.Host,
+		URL:          r.RequestURI,
+		Proto:        r.Proto,
+		Status:       rec.Status(),
+		Bytes:        rec.Bytes,
+		DurationMs:   float64(time.Since(start).Microseconds()) / 1000,
+		Referer:      r.Referer(),
+		UserAgent:    r.UserAgent(),
+		ProxyID:      strconv.Itoa(p.RemotePort),
+		Upstream:     p.OriginalURL,
+	})
+}
+
+// Log writes an entry in the configured format to the combined or per-proxy log.
+func Log(cfg config.AccessLogConfig, e Entry) {
+	var line []byte
+	if cfg.Format == config.AccessLogJSON {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v", err)
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		line = []byte(FormatCombined(e) + "\n")
+	}
+
+	name := "access.log"
+	if cfg.PerProxy {
+		name = fmt.Sprintf("access-%s.log", e.ProxyID)
+	}
+	enqueue(queuedLine{name: name, line: line, cfg: cfg})
+}
+
+// FormatCombined formats an entry in Combined Log Format, followed by the duration in
+// milliseconds and the proxy ID.
+func FormatCombined(e Entry) string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s "%s" "%s" %.3f "%s"`,
+		e.ClientIP,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escape(e.URL), e.Proto,
+		e.Status,
+		bytesField(e.Bytes),
+		escape(dashIfEmpty(e.Referer)),
+		escape(dashIfEmpty(e.UserAgent)),
+		e.DurationMs,
+		e.ProxyID,
+	)
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// List returns the access log files, newest first.
+func List() ([]FileInfo, error) {
+	Flush()
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, FileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	return files, nil
+}
+
+// Open opens a log file by name, after flushing pending entries. Names containing path
+// separators are rejected.
+func Open(name string) (*os.File, error) {
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, ".log") {
+		return nil, fmt.Errorf("invalid log file name: %q", name)
+	}
+	Flush()
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(dir, name))
+}
+
+// Tail returns up to n of the last lines of a log file.
+func Tail(name string, n int) ([]string, error) {
+	f, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read backwards in blocks until enough lines are buffered
+	const blockSize = 64 * 1024
+	var data []byte
+	offset := info.Size()
+	for offset > 0 && strings.Count(string(data), "\n") <= n {
+		readSize := int64(blockSize)
+		if offset < readSize {
+			readSize = offset
+		}
+		offset -= readSize
+		block := make([]byte, readSize)
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return nil, err
+		}
+		data = append(block, data...)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if offset > 0 {
+		// The first line may be partial
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,64 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+)
+
+func TestFormatCombined(t *testing.T) {
+	e := Entry{
+		Time:       time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("", 8*3600)),
+		ClientIP:   "192.168.1.20",
+		Method:     "GET",
+		URL:        `/login.jsp?next="home"`,
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      5120,
+		DurationMs: 12.5,
+		UserAgent:  "Mozilla/5.0",
+		ProxyID:    "10100",
+	}
+	expected := `192.168.1.20 - - [05/Mar/2024:14:07:09 +0800] "GET /login.jsp?next=\"home\" HTTP/1.1" 200 5120 "-" "Mozilla/5.0" 12.500 "10100"`
+	if got := FormatCombined(e); got != expected {
+		t.Errorf("Unexpected combined line:\n got: %s\nwant: %s", got, expected)
+	}
+}
+
+func TestLogRotatesBySizeAndTails(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+
+	cfg := config.AccessLogConfig{Enabled: true, Format: config.AccessLogJSON, PerProxy: true, MaxSizeMB: 1}
+	entry := Entry{Method: "GET", URL: "/" + strings.Repeat("a", 1000), Status: 200, ProxyID: "10100"}
+	for i := 0; i < 1100; i++ {
+		Log(cfg, entry)
+	}
+	Flush()
+
+	dir, _ := Dir()
+	rotated, _ := filepath.Glob(filepath.Join(dir, "access-10100.*.log"))
+	if len(rotated) != 1 {
+		t.Fatalf("Expected 1 rotated file, got %d", len(rotated))
+	}
+	if info, err := os.Stat(filepath.Join(dir, "access-10100.log")); err != nil || info.Size() == 0 {
+		t.Fatalf("Expected a non-empty active log file, err: %v", err)
+	}
+
+	lines, err := Tail("access-10100.log", 3)
+	if err != nil {
+		t.Fatalf("Tail failed: %v", err)
+	}
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], `{"time"`) {
+		t.Errorf("Unexpected tail result: %d lines", len(lines))
+	}
+
+	if _, err := Open("../config.json"); err == nil {
+		t.Errorf("Expected Open to reject paths outside the log directory")
+	}
+}
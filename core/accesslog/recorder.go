@@ -0,0 +1,50 @@
+package accesslog
+
+import (
+	"net/http"
+)
+
+// ResponseRecorder wraps a ResponseWriter to capture the status code and body size.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	Bytes  int64
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += int64(n)
+	return n, err
+}
+
+// Status returns the response status, defaulting to 200 if nothing was written.
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (Flush, Hijack for websockets).
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Flush keeps streamed responses flowing for callers that use http.Flusher directly.
+func (r *ResponseRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
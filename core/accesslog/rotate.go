@@ -0,0 +1,113 @@
+package accesslog
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+// rotatingFile appends to a log file in the access log directory, renaming it aside when it
+// grows too large or too old. It is only used by the writer goroutine.
+type rotatingFile struct {
+	name     string
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+func (f *rotatingFile) write(line []byte, cfg config.AccessLogConfig) error {
+	if f.file != nil && f.needsRotation(int64(len(line)), cfg) {
+		f.rotate(cfg)
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	n, err := f.buf.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// flush writes buffered lines to the file.
+func (f *rotatingFile) flush() error {
+	if f.buf == nil {
+		return nil
+	}
+	return f.buf.Flush()
+}
+
+// open opens the file in the access log directory, which is looked up (and created) here
+// rather than for every line.
+func (f *rotatingFile) open() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	f.path = filepath.Join(dir, f.name)
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.buf = bufio.NewWriterSize(file, 64*1024)
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) needsRotation(pending int64, cfg config.AccessLogConfig) bool {
+	if f.size == 0 {
+		return false
+	}
+	if cfg.MaxSizeMB > 0 && f.size+pending > int64(cfg.MaxSizeMB)*1024*1024 {
+		return true
+	}
+	return cfg.RotateHours > 0 && time.Since(f.openedAt) > time.Duration(cfg.RotateHours)*time.Hour
+}
+
+// rotate renames the active file to <name>.<timestamp>.log and removes expired rotations.
+func (f *rotatingFile) rotate(cfg config.AccessLogConfig) {
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("Failed to write access log %s: %v", f.path, err)
+	}
+	f.file.Close()
+	f.file = nil
+	f.buf = nil
+
+	base := strings.TrimSuffix(f.path, ".log")
+	rotated := base + "." + time.Now().Format("20060102-150405.000") + ".log"
+	if err := os.Rename(f.path, rotated); err != nil {
+		log.Printf("Failed to rotate access log %s: %v", f.path, err)
+		return
+	}
+	log.Printf("Rotated access log to %s", filepath.Base(rotated))
+
+	if cfg.MaxAgeDays <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(base + ".*.log")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(cfg.MaxAgeDays) * 24 * time.Hour)
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(match); err != nil {
+				log.Printf("Failed to remove expired access log %s: %v", match, err)
+			}
+		}
+	}
+}
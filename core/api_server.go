@@ -4,16 +4,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"strings"
 
+	"github.com/soda92/vpn-share-tool/core/accesslog"
+	"github.com/soda92/vpn-share-tool/core/captchadata"
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/debug"
 	"github.com/soda92/vpn-share-tool/core/handlers"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
 	"github.com/soda92/vpn-share-tool/core/proxy"
 	"github.com/soda92/vpn-share-tool/core/register"
 	"github.com/soda92/vpn-share-tool/core/resources"
 	"github.com/soda92/vpn-share-tool/core/utils"
+	"github.com/soda92/vpn-share-tool/core/vault"
 )
 
 // StartApiServer starts the HTTP server to provide the API endpoints.
@@ -38,6 +45,7 @@ func StartApiServer(apiPort int) error {
 	}
 
 	proxy.SetGlobalConfig(MyIP, APIPort, DiscoveryServerURL, GetHTTPClient)
+	config.Load()
 
 	addProxyHandler := &handlers.AddProxyHandler{
 		GetIP:       func() string { return MyIP },
@@ -47,8 +55,12 @@ func StartApiServer(apiPort int) error {
 		IsURLReachable: utils.IsURLReachable,
 	}
 	servicesHandler := &handlers.ServicesHandler{
-		GetProxies: proxy.GetProxies,
-		GetIP:      func() string { return MyIP },
+		GetProxies:    proxy.GetProxies,
+		GetIP:         func() string { return MyIP },
+		GetSharedURLs: proxy.SharedURLs,
+	}
+	interfacesHandler := &handlers.InterfacesHandler{
+		GetInterfaces: proxy.GetInterfaces,
 	}
 
 	activeProxiesHandler := &handlers.GetActiveProxiesHandler{
@@ -56,21 +68,79 @@ func StartApiServer(apiPort int) error {
 	}
 
 	updateSettingsHandler := &handlers.UpdateSettingsHandler{
-		GetProxies: proxy.GetProxies,
+		GetProxies:          proxy.GetProxies,
+		SaveProxies:         proxy.SaveProxies,
+		ApplySettings:       proxy.ApplySettings,
+		AllowLoginMacroEdit: fromLoopback,
 	}
 
 	triggerUpdateHandler := &handlers.TriggerUpdateHandler{
 		TriggerUpdate: TriggerUpdate,
 	}
 
+	nodeConfigHandler := &handlers.NodeConfigHandler{
+		GetConfig: config.Get,
+		SetConfig: config.Set,
+	}
+
+	captchaStatsHandler := &handlers.CaptchaStatsHandler{
+		GetStats: proxy.CaptchaStats,
+	}
+
+	processorStatsHandler := &handlers.ProcessorStatsHandler{
+		GetStats:   pipeline.Stats,
+		ResetStats: pipeline.ResetStats,
+	}
+
+	captchaAccuracyHandler := &handlers.CaptchaAccuracyHandler{
+		GetAccuracy: captchadata.Accuracy,
+	}
+
+	captchaDatasetHandler := &handlers.CaptchaDatasetHandler{
+		Export: captchadata.Export,
+	}
+
+	loginCredentialsHandler := &handlers.LoginCredentialsHandler{
+		List:   vault.List,
+		Set:    vault.Set,
+		Delete: vault.Delete,
+	}
+
+	rulesHandler := &handlers.RulesHandler{
+		GetRules:  pipeline.GetRules,
+		SetRules:  pipeline.SetRules,
+		AllowPush: fromLoopbackOrDiscovery,
+	}
+
+	rulesTestHandler := &handlers.RulesTestHandler{
+		GetRules:  pipeline.GetRules,
+		TestRules: pipeline.TestRules,
+	}
+
+	accessLogsHandler := &handlers.AccessLogsHandler{
+		ListFiles: accesslog.List,
+		OpenFile:  accesslog.Open,
+		Tail:      accesslog.Tail,
+	}
+
 	// Start the HTTP server to provide the list of services
 	mux := http.NewServeMux()
 	mux.Handle("/services", servicesHandler)
+	mux.Handle("/interfaces", interfacesHandler)
 	mux.Handle("/proxies", addProxyHandler)
 	mux.Handle("/can-reach", canReachHandler)
 	mux.Handle("/active-proxies", activeProxiesHandler)
 	mux.Handle("/update-settings", updateSettingsHandler)
 	mux.Handle("/trigger-update", triggerUpdateHandler)
+	mux.Handle("/config", nodeConfigHandler)
+	mux.Handle("/access-logs", accessLogsHandler)
+	mux.Handle("/captcha-stats", captchaStatsHandler)
+	mux.Handle("/captcha-accuracy", captchaAccuracyHandler)
+	mux.Handle("/processor-stats", processorStatsHandler)
+	mux.Handle("/captcha-dataset", captchaDatasetHandler)
+	mux.Handle("/login-credentials", loginCredentialsHandler)
+	mux.Handle("/rules", rulesHandler)
+	mux.Handle("/rules/test", rulesTestHandler)
 	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		response := map[string]string{"version": Version}
@@ -97,6 +167,8 @@ func StartApiServer(apiPort int) error {
 
 	// Restore saved proxies
 	proxy.LoadProxies()
+	go proxy.StartExpiryReaper()
+	go pipeline.WatchRules()
 
 	regCfg := register.Config{
 		MyIP:              MyIP,
@@ -119,3 +191,43 @@ func StartApiServer(apiPort int) error {
 	}
 	return nil
 }
+
+// fromLoopback reports whether a request comes from this machine.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	return remote != nil && remote.IsLoopback()
+}
+
+// fromLoopbackOrDiscovery reports whether a request comes from this machine or from the host
+// of the discovery server the node registered with.
+func fromLoopbackOrDiscovery(r *http.Request) bool {
+	if fromLoopback(r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return false
+	}
+	u, err := url.Parse(DiscoveryServerURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	addrs, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,26 +2,30 @@ package cache
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"runtime/trace"
+	"strconv"
 	"time"
 
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/debug"
 )
 
 func (t *CachingTransport) handleStaticAsset(req *http.Request, reqBody []byte) (*http.Response, error) {
 	defer trace.StartRegion(req.Context(), "handleStaticAsset").End()
+	acceptEncoding := req.Header.Get("Accept-Encoding")
 	if entry, ok := t.Cache.Get(req.URL.String()); ok {
 		log.Printf("Cache HIT for static: %s", req.URL.String())
 		resp := &http.Response{
 			StatusCode: http.StatusOK,
 			Header:     entry.Header,
-			Body:       io.NopCloser(bytes.NewReader(entry.Body)),
 			Request:    req,
 		}
 		debug.CaptureRequest(req, resp, reqBody, entry.Body)
+		t.serveCacheEntry(resp, entry, acceptEncoding)
 		return resp, nil
 	}
 	log.Printf("Cache MISS for static: %s", req.URL.String())
@@ -31,6 +35,7 @@ func (t *CachingTransport) handleStaticAsset(req *http.Request, reqBody []byte)
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
+	req.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
 	resp, err := transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
@@ -46,21 +51,86 @@ func (t *CachingTransport) handleStaticAsset(req *http.Request, reqBody []byte)
 		resp.Body.Close()
 	}
 
-	// Cache if 200 OK
-	if resp.StatusCode == http.StatusOK && respBody != nil {
-		t.Cache.Add(req.URL.String(), cacheEntry{
-			Header: resp.Header,
-			Body:   respBody,
-		})
+	if respBody == nil {
+		debug.CaptureRequest(req, resp, reqBody, nil)
+		return resp, nil
 	}
 
-	if respBody != nil {
+	// Upstream was asked for encodings we can decode, so the consumer's Accept-Encoding no
+	// longer applies to what it sent. Decode on every path and re-encode for the consumer.
+	encoding := resp.Header.Get("Content-Encoding")
+	body, err := t.decompressBody(encoding, respBody)
+	if err != nil {
+		if !acceptsEncoding(acceptEncoding, encoding) {
+			return nil, fmt.Errorf("static asset %s: %w", req.URL.String(), err)
+		}
+		// The consumer can decode it itself
+		log.Printf("Passing %q-encoded static asset %s through undecoded, not caching: %v", encoding, req.URL.String(), err)
 		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		debug.CaptureRequest(req, resp, reqBody, respBody)
+		return resp, nil
 	}
-	debug.CaptureRequest(req, resp, reqBody, respBody)
+	header := resp.Header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	resp.Header = header
+
+	// Cache if 200 OK. Entries hold the identity body plus pre-compressed variants so
+	// each consumer gets an encoding it accepts without recompressing on every hit.
+	if resp.StatusCode == http.StatusOK {
+		entry := newCacheEntry(header, body)
+		t.Cache.Add(req.URL.String(), entry)
+		debug.CaptureRequest(req, resp, reqBody, entry.Body)
+		t.serveCacheEntry(resp, entry, acceptEncoding)
+		return resp, nil
+	}
+
+	debug.CaptureRequest(req, resp, reqBody, body)
+	body = t.compressForConsumer(acceptEncoding, resp.Header, body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
 	return resp, nil
 }
 
+// newCacheEntry builds a cache entry for an identity body, pre-compressing it when worthwhile.
+func newCacheEntry(header http.Header, body []byte) cacheEntry {
+	entry := cacheEntry{Header: header, Body: body}
+	if len(body) < config.Get().CompressionMinBytes || !isCompressible(header.Get("Content-Type")) {
+		return entry
+	}
+	entry.Variants = map[string][]byte{}
+	for _, encoding := range consumerEncodings {
+		compressed, err := compressBody(encoding, body)
+		if err != nil {
+			log.Printf("Error pre-compressing cached asset with %s: %v", encoding, err)
+			continue
+		}
+		if len(compressed) < len(body) {
+			entry.Variants[encoding] = compressed
+		}
+	}
+	return entry
+}
+
+// serveCacheEntry fills resp from a cache entry, choosing a pre-compressed variant when the
+// consumer accepts one and compression is enabled for the proxy.
+func (t *CachingTransport) serveCacheEntry(resp *http.Response, entry cacheEntry, acceptEncoding string) {
+	header := entry.Header.Clone()
+	body := entry.Body
+	if len(entry.Variants) > 0 && t.shouldCompress(header, len(body)) {
+		header.Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(acceptEncoding)
+		if variant, ok := entry.Variants[encoding]; ok {
+			header.Set("Content-Encoding", encoding)
+			body = variant
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header = header
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+}
+
 func (t *CachingTransport) handleDynamicAsset(req *http.Request, reqBody []byte) (*http.Response, error) {
 	start := time.Now()
 	defer func() {
@@ -80,6 +150,11 @@ func (t *CachingTransport) handleDynamicAsset(req *http.Request, reqBody []byte)
 	req.Header.Del("If-Modified-Since")
 	req.Header.Del("If-None-Match")
 
+	// Negotiate compression toward the consumer ourselves; ask upstream only for encodings
+	// decompressBody can read.
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	req.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+
 	netRegion := trace.StartRegion(req.Context(), "NetworkWait")
 	resp, err := transport.RoundTrip(req)
 	netRegion.End()
@@ -100,6 +175,10 @@ func (t *CachingTransport) handleDynamicAsset(req *http.Request, reqBody []byte)
 		return resp, nil
 	}
 
+	if t.StreamProcessor != nil {
+		return t.streamPipeline(req, resp, reqBody, acceptEncoding)
+	}
+
 	readRegion := trace.StartRegion(req.Context(), "ReadBody")
 	respBody, err := io.ReadAll(resp.Body)
 	readRegion.End()
@@ -120,10 +199,13 @@ func (t *CachingTransport) handleDynamicAsset(req *http.Request, reqBody []byte)
 		return nil, err
 	}
 
+	t.checkCaptchaLogin(req, resp, decompressedBody)
+
 	// Run Pipeline
 	pipelineRegion := trace.StartRegion(req.Context(), "Pipeline")
-	newBody, modified := t.runPipeline(req, resp.Header, decompressedBody)
+	newBody, modified, processing := t.runPipeline(req, resp, decompressedBody)
 	pipelineRegion.End()
+	t.recordPageCharset(req, resp, modified, processing.Charset)
 
 	if modified {
 		respBody = newBody
@@ -135,7 +217,12 @@ func (t *CachingTransport) handleDynamicAsset(req *http.Request, reqBody []byte)
 		resp.Header.Del("Content-Length")
 	}
 
+	debug.CaptureProcessedRequest(req, resp, reqBody, decompressedBody, respBody, processing)
+
+	compressRegion := trace.StartRegion(req.Context(), "Compress")
+	respBody = t.compressForConsumer(acceptEncoding, resp.Header, respBody)
+	compressRegion.End()
+
 	resp.Body = io.NopCloser(bytes.NewBuffer(respBody))
-	debug.CaptureRequest(req, resp, reqBody, decompressedBody)
 	return resp, nil
 }
@@ -1,31 +1,45 @@
 package cache
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
 	_ "embed"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"runtime/trace"
+	"sync"
 
+	"github.com/andybalholm/brotli"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/models"
 )
 
 // cacheEntry holds the cached response data and headers.
 type cacheEntry struct {
 	Header http.Header
-	Body   []byte
+	Body   []byte // Identity (uncompressed) body
+	// Variants holds pre-compressed copies of Body keyed by content coding ("gzip", "br").
+	Variants map[string][]byte
 }
 
-// CaptchaProvider defines the interface for captcha operations.
+// CaptchaProvider defines the interface for captcha operations. Solutions are keyed by
+// consumer session (see captchaSession).
 type CaptchaProvider interface {
-	Solve(imgData []byte) string
-	Store(clientIP, solution string)
-	Get(clientIP string) string
-	Clear(clientIP string)
+	// Solve solves an image of the profile's captcha for the session, giving up when ctx is done.
+	Solve(ctx context.Context, session string, profile config.CaptchaProfile, imgData []byte) string
+	Store(session, solution string)
+	// Wait blocks until a solution for session is stored or ctx is done, returning "" then.
+	Wait(ctx context.Context, session string) string
+	Clear(session string)
+	// LoginResult reports whether the session's login accepted the last solution.
+	LoginResult(session string, correct bool)
 }
 
 // CachingTransport is an http.RoundTripper that caches responses for static assets.
@@ -35,6 +49,14 @@ type CachingTransport struct {
 	Proxy           *models.SharedProxy
 	CaptchaProvider CaptchaProvider
 	Processor       StringProcessor
+	// StreamProcessor, if set, is used instead of Processor so bodies aren't copied per
+	// processor and reach the consumer as they are processed.
+	StreamProcessor StreamProcessor
+
+	charsets *pageCharsets
+
+	captchaSolves     map[string]*captchaSolve // Running solve per consumer session
+	captchaSolvesLock sync.Mutex
 }
 
 func NewCachingTransport(transport http.RoundTripper, proxy *models.SharedProxy, captchaProvider CaptchaProvider, processor StringProcessor) *CachingTransport {
@@ -49,6 +71,7 @@ func NewCachingTransport(transport http.RoundTripper, proxy *models.SharedProxy,
 		Proxy:           proxy,
 		CaptchaProvider: captchaProvider,
 		Processor:       processor,
+		charsets:        newPageCharsets(),
 	}
 }
 
@@ -67,20 +90,32 @@ func (t *CachingTransport) readRequestBody(req *http.Request) ([]byte, error) {
 }
 
 func (t *CachingTransport) decompressBody(encoding string, body []byte) ([]byte, error) {
-	var reader io.ReadCloser
-	var err error
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	reader, err := decompressReader(encoding, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// decompressReader returns a reader decoding r, a body with the given Content-Encoding.
+func decompressReader(encoding string, r io.Reader) (io.Reader, error) {
 	switch encoding {
 	case "gzip":
-		reader, err = gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			return nil, err
-		}
-		defer reader.Close()
+		return gzip.NewReader(r)
 	case "deflate":
-		reader = flate.NewReader(bytes.NewReader(body))
-		defer reader.Close()
-	default:
-		return body, nil
+		// HTTP deflate is zlib-wrapped, but some servers send a raw deflate stream
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	case "", "identity":
+		return r, nil
 	}
-	return io.ReadAll(reader)
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
 }
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// metaPrescanBytes is how far into an HTML document a meta tag may declare its charset.
+const metaPrescanBytes = 1024
+
+// headScanBytes is how far into an HTML document setUTF8 looks for the end of its head.
+const headScanBytes = 64 << 10
+
+// reMetaCharset matches the charset of <meta charset> and of the content of
+// <meta http-equiv="Content-Type">, with the value in group 2.
+var reMetaCharset = regexp.MustCompile(`(?i)(<meta\b[^>]*?\bcharset\s*=\s*["']?)([\w.:-]+)`)
+
+var boms = []struct {
+	bom   []byte
+	label string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+	{[]byte{0xfe, 0xff}, "utf-16be"},
+	{[]byte{0xff, 0xfe}, "utf-16le"},
+}
+
+// SniffCharset returns the encoding of a text body and its name, from a byte order mark, the
+// charset of the Content-Type or, for HTML, a meta tag at the start of the document. It returns
+// nil for UTF-8 and for bodies that don't declare a known charset.
+func SniffCharset(contentType string, body []byte) (encoding.Encoding, string) {
+	label := ""
+	for _, b := range boms {
+		if bytes.HasPrefix(body, b.bom) {
+			label = b.label
+			break
+		}
+	}
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if label == "" {
+		label = params["charset"]
+	}
+	if label == "" && (mediaType == "text/html" || mediaType == "application/xhtml+xml") {
+		if m := reMetaCharset.FindSubmatch(body[:min(len(body), metaPrescanBytes)]); m != nil {
+			label = string(m[2])
+			// A document that could be read to find its meta tag can't be UTF-16
+			if strings.HasPrefix(strings.ToLower(label), "utf-16") {
+				label = "utf-8"
+			}
+		}
+	}
+	if label == "" {
+		return nil, ""
+	}
+
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		log.Printf("Unknown charset %q, treating the body as UTF-8", label)
+		return nil, ""
+	}
+	if name == "utf-8" {
+		return nil, ""
+	}
+	return enc, name
+}
+
+// DecodeText returns the body as UTF-8 text and the name of the charset it was decoded from,
+// or "" if it was already UTF-8.
+func DecodeText(contentType string, body []byte) (string, string) {
+	enc, name := SniffCharset(contentType, body)
+	if enc == nil {
+		return string(body), ""
+	}
+	decoded, err := io.ReadAll(transform.NewReader(bytes.NewReader(body), decoder(enc)))
+	if err != nil {
+		log.Printf("Error decoding %s body: %v", name, err)
+		return string(body), ""
+	}
+	return string(decoded), name
+}
+
+// decoder returns a decoder from enc that drops a byte order mark.
+func decoder(enc encoding.Encoding) transform.Transformer {
+	return unicode.BOMOverride(enc.NewDecoder())
+}
+
+// setUTF8 declares a body decoded to UTF-8 as such, in the charset of its Content-Type and,
+// for HTML, in the meta tags of its head. Declarations further in are left alone, as they
+// are not used to pick the charset.
+func setUTF8(header http.Header, body []byte) []byte {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return body
+	}
+	params["charset"] = "utf-8"
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return body
+	}
+
+	var head []byte
+	if i := bytes.Index(bytes.ToLower(body[:min(len(body), headScanBytes)]), []byte("</head>")); i >= 0 {
+		head = body[:i]
+	} else {
+		head = body[:min(len(body), metaPrescanBytes)]
+	}
+	rewritten := reMetaCharset.ReplaceAll(head, []byte("${1}utf-8"))
+	if bytes.Equal(rewritten, head) {
+		return body
+	}
+	return append(rewritten, body[len(head):]...)
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func mustEncode(t *testing.T, enc encoding.Encoding, s string) []byte {
+	t.Helper()
+	b, err := enc.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatalf("Failed to encode %q: %v", s, err)
+	}
+	return b
+}
+
+// streamProcessor runs a string processor as a StreamProcessor.
+func streamProcessor(process func(*models.ProcessingContext, string) string) StreamProcessor {
+	return func(ctx *models.ProcessingContext, r io.Reader, w io.Writer) error {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, process(ctx, string(body)))
+		return err
+	}
+}
+
+func TestSniffCharset(t *testing.T) {
+	utf16 := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{"header", "text/html; charset=GB2312", []byte("<p>x</p>"), "gbk"},
+		{"gb18030 header", "application/javascript; charset=gb18030", []byte("x()"), "gb18030"},
+		{"meta charset", "text/html", []byte(`<html><head><meta charset="big5"></head>`), "big5"},
+		{"meta http-equiv", "text/html", []byte(`<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=gbk">`), "gbk"},
+		{"header over meta", "text/html; charset=big5", []byte(`<meta charset="gbk">`), "big5"},
+		{"bom over header", "text/html; charset=gbk", mustEncode(t, utf16, "<p>x</p>"), "utf-16le"},
+		{"meta in script", "application/javascript", []byte(`document.write('<meta charset="gbk">')`), ""},
+		{"utf-8", "text/html", []byte(`<meta charset="UTF-8">`), ""},
+		{"undeclared", "text/html", []byte("<p>患者</p>"), ""},
+		{"unknown", "text/html; charset=x-unknown", []byte("<p>x</p>"), ""},
+	} {
+		if _, got := SniffCharset(tc.contentType, tc.body); got != tc.want {
+			t.Errorf("%s: expected charset %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestRunPipelineCharsets(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		enc         encoding.Encoding
+		contentType string
+		page        string
+		wantType    string
+		wantPage    string
+	}{
+		{
+			name:        "big5 meta",
+			enc:         traditionalchinese.Big5,
+			contentType: "text/html",
+			page:        `<html><head><meta http-equiv="Content-Type" content="text/html; charset=big5"></head><body>病歷 old</body></html>`,
+			wantType:    "text/html; charset=utf-8",
+			wantPage:    `<html><head><meta http-equiv="Content-Type" content="text/html; charset=utf-8"></head><body>病歷 new</body></html>`,
+		},
+		{
+			name:        "gb18030 header and meta",
+			enc:         simplifiedchinese.GB18030,
+			contentType: "text/html; charset=GB18030",
+			page:        `<html><head><meta charset="gb18030"><title>𠀀</title></head><body>患者 old <meta charset="gb18030"></body></html>`,
+			wantType:    "text/html; charset=utf-8",
+			wantPage:    `<html><head><meta charset="utf-8"><title>𠀀</title></head><body>患者 new <meta charset="gb18030"></body></html>`,
+		},
+		{
+			name:        "gbk script",
+			enc:         simplifiedchinese.GBK,
+			contentType: "application/javascript; charset=gbk",
+			page:        `alert("患者 old")`,
+			wantType:    "application/javascript; charset=utf-8",
+			wantPage:    `alert("患者 new")`,
+		},
+	} {
+		upstream := mustEncode(t, tc.enc, tc.page)
+		for _, stream := range []bool{false, true} {
+			transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+			process := func(ctx *models.ProcessingContext, body string) string {
+				return strings.ReplaceAll(body, "old", "new")
+			}
+			transport.Processor = process
+			if stream {
+				transport.StreamProcessor = streamProcessor(process)
+				header := http.Header{}
+				header.Set("Content-Type", tc.contentType)
+				resp := streamResponse(t, transport, header, bytes.NewReader(upstream), "")
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != tc.wantPage || resp.Header.Get("Content-Type") != tc.wantType {
+					t.Errorf("%s (stream): expected the page as UTF-8, got %s (%s)", tc.name, body, resp.Header.Get("Content-Type"))
+				}
+				continue
+			}
+
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+			resp.Header.Set("Content-Type", tc.contentType)
+			body, modified, processing := transport.runPipeline(httptest.NewRequest(http.MethodGet, "/index.jsp", nil), resp, upstream)
+			if !modified || string(body) != tc.wantPage || resp.Header.Get("Content-Type") != tc.wantType || processing.Charset == "" {
+				t.Errorf("%s: expected the page as UTF-8, got %s (%s, %q)", tc.name, body, resp.Header.Get("Content-Type"), processing.Charset)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+// upstreamAcceptEncoding lists the encodings decompressBody understands. It replaces the
+// browser's Accept-Encoding so upstreams never send something the pipeline can't read.
+const upstreamAcceptEncoding = "gzip, deflate, br"
+
+// consumerEncodings are the encodings offered to browsers, in order of preference.
+var consumerEncodings = []string{"br", "gzip"}
+
+// parseAcceptEncoding returns the q-value of each encoding listed in acceptEncoding.
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if v, ok := strings.CutPrefix(param, "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the preferred encoding the client accepts, or "" for identity.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	best, bestQ := "", 0.0
+	for _, enc := range consumerEncodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// acceptsEncoding reports whether a client sending acceptEncoding can decode a body with
+// the given Content-Encoding.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+	accepted := parseAcceptEncoding(acceptEncoding)
+	q, ok := accepted[encoding]
+	if !ok {
+		q, ok = accepted["*"]
+	}
+	return ok && q > 0
+}
+
+// isCompressible reports whether a response of this content type benefits from compression.
+// Images other than SVG and WOFF/WOFF2 fonts are already compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/x-javascript", "application/json",
+		"application/xml", "application/xhtml+xml", "image/svg+xml", "image/x-icon",
+		"image/vnd.microsoft.icon", "font/ttf", "font/otf", "application/x-font-ttf",
+		"application/vnd.ms-fontobject":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := compressWriter(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressWriter returns a writer compressing into w with one of consumerEncodings.
+func compressWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriterLevel(w, 5), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+// shouldCompress reports whether an identity body with the given header should be compressed
+// for the consumer.
+func (t *CachingTransport) shouldCompress(header http.Header, size int) bool {
+	if t.Proxy != nil {
+		t.Proxy.Mu.RLock()
+		enabled := t.Proxy.Settings.EnableCompression
+		t.Proxy.Mu.RUnlock()
+		if !enabled {
+			return false
+		}
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return size >= config.Get().CompressionMinBytes && isCompressible(header.Get("Content-Type"))
+}
+
+// compressForConsumer compresses a pipeline-processed body with the encoding negotiated from
+// acceptEncoding and updates the headers. The body is returned unchanged when compression
+// does not apply.
+func (t *CachingTransport) compressForConsumer(acceptEncoding string, header http.Header, body []byte) []byte {
+	if !t.shouldCompress(header, len(body)) {
+		return body
+	}
+	header.Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(acceptEncoding)
+	if encoding == "" {
+		return body
+	}
+	compressed, err := compressBody(encoding, body)
+	if err != nil || len(compressed) >= len(body) {
+		return body
+	}
+	header.Set("Content-Encoding", encoding)
+	header.Set("Content-Length", strconv.Itoa(len(compressed)))
+	return compressed
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"gzip, deflate":             "gzip",
+		"gzip, deflate, br":         "br",
+		"br;q=0.5, gzip":            "gzip",
+		"br;q=0, gzip;q=0":          "",
+		"*":                         "br",
+		"identity, *;q=0.1, br;q=0": "gzip",
+	}
+	for header, expected := range tests {
+		if got := negotiateEncoding(header); got != expected {
+			t.Errorf("negotiateEncoding(%q) = %q, expected %q", header, got, expected)
+		}
+	}
+}
+
+func TestStaticAssetServesPrecompressedVariant(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(`<rect width="1" height="1"/>`, 200) + `</svg>`
+	upstreamRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, svg)
+	}))
+	defer upstream.Close()
+
+	p := &models.SharedProxy{Settings: models.ProxySettings{EnableCompression: true}}
+	transport := NewCachingTransport(http.DefaultTransport, p, nil, nil)
+
+	fetch := func(acceptEncoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/icons/logo.svg", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		return resp
+	}
+
+	// Miss: served compressed and cached
+	resp := fetch("gzip, br")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Expected br on cache miss, got %q", enc)
+	}
+	body, _ := io.ReadAll(brotli.NewReader(resp.Body))
+	if string(body) != svg {
+		t.Errorf("Decoded br body does not match upstream body")
+	}
+
+	// Hit from a client without compression support gets the identity body
+	resp = fetch("")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected identity encoding, got %q", enc)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if !bytes.Equal(body, []byte(svg)) {
+		t.Errorf("Identity body does not match upstream body")
+	}
+
+	// Compression toggled off for the proxy
+	p.Settings.EnableCompression = false
+	resp = fetch("gzip")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected no encoding with compression disabled, got %q", enc)
+	}
+
+	if upstreamRequests != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", upstreamRequests)
+	}
+}
+
+func TestStaticAssetErrorIsDecodedForConsumer(t *testing.T) {
+	page := strings.Repeat("<p>Not found</p>", 200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The upstream answers in br because we asked for it, not the consumer
+		body, _ := compressBody("br", []byte(page))
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "br")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/missing.css", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected identity encoding for a consumer without br, got %q", enc)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != page {
+		t.Errorf("Expected the decoded upstream body")
+	}
+}
+
+func TestDeflateUpstreamBodyIsDecoded(t *testing.T) {
+	page := strings.Repeat("<p>row</p>", 200)
+	var zlibBody, rawBody bytes.Buffer
+	zw := zlib.NewWriter(&zlibBody)
+	zw.Write([]byte(page))
+	zw.Close()
+	fw, _ := flate.NewWriter(&rawBody, flate.DefaultCompression)
+	fw.Write([]byte(page))
+	fw.Close()
+
+	// HTTP deflate is zlib-wrapped; some servers send a raw deflate stream instead
+	for name, encoded := range map[string][]byte{"zlib": zlibBody.Bytes(), "raw": rawBody.Bytes()} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "deflate")
+			w.Write(encoded)
+		}))
+
+		transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/index.jsp", nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			upstream.Close()
+			t.Fatalf("RoundTrip failed for %s deflate: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		upstream.Close()
+		if string(body) != page {
+			t.Errorf("Expected the %s deflate body to be decoded, got %d bytes", name, len(body))
+		}
+	}
+}
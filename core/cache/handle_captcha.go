@@ -2,20 +2,23 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
 )
 
 func (t *CachingTransport) handleCaptchaImage(req *http.Request, reqBody []byte) (*http.Response, error) {
-	if !strings.HasSuffix(req.URL.Path, "voCode") || t.Proxy == nil {
+	if t.Proxy == nil {
 		return nil, nil
 	}
 
 	// Check if content modification is enabled.
-	// We could also check if "PHIS" is in ActiveSystems, but path check is strong enough here.
 	t.Proxy.Mu.RLock()
 	enabled := t.Proxy.Settings.EnableContentMod
 	t.Proxy.Mu.RUnlock()
@@ -24,6 +27,11 @@ func (t *CachingTransport) handleCaptchaImage(req *http.Request, reqBody []byte)
 		return nil, nil
 	}
 
+	profile, ok := pipeline.CaptchaProfileForImage(t.Proxy, req.URL.Path)
+	if !ok {
+		return nil, nil
+	}
+
 	transport := t.Transport
 	if transport == nil {
 		transport = http.DefaultTransport
@@ -44,16 +52,14 @@ func (t *CachingTransport) handleCaptchaImage(req *http.Request, reqBody []byte)
 
 	// Solve and Store (Async to avoid blocking image load)
 	if len(respBody) > 0 && t.CaptchaProvider != nil {
-		clientIP := getClientIP(req)
-		// Clear old solution immediately to prevent JS from picking up stale data
-		t.CaptchaProvider.Clear(clientIP)
+		session := captchaSession(req)
+		ctx, solve := t.startCaptchaSolve(session)
 
-		go func(data []byte, ip string) {
-			solution := t.CaptchaProvider.Solve(data)
-			if solution != "" {
-				t.CaptchaProvider.Store(ip, solution)
-			}
-		}(respBody, clientIP)
+		go func(data []byte, session string) {
+			defer t.endCaptchaSolve(session, solve)
+			solution := t.CaptchaProvider.Solve(ctx, session, profile, data)
+			t.storeCaptchaSolution(session, solve, solution)
+		}(respBody, session)
 	}
 
 	resp.Body = io.NopCloser(bytes.NewReader(respBody))
@@ -61,6 +67,74 @@ func (t *CachingTransport) handleCaptchaImage(req *http.Request, reqBody []byte)
 	return resp, nil
 }
 
+// captchaSolve is a running solve of one captcha image. A newer image of the same session
+// supersedes it.
+type captchaSolve struct {
+	cancel context.CancelFunc
+}
+
+// startCaptchaSolve supersedes the session's running solve, if any, and clears its old
+// solution immediately to prevent JS from picking up stale data.
+func (t *CachingTransport) startCaptchaSolve(session string) (context.Context, *captchaSolve) {
+	ctx, cancel := context.WithCancel(context.Background())
+	solve := &captchaSolve{cancel: cancel}
+
+	t.captchaSolvesLock.Lock()
+	defer t.captchaSolvesLock.Unlock()
+	if t.captchaSolves == nil {
+		t.captchaSolves = make(map[string]*captchaSolve)
+	}
+	if previous, ok := t.captchaSolves[session]; ok {
+		previous.cancel()
+	}
+	t.captchaSolves[session] = solve
+	t.CaptchaProvider.Clear(session)
+	return ctx, solve
+}
+
+// storeCaptchaSolution stores the solution unless a newer image superseded the solve.
+func (t *CachingTransport) storeCaptchaSolution(session string, solve *captchaSolve, solution string) {
+	t.captchaSolvesLock.Lock()
+	defer t.captchaSolvesLock.Unlock()
+	if solution != "" && t.captchaSolves[session] == solve {
+		t.CaptchaProvider.Store(session, solution)
+	}
+}
+
+func (t *CachingTransport) endCaptchaSolve(session string, solve *captchaSolve) {
+	t.captchaSolvesLock.Lock()
+	if t.captchaSolves[session] == solve {
+		delete(t.captchaSolves, session)
+	}
+	t.captchaSolvesLock.Unlock()
+	solve.cancel()
+}
+
+// checkCaptchaLogin reports the outcome of a login that submitted a captcha, judged by the
+// profile's login rules against the decoded response.
+func (t *CachingTransport) checkCaptchaLogin(req *http.Request, resp *http.Response, body []byte) {
+	profile, ok := t.captchaLoginProfile(req)
+	if !ok {
+		return
+	}
+	text, _ := DecodeText(resp.Header.Get("Content-Type"), body)
+	accepted := pipeline.CaptchaLoginAccepted(profile, resp.StatusCode, resp.Header, text)
+	t.CaptchaProvider.LoginResult(captchaSession(req), accepted)
+}
+
+// captchaLoginProfile returns the captcha profile whose login req submits, if any.
+func (t *CachingTransport) captchaLoginProfile(req *http.Request) (config.CaptchaProfile, bool) {
+	if req.Method != http.MethodPost || t.Proxy == nil || t.CaptchaProvider == nil {
+		return config.CaptchaProfile{}, false
+	}
+	return pipeline.CaptchaProfileForLogin(t.Proxy, req.URL.Path)
+}
+
+// captchaPollTimeout is how long a poll waits for a solution before the script polls again.
+var captchaPollTimeout = 25 * time.Second
+
+// handleCaptchaPoll long-polls for the session's solution. It answers 200 with the solution
+// as soon as one is stored, or 204 if none arrived within captchaPollTimeout.
 func (t *CachingTransport) handleCaptchaPoll(req *http.Request) *http.Response {
 	if !strings.HasSuffix(req.URL.Path, "/_proxy/captcha-solution") {
 		return nil
@@ -70,22 +144,26 @@ func (t *CachingTransport) handleCaptchaPoll(req *http.Request) *http.Response {
 		return nil
 	}
 
-	clientIP := getClientIP(req)
-	solution := t.CaptchaProvider.Get(clientIP)
+	ctx, cancel := context.WithTimeout(req.Context(), captchaPollTimeout)
+	defer cancel()
+	solution := t.CaptchaProvider.Wait(ctx, captchaSession(req))
 
+	header := make(http.Header)
+	header.Set("Cache-Control", "no-store")
 	if solution != "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
 		return &http.Response{
 			StatusCode: http.StatusOK,
-			Header:     make(http.Header),
+			Header:     header,
 			Body:       io.NopCloser(bytes.NewBufferString(solution)),
 			Request:    req,
 		}
 	}
-	// Not ready yet
+	// Not ready yet; JS polls again
 	return &http.Response{
-		StatusCode: http.StatusNotFound, // JS will retry
-		Header:     make(http.Header),
-		Body:       io.NopCloser(bytes.NewBufferString("Not found")),
+		StatusCode: http.StatusNoContent,
+		Header:     header,
+		Body:       http.NoBody,
 		Request:    req,
 	}
 }
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+type fakeCaptchaProvider struct {
+	mu        sync.Mutex
+	solutions map[string]string
+	logins    chan bool // Receives login results, if set
+}
+
+func (f *fakeCaptchaProvider) Solve(ctx context.Context, session string, profile config.CaptchaProfile, imgData []byte) string {
+	return string(imgData)
+}
+func (f *fakeCaptchaProvider) Store(session, solution string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.solutions[session] = solution
+}
+func (f *fakeCaptchaProvider) Wait(ctx context.Context, session string) string { return "" }
+func (f *fakeCaptchaProvider) Clear(session string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.solutions, session)
+}
+func (f *fakeCaptchaProvider) LoginResult(session string, correct bool) {
+	if f.logins != nil {
+		f.logins <- correct
+	}
+}
+
+func TestSupersededCaptchaSolveIsNotStored(t *testing.T) {
+	provider := &fakeCaptchaProvider{solutions: map[string]string{}}
+	transport := &CachingTransport{CaptchaProvider: provider}
+
+	// An operator is still looking at the first image when the page reloads the captcha
+	staleCtx, stale := transport.startCaptchaSolve("session:a")
+	_, current := transport.startCaptchaSolve("session:a")
+	if staleCtx.Err() == nil {
+		t.Errorf("Expected the superseded solve to be cancelled")
+	}
+
+	transport.storeCaptchaSolution("session:a", current, "fresh")
+	transport.storeCaptchaSolution("session:a", stale, "stale")
+	transport.endCaptchaSolve("session:a", stale)
+	if got := provider.solutions["session:a"]; got != "fresh" {
+		t.Errorf("Expected the current image's solution, got %q", got)
+	}
+
+	transport.endCaptchaSolve("session:a", current)
+	if len(transport.captchaSolves) != 0 {
+		t.Errorf("Expected finished solves to be forgotten, got %v", transport.captchaSolves)
+	}
+}
@@ -1,20 +1,27 @@
 package cache
 
 import (
+	"net"
 	"net/http"
-	"strings"
+
+	"github.com/soda92/vpn-share-tool/core/models"
 )
 
-func getClientIP(req *http.Request) string {
-	// Get Client IP
-	clientIP := req.Header.Get("X-Forwarded-For")
-	if clientIP == "" {
-		clientIP = req.RemoteAddr
-	}
-	if strings.Contains(clientIP, ",") {
-		clientIP = strings.Split(clientIP, ",")[0]
+// captchaSession returns the consumer session captcha solutions are keyed by. The proxy
+// handler sets it from its session cookie; otherwise the connection's IP is used.
+func captchaSession(req *http.Request) string {
+	if session, ok := req.Context().Value(models.CaptchaSessionKey).(string); ok && session != "" {
+		return session
 	}
-	clientIP = strings.TrimSpace(clientIP)
+	return "ip:" + getClientIP(req)
+}
 
-	return clientIP
+// getClientIP returns the IP of the connection. X-Forwarded-For is not trusted since any
+// client can set it.
+func getClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
@@ -16,6 +16,8 @@ func (t *CachingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	if err != nil {
 		return nil, err
 	}
+	// The body is captured as the consumer sent it, in UTF-8
+	t.encodeForUpstream(req, reqBody)
 
 	// 1. Intercept calendar.js
 	if resp := t.handleCalendarJS(req, reqBody); resp != nil {
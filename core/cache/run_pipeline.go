@@ -1,64 +1,280 @@
 package cache
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"log"
-	"mime"
 	"net/http"
-	"strings"
+	"runtime/trace"
 
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
 	"github.com/soda92/vpn-share-tool/core/models"
-	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 )
 
-func (t *CachingTransport) runPipeline(req *http.Request, header http.Header, body []byte) ([]byte, bool) {
+// runPipeline runs the processor over the response body, returning the new body, whether it
+// changed and which processors ran. A processor dropping the response turns it into a 204
+// No Content.
+func (t *CachingTransport) runPipeline(req *http.Request, resp *http.Response, body []byte) ([]byte, bool, debug.Processing) {
 	if t.Processor == nil {
-		return body, false
+		return body, false, debug.Processing{}
 	}
 
-	var bodyStr string
+	header := resp.Header
+	ctx := &models.ProcessingContext{
+		ReqURL:     req.URL,
+		ReqContext: req.Context(),
+		RespHeader: header,
+		Status:     resp.StatusCode,
+		Proxy:      t.Proxy,
+	}
 	contentType := header.Get("Content-Type")
-	isGBK := false
-	if _, params, err := mime.ParseMediaType(contentType); err == nil {
-		charset := strings.ToLower(params["charset"])
-		isGBK = charset == "gbk" || charset == "gb2312"
-	}
-
-	if isGBK {
-		reader := transform.NewReader(bytes.NewReader(body), simplifiedchinese.GBK.NewDecoder())
-		decoded, err := io.ReadAll(reader)
-		if err != nil {
-			log.Printf("Error decoding GBK body: %v", err)
-			bodyStr = string(body)
-		} else {
-			bodyStr = string(decoded)
+	bodyStr, charset := DecodeText(contentType, body)
+
+	originalBodyStr := bodyStr
+
+	// Use the injected processor
+	bodyStr = t.Processor(ctx, bodyStr)
+	if ctx.Drop {
+		dropResponse(req, resp)
+		return []byte{}, true, processing(ctx, charset)
+	}
+
+	if bodyStr != originalBodyStr {
+		newBody := []byte(bodyStr)
+		if charset != "" {
+			newBody = setUTF8(header, newBody)
 		}
-	} else {
-		bodyStr = string(body)
+		return newBody, true, processing(ctx, charset)
 	}
+	return body, false, processing(ctx, charset)
+}
 
-	originalBodyStr := bodyStr
+func processing(ctx *models.ProcessingContext, charset string) debug.Processing {
+	return debug.Processing{Processors: ctx.Processors, ModifiedBy: ctx.ModifiedBy, Charset: charset}
+}
+
+// dropResponse turns a response a processor dropped into a 204 No Content.
+func dropResponse(req *http.Request, resp *http.Response) {
+	log.Printf("Dropped response for %s", req.URL.String())
+	resp.StatusCode = http.StatusNoContent
+	resp.Status = "204 No Content"
+	resp.Header.Del("Content-Type")
+}
+
+// streamPipeline runs the StreamProcessor over a dynamic response on its way to the consumer.
+// The processed body is written into a pipe that becomes the response body, so it reaches
+// the consumer while the upstream is still sending it. The response is returned once its
+// headers are settled (see streamWriter); until then processors may still set headers or
+// drop the response. The body is always decoded to UTF-8 and sent as processed, since
+// telling whether the processors changed it would take the whole body.
+func (t *CachingTransport) streamPipeline(req *http.Request, resp *http.Response, reqBody []byte, acceptEncoding string) (*http.Response, error) {
+	upstreamResp := *resp
+	upstreamResp.Header = resp.Header.Clone()
+	upstream := resp.Body
+	decompressed, err := decompressReader(resp.Header.Get("Content-Encoding"), upstream)
+	if err != nil {
+		upstream.Close()
+		log.Printf("Error decompressing response body: %v", err)
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	// The upstream body is only kept when a captcha login check or the debug capture needs it
+	capture := debug.Capturing()
+	_, loginCheck := t.captchaLoginProfile(req)
+	var upstreamBody *bytes.Buffer
+	if capture || loginCheck {
+		upstreamBody = new(bytes.Buffer)
+		decompressed = io.TeeReader(decompressed, upstreamBody)
+	}
+	src := bufio.NewReaderSize(decompressed, metaPrescanBytes)
+	// A short body or a read error shows up again when the body is read
+	prefix, _ := src.Peek(metaPrescanBytes)
+	enc, charset := SniffCharset(resp.Header.Get("Content-Type"), prefix)
+	var text io.Reader = src
+	if enc != nil {
+		text = transform.NewReader(src, decoder(enc))
+	}
+	t.recordPageCharset(req, resp, true, charset)
 
 	ctx := &models.ProcessingContext{
 		ReqURL:     req.URL,
 		ReqContext: req.Context(),
-		RespHeader: header,
+		RespHeader: resp.Header,
+		Status:     resp.StatusCode,
 		Proxy:      t.Proxy,
 	}
+	pr, pw := io.Pipe()
+	w := newStreamWriter(t, resp, acceptEncoding, charset != "", pw)
+	if capture {
+		w.final = new(bytes.Buffer)
+	}
+	resp.Body = pr
 
-	// Use the injected processor
-	bodyStr = t.Processor(ctx, bodyStr)
+	go func() {
+		region := trace.StartRegion(req.Context(), "Pipeline")
+		err := t.StreamProcessor(ctx, text, w)
+		region.End()
+		upstream.Close()
+		switch {
+		case err != nil:
+			if !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("Error processing body of %s: %v", req.URL.String(), err)
+			}
+			w.fail(err)
+			return
+		case ctx.Drop:
+			w.drop(req)
+		default:
+			if err := w.Close(); err != nil {
+				return
+			}
+		}
+		if loginCheck {
+			t.checkCaptchaLogin(req, &upstreamResp, upstreamBody.Bytes())
+		}
+		if capture {
+			debug.CaptureProcessedRequest(req, w.released, reqBody, upstreamBody.Bytes(), w.final.Bytes(), processing(ctx, charset))
+		}
+	}()
 
-	if bodyStr != originalBodyStr {
-		if isGBK {
-			if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
-				params["charset"] = "utf-8"
-				header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	<-w.ready
+	if w.err != nil {
+		return nil, w.err
+	}
+	return resp, nil
+}
+
+// streamWriter takes the processed body of a streamed response. It holds back the head of the
+// body until the response headers can be settled from it: a page decoded to UTF-8 declares
+// so in its head, and only bodies of CompressionMinBytes are compressed. Then the response is
+// released and the body flows on into the pipe, compressed if negotiated. A body that ends
+// within the head is sent like a buffered one.
+type streamWriter struct {
+	t              *CachingTransport
+	resp           *http.Response
+	acceptEncoding string
+	toUTF8         bool // The body was decoded to UTF-8 and must be declared as such
+	holdBack       int
+	pw             *io.PipeWriter
+
+	head       []byte
+	out        io.Writer // Once released: the pipe, or the compressor writing into it
+	compressor io.WriteCloser
+	final      *bytes.Buffer // Body sent to the consumer before compression, if kept for the debug capture
+
+	ready    chan struct{}  // Closed when the response is released or failed
+	released *http.Response // Copy of resp as released
+	err      error          // Set instead if the response failed before it was released
+}
+
+func newStreamWriter(t *CachingTransport, resp *http.Response, acceptEncoding string, toUTF8 bool, pw *io.PipeWriter) *streamWriter {
+	holdBack := max(config.Get().CompressionMinBytes, 1)
+	if toUTF8 {
+		holdBack = max(holdBack, headScanBytes)
+	}
+	return &streamWriter{
+		t:              t,
+		resp:           resp,
+		acceptEncoding: acceptEncoding,
+		toUTF8:         toUTF8,
+		holdBack:       holdBack,
+		pw:             pw,
+		ready:          make(chan struct{}),
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.out == nil {
+		s.head = append(s.head, p...)
+		if len(s.head) >= s.holdBack {
+			if err := s.settle(false); err != nil {
+				return 0, err
 			}
 		}
-		return []byte(bodyStr), true
+		return len(p), nil
+	}
+	if s.final != nil {
+		s.final.Write(p)
+	}
+	return s.out.Write(p)
+}
+
+// Close ends the body, settling the headers first if all of it was held back.
+func (s *streamWriter) Close() error {
+	if s.out == nil {
+		if err := s.settle(true); err != nil {
+			return err
+		}
+	}
+	if s.compressor != nil {
+		if err := s.compressor.Close(); err != nil {
+			s.pw.CloseWithError(err)
+			return err
+		}
+	}
+	return s.pw.Close()
+}
+
+// settle settles the headers from the head held back, releases the response and writes the
+// head. complete reports whether the head is the whole body.
+func (s *streamWriter) settle(complete bool) error {
+	head := s.head
+	s.head = nil
+	if s.toUTF8 {
+		head = setUTF8(s.resp.Header, head)
+	}
+	if s.final != nil {
+		s.final.Write(head)
+	}
+	s.out = s.pw
+	if complete {
+		head = s.t.compressForConsumer(s.acceptEncoding, s.resp.Header, head)
+	} else if s.t.shouldCompress(s.resp.Header, len(head)) {
+		s.resp.Header.Add("Vary", "Accept-Encoding")
+		if encoding := negotiateEncoding(s.acceptEncoding); encoding != "" {
+			// negotiateEncoding only picks encodings compressWriter has
+			s.compressor, _ = compressWriter(encoding, s.pw)
+			s.out = s.compressor
+			s.resp.Header.Set("Content-Encoding", encoding)
+		}
+	}
+	s.release(nil)
+	_, err := s.out.Write(head)
+	return err
+}
+
+// release hands the response to the consumer, or fails it with err.
+func (s *streamWriter) release(err error) {
+	released := *s.resp
+	released.Header = s.resp.Header.Clone()
+	s.released = &released
+	s.err = err
+	close(s.ready)
+}
+
+// drop releases the response as a 204 No Content. The processors wrote nothing then, so
+// only a body that was already released is left to end.
+func (s *streamWriter) drop(req *http.Request) {
+	if s.out != nil {
+		s.Close()
+		return
+	}
+	dropResponse(req, s.resp)
+	s.release(nil)
+	s.pw.Close()
+}
+
+// fail ends the body with err, or fails the response if it wasn't released yet.
+func (s *streamWriter) fail(err error) {
+	if s.out == nil {
+		s.release(err)
 	}
-	return body, false
+	s.pw.CloseWithError(err)
 }
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// streamResponse runs an upstream response with the given body through streamPipeline.
+func streamResponse(t *testing.T, transport *CachingTransport, header http.Header, body io.Reader, acceptEncoding string) *http.Response {
+	t.Helper()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(body)}
+	resp, err := transport.streamPipeline(httptest.NewRequest(http.MethodGet, "/index.jsp", nil), resp, nil, acceptEncoding)
+	if err != nil {
+		t.Fatalf("streamPipeline failed: %v", err)
+	}
+	return resp
+}
+
+func TestStreamPipelineGBK(t *testing.T) {
+	page := "<html><body>患者姓名 old</body></html>"
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(page)
+	if err != nil {
+		t.Fatalf("Failed to encode page: %v", err)
+	}
+
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+	// Streamed bodies are sent as processed, even when nothing changed
+	for _, replace := range []string{"old", "new"} {
+		transport.StreamProcessor = streamProcessor(func(_ *models.ProcessingContext, body string) string {
+			return strings.ReplaceAll(body, "old", replace)
+		})
+		header := http.Header{}
+		header.Set("Content-Type", "text/html; charset=GBK")
+		resp := streamResponse(t, transport, header, strings.NewReader(gbk), "")
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != strings.ReplaceAll(page, "old", replace) || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("Expected the body as UTF-8, got %q (%s)", body, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestStreamPipelineSendsBodyIncrementally(t *testing.T) {
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+	transport.StreamProcessor = func(_ *models.ProcessingContext, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	upstream, upstreamWriter := io.Pipe()
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+
+	first := strings.Repeat("a", 4096)
+	go upstreamWriter.Write([]byte(first))
+	resp := streamResponse(t, transport, header, upstream, "")
+
+	// The start of the body arrives while the upstream is still sending
+	got := make([]byte, len(first))
+	if _, err := io.ReadFull(resp.Body, got); err != nil || string(got) != first {
+		t.Fatalf("Expected the first part of the body before the upstream finished, got %d bytes (%v)", len(got), err)
+	}
+	go func() {
+		io.WriteString(upstreamWriter, "end")
+		upstreamWriter.Close()
+	}()
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "end" {
+		t.Errorf("Expected the rest of the body, got %q (%v)", rest, err)
+	}
+}
+
+func TestStreamPipelineCompresses(t *testing.T) {
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{Settings: models.ProxySettings{EnableCompression: true}}, nil, nil)
+	transport.StreamProcessor = func(_ *models.ProcessingContext, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	for _, page := range []string{strings.Repeat("<p>row</p>", 10000), "<p>short</p>"} {
+		header := http.Header{}
+		header.Set("Content-Type", "text/html")
+		resp := streamResponse(t, transport, header, strings.NewReader(page), "gzip")
+		var body []byte
+		if len(page) > 1024 {
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Expected a large body to be sent gzipped, got %q", enc)
+			}
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read gzip body: %v", err)
+			}
+			body, _ = io.ReadAll(zr)
+		} else {
+			if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+				t.Errorf("Expected a short body to be sent as is, got %q", enc)
+			}
+			body, _ = io.ReadAll(resp.Body)
+		}
+		if string(body) != page {
+			t.Errorf("Expected the body to arrive intact (%d bytes), got %d bytes", len(page), len(body))
+		}
+	}
+}
+
+func TestStreamPipelineDrop(t *testing.T) {
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, nil)
+	transport.StreamProcessor = func(ctx *models.ProcessingContext, r io.Reader, _ io.Writer) error {
+		_, err := io.Copy(io.Discard, r)
+		ctx.Drop = true
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	resp := streamResponse(t, transport, header, bytes.NewReader([]byte("<p>ad</p>")), "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNoContent || len(body) != 0 || resp.Header.Get("Content-Type") != "" {
+		t.Errorf("Expected a dropped response to become a 204, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestStreamPipelineChecksCaptchaLogin(t *testing.T) {
+	provider := &fakeCaptchaProvider{solutions: map[string]string{}, logins: make(chan bool, 1)}
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, provider, nil)
+	transport.StreamProcessor = func(_ *models.ProcessingContext, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	// The upstream body is only kept for the check when the request submits a login
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	req := httptest.NewRequest(http.MethodPost, "/phis/api/submit", nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader("<p>Incorrect captcha</p>"))}
+	resp, err := transport.streamPipeline(req, resp, nil, "")
+	if err != nil {
+		t.Fatalf("streamPipeline failed: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	select {
+	case accepted := <-provider.logins:
+		if accepted {
+			t.Errorf("Expected the login to count as rejected")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the login result to be reported")
+	}
+}
@@ -1,8 +1,13 @@
 package cache
 
 import (
+	"io"
+
 	"github.com/soda92/vpn-share-tool/core/models"
 )
 
 // StringProcessor processes the string content of a response body.
 type StringProcessor func(ctx *models.ProcessingContext, body string) string
+
+// StreamProcessor copies a response body from r to w, processing it on the way.
+type StreamProcessor func(ctx *models.ProcessingContext, r io.Reader, w io.Writer) error
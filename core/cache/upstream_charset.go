@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+// pageCharsets remembers which upstream pages were served to consumers converted to UTF-8,
+// and from which charset, so what consumers submit from them can be converted back.
+type pageCharsets struct {
+	pages *lru.Cache[string, string] // Page path -> original charset, or "" if served as it was
+	last  atomic.Pointer[string]     // Charset of the most recently converted page of the proxy
+}
+
+func newPageCharsets() *pageCharsets {
+	pages, err := lru.New[string, string](1024)
+	if err != nil {
+		// This should not happen with a static size
+		panic(err)
+	}
+	return &pageCharsets{pages: pages}
+}
+
+// record remembers the charset a page was converted from, or "" if it was served as it was.
+func (c *pageCharsets) record(path, charset string) {
+	c.pages.Add(path, charset)
+	if charset != "" {
+		c.last.Store(&charset)
+	}
+}
+
+// recordPageCharset remembers whether an HTML page was served converted from its charset.
+func (t *CachingTransport) recordPageCharset(req *http.Request, resp *http.Response, modified bool, charset string) {
+	if t.charsets == nil {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return
+	}
+	if !modified {
+		charset = ""
+	}
+	t.charsets.record(req.URL.Path, charset)
+}
+
+// lookup returns the charset of the page a request was made from. Without a Referer, as when
+// the browser's referrer policy drops it, the charset of the last converted page of the
+// proxy is assumed. It returns "" if the request needs no conversion, including when the
+// Referer names a page the proxy hasn't seen.
+func (c *pageCharsets) lookup(req *http.Request) string {
+	if req.Referer() != "" {
+		ref, err := url.Parse(req.Referer())
+		if err != nil {
+			return ""
+		}
+		charset, _ := c.pages.Get(ref.Path)
+		return charset
+	}
+	if last := c.last.Load(); last != nil {
+		return *last
+	}
+	return ""
+}
+
+// browserEncoded reports whether the browser encoded a request's query string and form body in
+// the charset of the page, as it does for navigations, form submissions and subresources.
+// Scripts encode in UTF-8 whatever the page, so their requests are left alone.
+func browserEncoded(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Mode") {
+	case "navigate", "nested-navigate", "no-cors":
+		return true
+	case "":
+		// Browsers without fetch metadata; XHR libraries mark their requests
+		return req.Header.Get("X-Requested-With") == ""
+	}
+	return false
+}
+
+// encodeForUpstream converts the query string and form body of a request, which the consumer
+// encoded in UTF-8 for a page served converted, to the charset the upstream page was in.
+func (t *CachingTransport) encodeForUpstream(req *http.Request, body []byte) {
+	if t.charsets == nil || !browserEncoded(req) {
+		return
+	}
+	name := t.charsets.lookup(req)
+	if name == "" {
+		return
+	}
+	enc, _ := charset.Lookup(name)
+	if enc == nil {
+		return
+	}
+
+	if query, ok := encodeEscaped(enc, req.URL.RawQuery); ok {
+		req.URL.RawQuery = query
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || len(body) == 0 {
+		return
+	}
+	var encoded []byte
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		form, ok := encodeEscaped(enc, string(body))
+		if !ok {
+			return
+		}
+		encoded = []byte(form)
+	case "multipart/form-data":
+		if encoded, err = encodeMultipart(enc, body, params["boundary"]); err != nil {
+			log.Printf("Not converting multipart form for %s: %v", req.URL.Path, err)
+			return
+		}
+	default:
+		return
+	}
+	if bytes.Equal(encoded, body) {
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(encoded))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(encoded)), nil }
+	req.ContentLength = int64(len(encoded))
+}
+
+// encodeEscaped converts the percent-encoded UTF-8 text of a query string or urlencoded form
+// to enc, reporting whether it changed. Runs of escapes that aren't UTF-8 text, such as those
+// already in enc, are left as they are, as is everything that isn't escaped, such as the '+'
+// of spaces in forms.
+func encodeEscaped(enc encoding.Encoding, s string) (string, bool) {
+	var out []byte
+	last := 0
+	for i := 0; i < len(s); {
+		end, raw := escapedRun(s, i)
+		if end == i {
+			i++
+			continue
+		}
+		if encoded, ok := encodeRun(enc, raw); ok {
+			out = append(out, s[last:i]...)
+			out = append(out, encoded...)
+			last = end
+		}
+		i = end
+	}
+	if out == nil {
+		return s, false
+	}
+	return string(append(out, s[last:]...)), true
+}
+
+// escapedRun returns the end of the run of percent escapes and raw non-ASCII bytes at s[i:],
+// and the bytes it stands for.
+func escapedRun(s string, i int) (int, []byte) {
+	var raw []byte
+	for i < len(s) {
+		switch {
+		case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			raw = append(raw, byte(b))
+			i += 3
+		case s[i] >= utf8.RuneSelf:
+			raw = append(raw, s[i])
+			i++
+		default:
+			return i, raw
+		}
+	}
+	return i, raw
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// encodeRun percent-encodes the UTF-8 text of a run in enc, if it has any non-ASCII text.
+// Characters enc can't represent become HTML character references, as browsers submit them.
+func encodeRun(enc encoding.Encoding, raw []byte) (string, bool) {
+	if !utf8.Valid(raw) || isASCII(raw) {
+		return "", false
+	}
+	encoded, err := encoding.HTMLEscapeUnsupported(enc.NewEncoder()).Bytes(raw)
+	if err != nil {
+		return "", false
+	}
+	const hex = "0123456789ABCDEF"
+	out := make([]byte, 0, 3*len(encoded))
+	for _, b := range encoded {
+		if isUnreserved(b) {
+			out = append(out, b)
+		} else {
+			out = append(out, '%', hex[b>>4], hex[b&15])
+		}
+	}
+	return string(out), true
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeMultipart converts the text fields of a multipart form, and the names and file names
+// in its part headers, from UTF-8 to enc. File contents are copied as they are.
+func encodeMultipart(enc encoding.Encoding, body []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("no boundary")
+	}
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	var out bytes.Buffer
+	w := multipart.NewWriter(&out)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	encoder := encoding.HTMLEscapeUnsupported(enc.NewEncoder())
+	encodeText := func(b []byte) []byte {
+		if !utf8.Valid(b) || isASCII(b) {
+			return b
+		}
+		if encoded, err := encoder.Bytes(b); err == nil {
+			return encoded
+		}
+		return b
+	}
+
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		header := textproto.MIMEHeader{}
+		for key, values := range part.Header {
+			for _, v := range values {
+				header.Add(key, string(encodeText([]byte(v))))
+			}
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" {
+			content = encodeText(content)
+		}
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		pw.Write(content)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
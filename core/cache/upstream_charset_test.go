@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// gbkUpstream is a demo upstream serving GBK pages. /save echoes the form it received, decoded
+// as GBK, in a GBK page.
+func gbkUpstream(t *testing.T) *httptest.Server {
+	gbk := func(w http.ResponseWriter, page string) {
+		w.Header().Set("Content-Type", "text/html; charset=GBK")
+		w.Write(mustEncode(t, simplifiedchinese.GBK, page))
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/form.jsp":
+			gbk(w, `<html><head></head><body><form action="/save" method="post">患者姓名 old <input name="name"></form></body></html>`)
+		case "/save":
+			// Go decodes forms as given, so the values are still in GBK
+			if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+				t.Errorf("Failed to parse form: %v", err)
+			}
+			var b strings.Builder
+			for _, key := range []string{"q", "name", "note"} {
+				value, err := simplifiedchinese.GBK.NewDecoder().String(r.FormValue(key))
+				if err != nil {
+					t.Errorf("Failed to decode %s as GBK: %v", key, err)
+				}
+				b.WriteString(key + "=" + value + ";")
+			}
+			if r.MultipartForm != nil {
+				for _, file := range r.MultipartForm.File["file"] {
+					f, _ := file.Open()
+					content, _ := io.ReadAll(f)
+					b.WriteString("file=" + string(content) + ";")
+				}
+			}
+			gbk(w, "<p>old</p><p>"+b.String()+"</p>")
+		}
+	}))
+}
+
+func TestUpstreamCharsetRoundTrip(t *testing.T) {
+	upstream := gbkUpstream(t)
+	defer upstream.Close()
+	transport := NewCachingTransport(http.DefaultTransport, &models.SharedProxy{}, nil, func(ctx *models.ProcessingContext, body string) string {
+		return strings.ReplaceAll(body, "old", "new")
+	})
+
+	roundTrip := func(method, path, contentType string, body []byte, header map[string]string) string {
+		t.Helper()
+		req := httptest.NewRequest(method, upstream.URL+path, bytes.NewReader(body))
+		req.RequestURI = ""
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("Expected %s to be served as UTF-8, got %s", path, ct)
+		}
+		return string(respBody)
+	}
+
+	if page := roundTrip(http.MethodGet, "/form.jsp", "", nil, nil); !strings.Contains(page, "患者姓名 new") {
+		t.Fatalf("Expected the form page as UTF-8, got %s", page)
+	}
+
+	navigate := map[string]string{"Referer": "http://192.168.1.2:10081/form.jsp", "Sec-Fetch-Mode": "navigate"}
+	query := "/save?q=" + url.QueryEscape("李四 1+1")
+	form := url.Values{"name": {"张三"}, "note": {"备注 ok"}}.Encode()
+	if got := roundTrip(http.MethodPost, query, "application/x-www-form-urlencoded", []byte(form), navigate); !strings.Contains(got, "q=李四 1+1;name=张三;note=备注 ok;") {
+		t.Errorf("Expected the form to reach the upstream in GBK, got %s", got)
+	}
+
+	var multipartBody bytes.Buffer
+	w := multipart.NewWriter(&multipartBody)
+	w.WriteField("name", "王五")
+	file, _ := w.CreateFormFile("file", "report.txt")
+	file.Write([]byte("原始内容"))
+	w.Close()
+	if got := roundTrip(http.MethodPost, "/save", w.FormDataContentType(), multipartBody.Bytes(), navigate); !strings.Contains(got, "name=王五;") || !strings.Contains(got, "file=原始内容;") {
+		t.Errorf("Expected the text fields in GBK and files unchanged, got %s", got)
+	}
+
+	// Scripts encode in UTF-8 whatever the page, so their requests are passed through
+	xhr := map[string]string{"Referer": navigate["Referer"], "Sec-Fetch-Mode": "cors"}
+	utf8Form := url.Values{"name": {"张三"}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, upstream.URL+"/save", strings.NewReader(utf8Form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range xhr {
+		req.Header.Set(k, v)
+	}
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	transport.encodeForUpstream(req, body)
+	if forwarded, _ := io.ReadAll(req.Body); string(forwarded) != utf8Form {
+		t.Errorf("Expected a script's request to be left in UTF-8, got %q", forwarded)
+	}
+}
+
+func TestPageCharsetsLookup(t *testing.T) {
+	c := newPageCharsets()
+	c.record("/form.jsp", "gbk")
+	c.record("/utf8.jsp", "")
+
+	for referer, want := range map[string]string{
+		"http://192.168.1.2:10081/form.jsp":  "gbk",
+		"http://192.168.1.2:10081/utf8.jsp":  "",
+		"http://192.168.1.2:10081/other.jsp": "", // Unknown pages pass through
+		"":                                   "gbk",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/save", nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		if got := c.lookup(req); got != want {
+			t.Errorf("lookup with Referer %q = %q, expected %q", referer, got, want)
+		}
+	}
+}
+
+func TestEncodeEscaped(t *testing.T) {
+	gbk := simplifiedchinese.GBK
+	for _, tc := range []struct{ in, want string }{
+		{"a=1&b=%2F+x", "a=1&b=%2F+x"},
+		{"name=%E5%BC%A0%E4%B8%89&x=1", "name=%D5%C5%C8%FD&x=1"},
+		{"name=%D5%C5%C8%FD", "name=%D5%C5%C8%FD"}, // Already GBK
+		{"name=張", "name=%8F%88"},                  // Raw UTF-8
+		{"s=%F0%9F%98%80", "s=%26%23128512%3B"},    // Not in GBK
+	} {
+		if got, _ := encodeEscaped(gbk, tc.in); got != tc.want {
+			t.Errorf("encodeEscaped(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
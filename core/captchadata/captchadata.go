@@ -0,0 +1,338 @@
+// Package captchadata records solved captcha images with the solver's answer and whether the
+// login that used it succeeded, for accuracy stats and for retraining the OCR model.
+package captchadata
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+// Login outcomes of a solution.
+const (
+	OutcomeCorrect = "correct" // The login accepted the captcha
+	OutcomeWrong   = "wrong"   // The login rejected the captcha
+	OutcomeUnknown = "unknown" // No matching login was seen, e.g. the user refreshed the image
+)
+
+// pendingTTL is how long a solution waits for its login before it is recorded as unknown.
+const pendingTTL = 10 * time.Minute
+
+// maxPending bounds the solutions waiting for their login.
+const maxPending = 1000
+
+// Record is one solved captcha image.
+type Record struct {
+	Time      time.Time `json:"time"`
+	ImageHash string    `json:"image_hash"` // sha256 of the image
+	Image     string    `json:"image"`      // Path of the image relative to the dataset directory
+	Profile   string    `json:"profile"`
+	Backend   string    `json:"backend"`
+	Solution  string    `json:"solution"`
+	LatencyMs float64   `json:"latency_ms"`
+	Cached    bool      `json:"cached,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+// BackendAccuracy summarizes the login outcomes of one backend's solutions.
+type BackendAccuracy struct {
+	Backend      string  `json:"backend"`
+	Solved       int     `json:"solved"`
+	Correct      int     `json:"correct"`
+	Wrong        int     `json:"wrong"`
+	Unknown      int     `json:"unknown"`
+	Accuracy     float64 `json:"accuracy"` // Correct / (Correct + Wrong); 0 until a login was seen
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	totalLatencyMs float64
+}
+
+type pendingRecord struct {
+	record Record
+	added  time.Time
+}
+
+var (
+	pending  = map[string]*pendingRecord{} // Consumer session -> solution waiting for its login
+	accuracy map[string]*BackendAccuracy   // Loaded from records.jsonl on first use
+	lock     sync.Mutex
+)
+
+// Dir returns the directory holding the dataset, creating it if needed.
+func Dir() (string, error) {
+	dir, err := config.FilePath("captcha_dataset")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Solved records a solution for the consumer session. It is written to the dataset once the
+// session's next login shows whether it was correct, or as unknown if none follows.
+func Solved(session string, rec Record, img []byte) {
+	if !config.Get().Captcha.CollectDataset {
+		return
+	}
+	dir, err := Dir()
+	if err != nil {
+		log.Printf("Failed to get captcha dataset directory: %v", err)
+		return
+	}
+
+	sum := sha256.Sum256(img)
+	rec.ImageHash = hex.EncodeToString(sum[:])
+	rec.Image = "images/" + rec.ImageHash + imageExt(img)
+	path := filepath.Join(dir, filepath.FromSlash(rec.Image))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.WriteFile(path, img, 0644); err != nil {
+			log.Printf("Failed to save captcha image: %v", err)
+			return
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	now := time.Now()
+	expirePending(now)
+	if p, ok := pending[session]; ok {
+		// A new image replaced the previous one before any login
+		finish(p.record, OutcomeUnknown)
+	}
+	if len(pending) >= maxPending {
+		finishOldest()
+	}
+	pending[session] = &pendingRecord{record: rec, added: now}
+}
+
+// LoginResult records whether the session's pending solution was accepted. It does nothing
+// if the session has no pending solution.
+func LoginResult(session string, correct bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	expirePending(time.Now())
+	p, ok := pending[session]
+	if !ok {
+		return
+	}
+	delete(pending, session)
+	outcome := OutcomeWrong
+	if correct {
+		outcome = OutcomeCorrect
+	}
+	log.Printf("Captcha solution '%s' from %s was %s", p.record.Solution, p.record.Backend, outcome)
+	finish(p.record, outcome)
+}
+
+func expirePending(now time.Time) {
+	for session, p := range pending {
+		if now.Sub(p.added) >= pendingTTL {
+			delete(pending, session)
+			finish(p.record, OutcomeUnknown)
+		}
+	}
+}
+
+func finishOldest() {
+	var oldest string
+	for session, p := range pending {
+		if oldest == "" || p.added.Before(pending[oldest].added) {
+			oldest = session
+		}
+	}
+	if p, ok := pending[oldest]; ok {
+		delete(pending, oldest)
+		finish(p.record, OutcomeUnknown)
+	}
+}
+
+// finish appends the record to records.jsonl and counts it. Callers hold lock.
+func finish(rec Record, outcome string) {
+	rec.Outcome = outcome
+	loadAccuracy()
+	count(rec)
+
+	dir, err := Dir()
+	if err != nil {
+		log.Printf("Failed to get captcha dataset directory: %v", err)
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "records.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open captcha dataset: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write captcha dataset: %v", err)
+	}
+}
+
+func count(rec Record) {
+	a, ok := accuracy[rec.Backend]
+	if !ok {
+		a = &BackendAccuracy{Backend: rec.Backend}
+		accuracy[rec.Backend] = a
+	}
+	a.Solved++
+	a.totalLatencyMs += rec.LatencyMs
+	switch rec.Outcome {
+	case OutcomeCorrect:
+		a.Correct++
+	case OutcomeWrong:
+		a.Wrong++
+	default:
+		a.Unknown++
+	}
+}
+
+// loadAccuracy counts the records already in the dataset. Callers hold lock.
+func loadAccuracy() {
+	if accuracy != nil {
+		return
+	}
+	accuracy = map[string]*BackendAccuracy{}
+	if err := readRecords(func(rec Record) { count(rec) }); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read captcha dataset: %v", err)
+	}
+}
+
+func readRecords(fn func(Record)) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, "records.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // Skip a line cut short by a crash
+		}
+		fn(rec)
+	}
+	return scanner.Err()
+}
+
+// Accuracy returns the outcomes of each backend's solutions, sorted by backend name.
+func Accuracy() []BackendAccuracy {
+	lock.Lock()
+	defer lock.Unlock()
+	loadAccuracy()
+	result := make([]BackendAccuracy, 0, len(accuracy))
+	for _, a := range accuracy {
+		snapshot := *a
+		if a.Correct+a.Wrong > 0 {
+			snapshot.Accuracy = float64(a.Correct) / float64(a.Correct+a.Wrong)
+		}
+		if a.Solved > 0 {
+			snapshot.AvgLatencyMs = a.totalLatencyMs / float64(a.Solved)
+		}
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Backend < result[j].Backend })
+	return result
+}
+
+// Export writes a zip of the labelled images with a manifest.json listing their records.
+// Only solutions with a known outcome are included; correctOnly further limits the export to
+// accepted solutions, whose text is a reliable label.
+func Export(w io.Writer, correctOnly bool) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	var records []Record
+	err = readRecords(func(rec Record) {
+		if rec.Outcome == OutcomeCorrect || (rec.Outcome == OutcomeWrong && !correctOnly) {
+			records = append(records, rec)
+		}
+	})
+	lock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	written := map[string]bool{}
+	for _, rec := range records {
+		if written[rec.Image] {
+			continue
+		}
+		if err := addFile(zw, rec.Image, filepath.Join(dir, filepath.FromSlash(rec.Image))); err != nil {
+			log.Printf("Skipping captcha image %s: %v", rec.Image, err)
+			continue
+		}
+		written[rec.Image] = true
+	}
+
+	manifest, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifest)
+	encoder.SetIndent("", "  ")
+	if records == nil {
+		records = []Record{}
+	}
+	if err := encoder.Encode(records); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addFile(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func imageExt(img []byte) string {
+	switch http.DetectContentType(img) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/bmp":
+		return ".bmp"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".bin"
+	}
+}
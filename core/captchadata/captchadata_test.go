@@ -0,0 +1,91 @@
+package captchadata
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/debug"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func TestLoginOutcomesAndExport(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	lock.Lock()
+	pending = map[string]*pendingRecord{}
+	accuracy = nil
+	lock.Unlock()
+
+	solve := func(session, backend, solution string, img []byte) {
+		Solved(session, Record{Time: time.Now(), Backend: backend, Solution: solution, LatencyMs: 10}, img)
+	}
+
+	solve("alice", "python", "ab12", append(pngHeader, 1))
+	solve("bob", "python", "cd34", append(pngHeader, 2))
+	solve("carol", "discovery", "ef56", append(pngHeader, 3))
+	// Carol refreshed the image before logging in
+	solve("carol", "discovery", "gh78", append(pngHeader, 4))
+
+	LoginResult("alice", true)
+	LoginResult("bob", false)
+	LoginResult("carol", true)
+	LoginResult("dave", true) // No pending solution: ignored
+
+	byBackend := map[string]BackendAccuracy{}
+	for _, a := range Accuracy() {
+		byBackend[a.Backend] = a
+	}
+	if a := byBackend["python"]; a.Solved != 2 || a.Correct != 1 || a.Wrong != 1 || a.Accuracy != 0.5 {
+		t.Errorf("Unexpected python accuracy: %+v", a)
+	}
+	if a := byBackend["discovery"]; a.Solved != 2 || a.Correct != 1 || a.Unknown != 1 || a.Accuracy != 1 {
+		t.Errorf("Unexpected discovery accuracy: %+v", a)
+	}
+
+	// Stats survive a restart
+	lock.Lock()
+	accuracy = nil
+	lock.Unlock()
+	if got := Accuracy(); len(got) != 2 || got[1].Solved != 2 {
+		t.Errorf("Expected accuracy reloaded from the dataset, got %+v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, true); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+
+	var manifest []Record
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("Invalid manifest: %v", err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("Expected the 2 correct solutions, got %+v", manifest)
+	}
+	for _, rec := range manifest {
+		if rec.Outcome != OutcomeCorrect {
+			t.Errorf("Expected only correct solutions, got %+v", rec)
+		}
+		if _, ok := files[rec.Image]; !ok {
+			t.Errorf("Expected image %s in the export", rec.Image)
+		}
+	}
+}
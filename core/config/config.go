@@ -0,0 +1,486 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/soda92/vpn-share-tool/core/debug"
+)
+
+// NodeConfig holds node-wide settings persisted in config.json next to proxies.json.
+type NodeConfig struct {
+	AutoProxy AutoProxyPolicy `json:"auto_proxy"`
+	// IdleTTLMinutes removes any unpinned proxy idle for this long (0 = never).
+	// Proxies can override it with ProxySettings.IdleTTLMinutes.
+	IdleTTLMinutes int `json:"idle_ttl_minutes"`
+	// APIPortRange is scanned for the node's API server port.
+	APIPortRange PortRange `json:"api_port_range"`
+	// ProxyPortRange is used for shared proxy listeners. It must not overlap APIPortRange.
+	ProxyPortRange PortRange `json:"proxy_port_range"`
+	// CompressionMinBytes is the smallest response body compressed for consumers.
+	CompressionMinBytes int `json:"compression_min_bytes"`
+	// HTTP2 holds the defaults for proxies without an HTTP/2 override.
+	HTTP2 HTTP2Config `json:"http2"`
+	// AccessLog controls the audit log of requests served by proxies.
+	AccessLog AccessLogConfig `json:"access_log"`
+	// Captcha selects the solver backends used for captcha images.
+	Captcha CaptchaConfig `json:"captcha"`
+	// Systems are the upstream applications detected on proxies. A missing list uses
+	// DefaultSystems.
+	Systems []SystemDefinition `json:"systems"`
+}
+
+// Probe types of a SystemDefinition.
+const (
+	ProbeStatus  = "status"  // The path answers with Status (default 200)
+	ProbeBody    = "body"    // The body contains Contains and/or matches Pattern
+	ProbeHeader  = "header"  // Header is present and its value matches Pattern
+	ProbeFavicon = "favicon" // The sha256 of the favicon at Path (default /favicon.ico) is Hash
+	ProbeTitle   = "title"   // The page's <title> matches Pattern
+)
+
+// SystemDefinition describes an upstream application: how to recognise it and which content
+// processors fix its pages.
+type SystemDefinition struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Probes are checked against the proxy's upstream. The detection confidence is the weight
+	// of the matching probes over the weight of all probes.
+	Probes []SystemProbe `json:"probes"`
+	// MinConfidence is the confidence needed to detect the system (0 = any matching probe).
+	MinConfidence float64 `json:"min_confidence,omitempty"`
+	// Processors names the pipeline's content processors run for the system, in order.
+	Processors []string `json:"processors"`
+	// DefaultSettings are applied once to a proxy when the system is first detected on it.
+	DefaultSettings *SystemSettings `json:"default_settings,omitempty"`
+}
+
+// SystemProbe is one check of a SystemDefinition. Path is resolved against the proxy's URL.
+type SystemProbe struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+	// Status is the expected status of "status" probes.
+	Status   int    `json:"status,omitempty"`
+	Contains string `json:"contains,omitempty"`
+	// Pattern is a regular expression; its first capture group, if any, is reported as the
+	// system's version.
+	Pattern string `json:"pattern,omitempty"`
+	Header  string `json:"header,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	// Weight of the probe in the confidence (0 = 1).
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// SystemSettings overrides proxy settings; nil fields are left alone.
+type SystemSettings struct {
+	EnableContentMod  *bool `json:"enable_content_mod,omitempty"`
+	EnableUrlRewrite  *bool `json:"enable_url_rewrite,omitempty"`
+	EnableCompression *bool `json:"enable_compression,omitempty"`
+	EnableDebugScript *bool `json:"enable_debug_script,omitempty"`
+	IdleTTLMinutes    *int  `json:"idle_ttl_minutes,omitempty"`
+}
+
+// DefaultSystems returns the built-in system definitions.
+func DefaultSystems() []SystemDefinition {
+	return []SystemDefinition{
+		{
+			ID:         "HIS",
+			Name:       "Legacy HIS",
+			Probes:     []SystemProbe{{Type: ProbeStatus, Path: "/cis/images/img/LOGO-HIS-LOGIN.png"}},
+			Processors: []string{"fix_legacy_js"},
+		},
+		{
+			ID:         "PHIS",
+			Name:       "Public Health",
+			Probes:     []SystemProbe{{Type: ProbeStatus, Path: "/phis/static/images/logins/bg-denglu.png"}},
+			Processors: []string{"fix_legacy_js", "rewrite_phis_urls"},
+		},
+		{
+			ID:         "DEMO",
+			Name:       "Demo Site",
+			Probes:     []SystemProbe{{Type: ProbeStatus, Path: "/demo/probe.png"}},
+			Processors: []string{"fix_legacy_js"},
+		},
+	}
+}
+
+func validateSystems(systems []SystemDefinition) error {
+	ids := map[string]bool{}
+	for _, sys := range systems {
+		if sys.ID == "" {
+			return fmt.Errorf("system %q needs an ID", sys.Name)
+		}
+		if ids[sys.ID] {
+			return fmt.Errorf("duplicate system ID %q", sys.ID)
+		}
+		ids[sys.ID] = true
+		if len(sys.Probes) == 0 {
+			return fmt.Errorf("system %s has no probes", sys.ID)
+		}
+		for _, probe := range sys.Probes {
+			switch probe.Type {
+			case ProbeStatus:
+			case ProbeBody:
+				if probe.Contains == "" && probe.Pattern == "" {
+					return fmt.Errorf("system %s: body probe needs contains or pattern", sys.ID)
+				}
+			case ProbeHeader:
+				if probe.Header == "" {
+					return fmt.Errorf("system %s: header probe needs a header", sys.ID)
+				}
+			case ProbeFavicon:
+				if probe.Hash == "" {
+					return fmt.Errorf("system %s: favicon probe needs a hash", sys.ID)
+				}
+			case ProbeTitle:
+				if probe.Pattern == "" {
+					return fmt.Errorf("system %s: title probe needs a pattern", sys.ID)
+				}
+			default:
+				return fmt.Errorf("system %s: unknown probe type %q", sys.ID, probe.Type)
+			}
+			if _, err := regexp.Compile(probe.Pattern); err != nil {
+				return fmt.Errorf("system %s: %w", sys.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CaptchaConfig orders the captcha solver backends ("discovery", "http", "python"); each is
+// tried in turn until one returns a solution.
+type CaptchaConfig struct {
+	Backends []string `json:"backends"`
+	// HTTPURL is the endpoint of the "http" backend. It receives the raw image by POST.
+	HTTPURL string `json:"http_url"`
+	// TimeoutSeconds limits each backend attempt.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// SolutionTTLSeconds drops solutions (and pending sessions) not updated for this long.
+	SolutionTTLSeconds int `json:"solution_ttl_seconds"`
+	// MaxSessions bounds the number of consumer sessions holding a solution.
+	MaxSessions int `json:"max_sessions"`
+	// HumanFallback queues captchas that no backend solved confidently on the discovery
+	// dashboard, where an operator can answer them within HumanTimeoutSeconds.
+	HumanFallback       bool `json:"human_fallback"`
+	HumanTimeoutSeconds int  `json:"human_timeout_seconds"`
+	// CollectDataset records each solved image with its solution and login outcome, for
+	// accuracy stats and retraining the OCR model.
+	CollectDataset bool `json:"collect_dataset"`
+	// Profiles describe the captcha of each supported site. An empty list disables captcha
+	// solving; a missing one uses DefaultCaptchaProfiles.
+	Profiles []CaptchaProfile `json:"profiles"`
+}
+
+// CaptchaProfile tells the proxy how to recognise and fill in one site's captcha.
+type CaptchaProfile struct {
+	Name string `json:"name"`
+	// Systems limits the profile to proxies where one of these systems was detected (empty = any).
+	Systems []string `json:"systems,omitempty"`
+	// ImagePattern is a regular expression matched against the path of captcha image requests.
+	ImagePattern string `json:"image_pattern"`
+	// PageMatch is a regular expression matched against HTML pages; the solver script is
+	// injected into pages that match.
+	PageMatch string `json:"page_match"`
+	// InputSelector is the CSS selector of the input the solution is filled into.
+	InputSelector string `json:"input_selector"`
+	// RefreshSelector is the CSS selector of the element that loads a new captcha when clicked.
+	RefreshSelector string `json:"refresh_selector,omitempty"`
+	// Backend solves this profile's images with one backend instead of the Backends chain.
+	Backend string `json:"backend,omitempty"`
+	// SolutionPattern is a regular expression a confident solution matches, e.g. ^[0-9a-z]{4}$.
+	// Other solutions are sent to operators when HumanFallback is on.
+	SolutionPattern string `json:"solution_pattern,omitempty"`
+	// LoginPattern is a regular expression matched against the path of the POST that submits
+	// the captcha. Its response tells whether the solution was correct.
+	LoginPattern string `json:"login_pattern,omitempty"`
+	// A login response matching LoginFailure means the captcha was rejected. Otherwise the
+	// solution counts as correct if LoginSuccess matches or is unset.
+	LoginFailure *LoginRule `json:"login_failure,omitempty"`
+	LoginSuccess *LoginRule `json:"login_success,omitempty"`
+}
+
+// LoginRule matches a login response. All of its non-empty conditions must hold; a rule
+// without conditions never matches.
+type LoginRule struct {
+	Status []int `json:"status,omitempty"`
+	// BodyPattern and LocationPattern are regular expressions for the decoded body and the
+	// Location header.
+	BodyPattern     string `json:"body_pattern,omitempty"`
+	LocationPattern string `json:"location_pattern,omitempty"`
+}
+
+// DefaultCaptchaProfiles returns the built-in profiles for the PHIS login page, which the demo
+// site mirrors.
+func DefaultCaptchaProfiles() []CaptchaProfile {
+	return []CaptchaProfile{
+		{
+			Name:            "phis",
+			ImagePattern:    `voCode$`,
+			PageMatch:       `<img[^>]+src=["']/phis/app/login/voCode["']`,
+			InputSelector:   "#verifyCode",
+			RefreshSelector: "#img",
+			SolutionPattern: `^[0-9A-Za-z]{4}$`,
+			LoginPattern:    `/api/submit$`,
+			LoginFailure:    &LoginRule{BodyPattern: `(?i)incorrect captcha|验证码`},
+		},
+	}
+}
+
+func validateCaptchaProfiles(profiles []CaptchaProfile) error {
+	for _, p := range profiles {
+		if p.ImagePattern == "" || p.InputSelector == "" {
+			return fmt.Errorf("captcha profile %q needs an image pattern and an input selector", p.Name)
+		}
+		patterns := []string{p.ImagePattern, p.PageMatch, p.LoginPattern, p.SolutionPattern}
+		for _, rule := range []*LoginRule{p.LoginFailure, p.LoginSuccess} {
+			if rule != nil {
+				patterns = append(patterns, rule.BodyPattern, rule.LocationPattern)
+			}
+		}
+		for _, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("captcha profile %q: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Access log formats.
+const (
+	AccessLogCombined = "combined" // Apache/NGINX Combined Log Format plus duration and proxy ID
+	AccessLogJSON     = "json"     // One JSON object per line
+)
+
+// AccessLogConfig configures access logs written under the access_logs storage directory.
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Format  string `json:"format"`
+	// PerProxy writes one file per proxy instead of a single combined access.log.
+	PerProxy bool `json:"per_proxy"`
+	// The active file is rotated once it exceeds MaxSizeMB or is older than RotateHours.
+	MaxSizeMB   int `json:"max_size_mb"`
+	RotateHours int `json:"rotate_hours"`
+	// MaxAgeDays deletes rotated files older than this (0 = keep forever).
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+// HTTP2Config enables HTTP/2 on each side of the proxies.
+type HTTP2Config struct {
+	// Consumer serves h2c (prior knowledge) on proxy listeners. Proxies only listen on plain
+	// HTTP, so browsers, which speak HTTP/2 over TLS only, keep using HTTP/1.1.
+	Consumer bool `json:"consumer"`
+	// Upstream negotiates h2 via ALPN with HTTPS upstreams that support it.
+	Upstream bool `json:"upstream"`
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Size returns the number of ports in the range.
+func (r PortRange) Size() int {
+	if r.End < r.Start {
+		return 0
+	}
+	return r.End - r.Start + 1
+}
+
+// Contains reports whether port lies in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+// Overlaps reports whether the two ranges share a port.
+func (r PortRange) Overlaps(o PortRange) bool {
+	return r.Size() > 0 && o.Size() > 0 && r.Start <= o.End && o.Start <= r.End
+}
+
+// AutoProxyPolicy limits which proxies may be created automatically while rewriting
+// responses (internal URLs, redirects, PHIS links). Manually shared URLs are not affected.
+type AutoProxyPolicy struct {
+	Enabled bool `json:"enabled"`
+	// AllowCIDRs/AllowHosts restrict auto-creation to matching targets when non-empty.
+	AllowCIDRs []string `json:"allow_cidrs"`
+	AllowHosts []string `json:"allow_hosts"`
+	// DenyCIDRs/DenyHosts always win over the allow lists.
+	DenyCIDRs []string `json:"deny_cidrs"`
+	DenyHosts []string `json:"deny_hosts"`
+	// MaxProxies caps the number of auto-created proxies alive at once (0 = unlimited).
+	MaxProxies int `json:"max_proxies"`
+	// TTLMinutes removes auto-created proxies that have not been used for this long (0 = never).
+	TTLMinutes int `json:"ttl_minutes"`
+}
+
+func defaultConfig() NodeConfig {
+	return NodeConfig{
+		AutoProxy: AutoProxyPolicy{
+			Enabled:    true,
+			MaxProxies: 20,
+			TTLMinutes: 120,
+		},
+		APIPortRange:        PortRange{Start: 10081, End: 10090},
+		ProxyPortRange:      PortRange{Start: 10100, End: 10999},
+		CompressionMinBytes: 1024,
+		HTTP2:               HTTP2Config{Consumer: true, Upstream: true},
+		AccessLog: AccessLogConfig{
+			Enabled:     true,
+			Format:      AccessLogCombined,
+			MaxSizeMB:   10,
+			RotateHours: 24,
+			MaxAgeDays:  30,
+		},
+		Captcha: CaptchaConfig{
+			Backends:            []string{"discovery", "python"},
+			TimeoutSeconds:      10,
+			SolutionTTLSeconds:  300,
+			MaxSessions:         1000,
+			HumanFallback:       true,
+			HumanTimeoutSeconds: 180,
+			CollectDataset:      true,
+			Profiles:            DefaultCaptchaProfiles(),
+		},
+		Systems: DefaultSystems(),
+	}
+}
+
+var (
+	current = defaultConfig()
+	mu      sync.RWMutex
+)
+
+// FilePath returns the path of a file in the application's config directory, creating the
+// directory if needed.
+func FilePath(name string) (string, error) {
+	if debug.DebugStoragePath != "" {
+		if err := os.MkdirAll(debug.DebugStoragePath, 0755); err != nil {
+			return "", err
+		}
+		return filepath.Join(debug.DebugStoragePath, name), nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	appDir := filepath.Join(configDir, "vpn-share-tool")
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(appDir, name), nil
+}
+
+// Get returns a copy of the current node configuration.
+func Get() NodeConfig {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Load reads config.json, keeping defaults for anything not present in the file.
+func Load() {
+	file, err := FilePath("config.json")
+	if err != nil {
+		log.Printf("Failed to get node config path: %v", err)
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read node config: %v", err)
+		}
+		return
+	}
+
+	cfg := defaultConfig()
+	// Decoding into the default lists would merge their fields into the configured ones
+	cfg.Captcha.Profiles = nil
+	cfg.Systems = nil
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Failed to unmarshal node config: %v", err)
+		return
+	}
+	if cfg.Systems == nil {
+		cfg.Systems = DefaultSystems()
+	}
+	if err := validateSystems(cfg.Systems); err != nil {
+		log.Printf("Invalid system definitions (%v), using defaults", err)
+		cfg.Systems = DefaultSystems()
+	}
+	if cfg.Captcha.Profiles == nil {
+		cfg.Captcha.Profiles = DefaultCaptchaProfiles()
+	}
+	if err := validateCaptchaProfiles(cfg.Captcha.Profiles); err != nil {
+		log.Printf("Invalid captcha profiles (%v), using defaults", err)
+		cfg.Captcha.Profiles = DefaultCaptchaProfiles()
+	}
+	if cfg.APIPortRange.Size() == 0 {
+		log.Printf("Invalid API port range %+v, using default", cfg.APIPortRange)
+		cfg.APIPortRange = defaultConfig().APIPortRange
+	}
+	if cfg.ProxyPortRange.Size() == 0 {
+		log.Printf("Invalid proxy port range %+v, using default", cfg.ProxyPortRange)
+		cfg.ProxyPortRange = defaultConfig().ProxyPortRange
+	}
+	if cfg.APIPortRange.Overlaps(cfg.ProxyPortRange) {
+		log.Printf("Proxy port range %+v overlaps API port range %+v, using defaults", cfg.ProxyPortRange, cfg.APIPortRange)
+		cfg.APIPortRange = defaultConfig().APIPortRange
+		cfg.ProxyPortRange = defaultConfig().ProxyPortRange
+	}
+	if f := cfg.AccessLog.Format; f != AccessLogCombined && f != AccessLogJSON {
+		log.Printf("Invalid access log format %q, using %s", f, AccessLogCombined)
+		cfg.AccessLog.Format = AccessLogCombined
+	}
+
+	mu.Lock()
+	current = cfg
+	mu.Unlock()
+	log.Printf("Loaded node config from %s", file)
+}
+
+// Set replaces the current configuration and persists it.
+func Set(cfg NodeConfig) error {
+	if cfg.APIPortRange.Size() == 0 || cfg.ProxyPortRange.Size() == 0 {
+		return fmt.Errorf("invalid port range")
+	}
+	if cfg.APIPortRange.Overlaps(cfg.ProxyPortRange) {
+		return fmt.Errorf("proxy port range overlaps the API port range")
+	}
+	if f := cfg.AccessLog.Format; f != AccessLogCombined && f != AccessLogJSON {
+		return fmt.Errorf("invalid access log format: %s", f)
+	}
+	if cfg.Captcha.Profiles == nil {
+		cfg.Captcha.Profiles = DefaultCaptchaProfiles()
+	}
+	if err := validateCaptchaProfiles(cfg.Captcha.Profiles); err != nil {
+		return err
+	}
+	if cfg.Systems == nil {
+		cfg.Systems = DefaultSystems()
+	}
+	if err := validateSystems(cfg.Systems); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = cfg
+	mu.Unlock()
+
+	file, err := FilePath("config.json")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
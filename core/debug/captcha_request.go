@@ -1,6 +1,7 @@
 package debug
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"log"
@@ -21,10 +22,36 @@ var (
 
 // CaptureRequest captures the request and response for debugging.
 func CaptureRequest(req *http.Request, resp *http.Response, reqBody, respBody []byte) {
+	CaptureProcessedRequest(req, resp, reqBody, respBody, respBody, Processing{})
+}
+
+// Capturing reports whether captured requests are kept anywhere: the debug database is open
+// or a debug client is listening. Callers can skip buffering bodies for a capture otherwise.
+func Capturing() bool {
+	if db != nil {
+		return true
+	}
+	wsMutex.Lock()
+	defer wsMutex.Unlock()
+	return len(wsClients) > 0
+}
+
+// Processing records which content processors ran over a response.
+type Processing struct {
+	Processors []string // In the order they ran
+	ModifiedBy []string // Processors that changed the body
+	Charset    string   // Charset the upstream body was decoded from for processing, if not UTF-8
+}
+
+// CaptureProcessedRequest is CaptureRequest for a response that went through the content
+// processors. It keeps the upstream body and, if the processors changed it, the final body
+// sent to the consumer, along with the chain that ran.
+func CaptureProcessedRequest(req *http.Request, resp *http.Response, reqBody, respBody, finalBody []byte, processing Processing) {
 	// Extract data synchronously to avoid race conditions as the request object might be reused/invalidated
 	timestamp := time.Now()
 	method := req.Method
 	urlStr := req.URL.String()
+	reqProto := req.Proto
 
 	reqHeaders := make(http.Header)
 	for k, v := range req.Header {
@@ -32,6 +59,7 @@ func CaptureRequest(req *http.Request, resp *http.Response, reqBody, respBody []
 	}
 
 	respStatus := resp.StatusCode
+	proto := resp.Proto
 	respHeaders := make(http.Header)
 	for k, v := range resp.Header {
 		respHeaders[k] = v
@@ -47,15 +75,14 @@ func CaptureRequest(req *http.Request, resp *http.Response, reqBody, respBody []
 		id := nextRequestID
 		requestIDLock.Unlock()
 
-		isBase64 := false
-		var responseBody string
-
 		contentType := respHeaders.Get("Content-Type")
-		if strings.HasPrefix(contentType, "image/") || !utf8.Valid(respBody) {
-			responseBody = base64.StdEncoding.EncodeToString(respBody)
-			isBase64 = true
-		} else {
-			responseBody = string(respBody)
+		responseBody, isBase64 := encodeBody(contentType, respBody)
+		// The final body is only kept when it differs, as most responses pass through unchanged
+		var final *string
+		finalIsBase64 := false
+		if !bytes.Equal(finalBody, respBody) {
+			body, b64 := encodeBody(contentType, finalBody)
+			final, finalIsBase64 = &body, b64
 		}
 
 		cr := &CapturedRequest{
@@ -65,10 +92,17 @@ func CaptureRequest(req *http.Request, resp *http.Response, reqBody, respBody []
 			URL:             urlStr,
 			RequestHeaders:  reqHeaders,
 			RequestBody:     string(reqBody),
+			RequestProto:    reqProto,
 			ResponseStatus:  respStatus,
+			Proto:           proto,
 			ResponseHeaders: respHeaders,
 			ResponseBody:    responseBody,
 			IsBase64:        isBase64,
+			FinalBody:       final,
+			FinalIsBase64:   finalIsBase64,
+			UpstreamCharset: processing.Charset,
+			Processors:      processing.Processors,
+			ModifiedBy:      processing.ModifiedBy,
 		}
 
 		if db != nil {
@@ -107,3 +141,12 @@ func CaptureRequest(req *http.Request, resp *http.Response, reqBody, respBody []
 		wsBroadCast(cr)
 	}()
 }
+
+// encodeBody returns a body as it is stored in a CapturedRequest, base64-encoding images and
+// other bodies that aren't valid UTF-8.
+func encodeBody(contentType string, body []byte) (string, bool) {
+	if strings.HasPrefix(contentType, "image/") || !utf8.Valid(body) {
+		return base64.StdEncoding.EncodeToString(body), true
+	}
+	return string(body), false
+}
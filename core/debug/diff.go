@@ -0,0 +1,94 @@
+package debug
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const defaultDiffContext = 3
+
+// bodyDiff returns a unified diff from the upstream body of a captured request to the final
+// body the consumer received, with context lines around each change. It is empty if the
+// processors didn't change the body.
+func bodyDiff(cr *CapturedRequest, context int) (string, error) {
+	if cr.FinalBody == nil {
+		return "", nil
+	}
+	upstream, err := decodeBody(cr.ResponseBody, cr.IsBase64, cr.UpstreamCharset)
+	if err != nil {
+		return "", fmt.Errorf("upstream body: %w", err)
+	}
+	final, err := decodeBody(*cr.FinalBody, cr.FinalIsBase64, "")
+	if err != nil {
+		return "", fmt.Errorf("final body: %w", err)
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(upstream),
+		B:        difflib.SplitLines(final),
+		FromFile: "upstream",
+		ToFile:   "final",
+		Context:  context,
+	})
+}
+
+// decodeBody returns a stored body as UTF-8 text, decoding it from charset if given.
+func decodeBody(body string, isBase64 bool, charset string) (string, error) {
+	if isBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", err
+		}
+		body = string(decoded)
+	}
+	if charset != "" {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return "", err
+		}
+		decoded, err := io.ReadAll(enc.NewDecoder().Reader(strings.NewReader(body)))
+		if err != nil {
+			return "", err
+		}
+		body = string(decoded)
+	}
+	if !utf8.ValidString(body) {
+		return "", fmt.Errorf("body is not text")
+	}
+	return body, nil
+}
+
+// getRequestDiff serves the diff of a captured request's body as text. The "context" parameter
+// sets the number of context lines.
+func getRequestDiff(w http.ResponseWriter, r *http.Request, sessionID, idStr string) {
+	cr, err := loadRequest(sessionID, idStr)
+	if err != nil {
+		log.Printf("Error getting request for diff: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	context := defaultDiffContext
+	if s := r.URL.Query().Get("context"); s != "" {
+		if context, err = strconv.Atoi(s); err != nil || context < 0 {
+			http.Error(w, "Invalid context", http.StatusBadRequest)
+			return
+		}
+	}
+
+	diff, err := bodyDiff(cr, context)
+	if err != nil {
+		http.Error(w, "Cannot diff bodies: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	io.WriteString(w, diff)
+}
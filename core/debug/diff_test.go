@@ -0,0 +1,44 @@
+package debug
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestBodyDiff(t *testing.T) {
+	final := "<html>\n<a href=\"http://192.168.1.2:10081/view\">查看</a>\n</html>\n"
+	cr := &CapturedRequest{ResponseBody: final}
+	if diff, err := bodyDiff(cr, 3); err != nil || diff != "" {
+		t.Errorf("Expected no diff for an unchanged body, got %q, %v", diff, err)
+	}
+
+	upstream, err := simplifiedchinese.GBK.NewEncoder().String("<html>\n<a href=\"http://10.0.0.5/view\">查看</a>\n</html>\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr = &CapturedRequest{
+		ResponseBody:    base64.StdEncoding.EncodeToString([]byte(upstream)),
+		IsBase64:        true,
+		UpstreamCharset: "gbk",
+		FinalBody:       &final,
+	}
+	diff, err := bodyDiff(cr, 0)
+	if err != nil {
+		t.Fatalf("bodyDiff failed: %v", err)
+	}
+	want := "--- upstream\n+++ final\n@@ -2 +2 @@\n" +
+		"-<a href=\"http://10.0.0.5/view\">查看</a>\n" +
+		"+<a href=\"http://192.168.1.2:10081/view\">查看</a>\n"
+	if diff != want {
+		t.Errorf("Unexpected diff:\n%s\nwant:\n%s", diff, want)
+	}
+
+	image := base64.StdEncoding.EncodeToString([]byte{0xff, 0xd8, 0xff})
+	cr = &CapturedRequest{ResponseBody: image, IsBase64: true, FinalBody: &final}
+	if _, err := bodyDiff(cr, 3); err == nil || !strings.Contains(err.Error(), "not text") {
+		t.Errorf("Expected binary bodies not to be diffed, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package debug
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -55,7 +56,9 @@ func importHar(w http.ResponseWriter, r *http.Request) {
 				Method:          entry.Request.Method,
 				URL:             entry.Request.URL,
 				RequestHeaders:  make(http.Header),
+				RequestProto:    entry.Request.HTTPVersion,
 				ResponseStatus:  entry.Response.Status,
+				Proto:           entry.Response.HTTPVersion,
 				ResponseHeaders: make(http.Header),
 			}
 			requestIDLock.Unlock()
@@ -165,13 +168,18 @@ func toHAR(requests []*CapturedRequest) HAR {
 			}
 		}
 
+		// The consumer and the upstream may speak different protocols. Captures made before
+		// the protocols were recorded were all HTTP/1.1.
+		requestVersion := cmp.Or(req.RequestProto, "HTTP/1.1")
+		responseVersion := cmp.Or(req.Proto, "HTTP/1.1")
+
 		entries[i] = Entry{
 			StartedDateTime: req.Timestamp,
 			Time:            -1, // Not easily available, set to -1
 			Request: Request{
 				Method:      req.Method,
 				URL:         req.URL,
-				HTTPVersion: "HTTP/1.1", // Assumption
+				HTTPVersion: requestVersion,
 				Headers:     reqHeaders,
 				QueryString: queryString,
 				PostData:    postData,
@@ -180,7 +188,7 @@ func toHAR(requests []*CapturedRequest) HAR {
 			Response: Response{
 				Status:      req.ResponseStatus,
 				StatusText:  http.StatusText(req.ResponseStatus),
-				HTTPVersion: "HTTP/1.1", // Assumption
+				HTTPVersion: responseVersion,
 				Headers:     respHeaders,
 				Content: Content{
 					Size:     int64(len(req.ResponseBody)),
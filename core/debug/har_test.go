@@ -0,0 +1,22 @@
+package debug
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHARRecordsBothProtocols(t *testing.T) {
+	// A consumer on HTTP/1.1 whose request went upstream over HTTP/2
+	har := toHAR([]*CapturedRequest{
+		{URL: "http://10.0.0.5/index.jsp", RequestProto: "HTTP/1.1", Proto: "HTTP/2.0", ResponseStatus: http.StatusOK},
+		{URL: "http://10.0.0.5/old.jsp", ResponseStatus: http.StatusOK},
+	})
+	entry := har.Log.Entries[0]
+	if entry.Request.HTTPVersion != "HTTP/1.1" || entry.Response.HTTPVersion != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/1.1 to the consumer and HTTP/2.0 from the upstream, got %s and %s", entry.Request.HTTPVersion, entry.Response.HTTPVersion)
+	}
+	old := har.Log.Entries[1]
+	if old.Request.HTTPVersion != "HTTP/1.1" || old.Response.HTTPVersion != "HTTP/1.1" {
+		t.Errorf("Expected captures without protocols to default to HTTP/1.1, got %s and %s", old.Request.HTTPVersion, old.Response.HTTPVersion)
+	}
+}
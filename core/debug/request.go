@@ -14,6 +14,10 @@ func handleSingleRequest(w http.ResponseWriter, r *http.Request) {
 	// New path: /api/debug/requests/{sessionID}/{requestID}
 	path := strings.TrimPrefix(r.URL.Path, "/api/debug/requests/")
 	parts := strings.Split(path, "/")
+	if len(parts) == 3 && parts[2] == "diff" && r.Method == http.MethodGet {
+		getRequestDiff(w, r, parts[0], parts[1])
+		return
+	}
 	if len(parts) != 2 {
 		http.Error(w, "Invalid request path. Expected /api/debug/requests/{sessionID}/{requestID}", http.StatusBadRequest)
 		return
@@ -34,6 +38,22 @@ func handleSingleRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func getSingleRequest(w http.ResponseWriter, r *http.Request, sessionID, idStr string) {
+	foundRequest, err := loadRequest(sessionID, idStr)
+	if err != nil {
+		log.Printf("Error getting single request: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(foundRequest)
+}
+
+// loadRequest reads a captured request from a session.
+func loadRequest(sessionID, idStr string) (*CapturedRequest, error) {
+	if db == nil {
+		return nil, fmt.Errorf("debug database not available")
+	}
 	var foundRequest *CapturedRequest
 	err := db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(sessionID))
@@ -51,15 +71,7 @@ func getSingleRequest(w http.ResponseWriter, r *http.Request, sessionID, idStr s
 		foundRequest = &req
 		return nil
 	})
-
-	if err != nil {
-		log.Printf("Error getting single request: %v", err)
-		http.NotFound(w, r)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(foundRequest)
+	return foundRequest, err
 }
 
 func updateSingleRequest(w http.ResponseWriter, r *http.Request, sessionID, idStr string) {
@@ -32,10 +32,17 @@ type CapturedRequest struct {
 	URL              string      `json:"url"`
 	RequestHeaders   http.Header `json:"request_headers"`
 	RequestBody      string      `json:"request_body"`
+	RequestProto     string      `json:"request_proto,omitempty"` // Protocol the consumer used, e.g. "HTTP/2.0"
 	ResponseStatus   int         `json:"response_status"`
+	Proto            string      `json:"proto,omitempty"` // Protocol negotiated with the upstream, e.g. "HTTP/2.0"
 	ResponseHeaders  http.Header `json:"response_headers"`
 	ResponseBody     string      `json:"response_body"`
 	IsBase64         bool        `json:"is_base64"`
+	FinalBody        *string     `json:"final_body,omitempty"`       // Body sent to the consumer, if processors changed it
+	FinalIsBase64    bool        `json:"final_is_base64,omitempty"`  // Whether FinalBody is base64-encoded
+	UpstreamCharset  string      `json:"upstream_charset,omitempty"` // Charset of ResponseBody if it was decoded for processing
+	Processors       []string    `json:"processors,omitempty"`       // Content processors that ran, in order
+	ModifiedBy       []string    `json:"modified_by,omitempty"`      // Content processors that changed the body
 	Bookmarked       bool        `json:"bookmarked"`
 	Note             string      `json:"note"`
 	VpnShareToolMeta string      `json:"_vpnShareToolMetadata,omitempty"` // Field for HAR metadata
@@ -9,6 +9,11 @@ export interface CapturedRequest {
   response_headers: Record<string, string[]>;
   response_body: string;
   is_base64?: boolean;
+  final_body?: string;
+  final_is_base64?: boolean;
+  upstream_charset?: string;
+  processors?: string[];
+  modified_by?: string[];
   bookmarked: boolean;
   note: string;
 }
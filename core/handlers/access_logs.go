@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/soda92/vpn-share-tool/core/accesslog"
+)
+
+type AccessLogsHandler struct {
+	ListFiles func() ([]accesslog.FileInfo, error)
+	OpenFile  func(name string) (*os.File, error)
+	Tail      func(name string, lines int) ([]string, error)
+}
+
+// ServeHTTP lists the access log files, downloads one with ?file=NAME, or returns its last
+// lines with ?file=NAME&tail=N.
+func (h *AccessLogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("file")
+	if name == "" {
+		files, err := h.ListFiles()
+		if err != nil {
+			log.Printf("Failed to list access logs: %v", err)
+			http.Error(w, "Failed to list access logs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(files); err != nil {
+			log.Printf("Failed to encode access log list: %v", err)
+		}
+		return
+	}
+
+	if tail := r.URL.Query().Get("tail"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid tail parameter", http.StatusBadRequest)
+			return
+		}
+		lines, err := h.Tail(name, n)
+		if err != nil {
+			http.Error(w, "Access log not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(lines) > 0 {
+			fmt.Fprintln(w, strings.Join(lines, "\n"))
+		}
+		return
+	}
+
+	f, err := h.OpenFile(name)
+	if err != nil {
+		http.Error(w, "Access log not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read access log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
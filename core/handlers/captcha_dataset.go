@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/captchadata"
+)
+
+type CaptchaAccuracyHandler struct {
+	GetAccuracy func() []captchadata.BackendAccuracy
+}
+
+// ServeHTTP returns how often each backend's captcha solutions were accepted by the login.
+func (h *CaptchaAccuracyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.GetAccuracy()); err != nil {
+		log.Printf("Failed to encode captcha accuracy: %v", err)
+		http.Error(w, "Failed to encode captcha accuracy", http.StatusInternalServerError)
+	}
+}
+
+type CaptchaDatasetHandler struct {
+	Export func(w io.Writer, correctOnly bool) error
+}
+
+// ServeHTTP downloads the labelled captcha images as a zip with a manifest.json. Pass
+// ?correct_only=1 to leave out solutions the login rejected.
+func (h *CaptchaDatasetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	correctOnly := r.URL.Query().Get("correct_only") == "1"
+	name := fmt.Sprintf("captcha-dataset-%s.zip", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := h.Export(w, correctOnly); err != nil {
+		// Headers are already sent; the truncated zip will fail to open
+		log.Printf("Failed to export captcha dataset: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/common"
+)
+
+type CaptchaStatsHandler struct {
+	GetStats func() []common.SolverStats
+}
+
+// ServeHTTP returns the attempts, successes, timeouts and latency of each captcha solver backend.
+func (h *CaptchaStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.GetStats()); err != nil {
+		log.Printf("Failed to encode captcha stats: %v", err)
+		http.Error(w, "Failed to encode captcha stats", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/core/utils"
+)
+
+type InterfacesHandler struct {
+	GetInterfaces func() []utils.Interface
+}
+
+// ServeHTTP lists the node's usable network interfaces, which proxies can be bound to.
+func (h *InterfacesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ifaces := h.GetInterfaces()
+	if ifaces == nil {
+		ifaces = []utils.Interface{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ifaces); err != nil {
+		log.Printf("Failed to encode interfaces to JSON: %v", err)
+		http.Error(w, "Failed to encode interfaces", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/core/vault"
+)
+
+type LoginCredentialsHandler struct {
+	List   func() ([]vault.Entry, error)
+	Set    func(name string, cred vault.Credential) error
+	Delete func(name string) error
+}
+
+// ServeHTTP manages the credentials used by login macros: GET lists them without passwords,
+// POST stores one with the upstream host it may be sent to and DELETE ?name= removes one.
+// Passwords are write-only.
+func (h *LoginCredentialsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := h.List()
+		if err != nil {
+			log.Printf("Failed to read credential vault: %v", err)
+			http.Error(w, "Failed to read credential vault", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Host     string `json:"host"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || req.Username == "" || req.Host == "" {
+			http.Error(w, "name, username and host are required", http.StatusBadRequest)
+			return
+		}
+		if err := h.Set(req.Name, vault.Credential{Username: req.Username, Password: req.Password, Host: req.Host}); err != nil {
+			log.Printf("Failed to store credential %s: %v", req.Name, err)
+			http.Error(w, "Failed to store credential", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Stored login credential %s for %s on %s", req.Name, req.Username, req.Host)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if err := h.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Deleted login credential %s", name)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
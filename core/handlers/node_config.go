@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+type NodeConfigHandler struct {
+	GetConfig func() config.NodeConfig
+	SetConfig func(config.NodeConfig) error
+}
+
+// ServeHTTP returns the node configuration on GET and replaces it on POST.
+func (h *NodeConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.GetConfig()); err != nil {
+			log.Printf("Failed to encode node config: %v", err)
+			http.Error(w, "Failed to encode config", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		// Start from the current config so partial updates keep the other sections
+		cfg := h.GetConfig()
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.SetConfig(cfg); err != nil {
+			log.Printf("Failed to save node config: %v", err)
+			http.Error(w, "Failed to save config", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Updated node config: %+v", cfg)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
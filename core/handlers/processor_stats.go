@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+type ProcessorStatsHandler struct {
+	GetStats   func() []pipeline.ProcessorStats
+	ResetStats func()
+}
+
+// ServeHTTP returns the invocations, durations and changes of each content processor per proxy
+// on GET, optionally only those of the proxy in the "proxy" parameter, and clears them on DELETE.
+func (h *ProcessorStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stats := []pipeline.ProcessorStats{}
+		proxy := r.URL.Query().Get("proxy")
+		for _, s := range h.GetStats() {
+			if proxy == "" || s.Proxy == proxy {
+				stats = append(stats, s)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("Failed to encode processor stats: %v", err)
+			http.Error(w, "Failed to encode processor stats", http.StatusInternalServerError)
+		}
+	case http.MethodDelete:
+		h.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+type RulesHandler struct {
+	GetRules func() []pipeline.Rule
+	SetRules func([]pipeline.Rule) error
+	// AllowPush reports whether a POST may replace the rules. Nil allows every caller.
+	AllowPush func(r *http.Request) bool
+}
+
+// ServeHTTP returns the active content rules on GET and replaces them on POST. The discovery
+// server pushes rules here; other senders are rejected by AllowPush since a rule can inject
+// scripts into every proxied page.
+func (h *RulesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules := h.GetRules()
+		if rules == nil {
+			rules = []pipeline.Rule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pipeline.RuleSet{Rules: rules})
+	case http.MethodPost:
+		if h.AllowPush != nil && !h.AllowPush(r) {
+			http.Error(w, "Rules can only be pushed by the discovery server", http.StatusForbidden)
+			return
+		}
+		var set pipeline.RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := pipeline.ValidateRules(set.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.SetRules(set.Rules); err != nil {
+			log.Printf("Failed to save content rules: %v", err)
+			http.Error(w, "Failed to save rules", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type RulesTestHandler struct {
+	GetRules  func() []pipeline.Rule
+	TestRules func([]pipeline.Rule, pipeline.RuleSample) (pipeline.RuleTestResult, error)
+}
+
+// ServeHTTP runs rules over a sample body and returns the result without activating them.
+// Without rules in the request the active rules are tested.
+func (h *RulesTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Rules       []pipeline.Rule `json:"rules"`
+		URL         string          `json:"url"`
+		ContentType string          `json:"content_type"`
+		Status      int             `json:"status"`
+		Systems     []string        `json:"systems"`
+		Body        string          `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rules := req.Rules
+	if rules == nil {
+		rules = h.GetRules()
+	}
+	result, err := h.TestRules(rules, pipeline.RuleSample{
+		URL:         req.URL,
+		ContentType: req.ContentType,
+		Status:      req.Status,
+		Systems:     req.Systems,
+		Body:        req.Body,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+func TestRulesHandler_RejectsUntrustedPush(t *testing.T) {
+	var set []pipeline.Rule
+	handler := &RulesHandler{
+		GetRules:  func() []pipeline.Rule { return set },
+		SetRules:  func(rules []pipeline.Rule) error { set = rules; return nil },
+		AllowPush: func(r *http.Request) bool { return r.RemoteAddr == "127.0.0.1:1234" },
+	}
+	body := `{"rules":[{"name":"x","actions":[{"type":"inject_script","value":"alert(1)"}]}]}`
+
+	req := httptest.NewRequest("POST", "/rules", bytes.NewBufferString(body))
+	req.RemoteAddr = "192.168.1.50:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for an untrusted sender, got %d", w.Code)
+	}
+	if set != nil {
+		t.Fatalf("Expected rules to stay unset, got %+v", set)
+	}
+
+	req = httptest.NewRequest("POST", "/rules", bytes.NewBufferString(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for a trusted sender, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(set) != 1 {
+		t.Errorf("Expected one rule to be set, got %+v", set)
+	}
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 
@@ -10,13 +9,15 @@ import (
 )
 
 type ServicesHandler struct {
-	GetProxies func() []*models.SharedProxy
-	GetIP      func() string
+	GetProxies    func() []*models.SharedProxy
+	GetIP         func() string
+	GetSharedURLs func(p *models.SharedProxy) []models.InterfaceURL
 }
 
 type sharedURLInfo struct {
-	OriginalURL string `json:"original_url"`
-	SharedURL   string `json:"shared_url"`
+	OriginalURL string                `json:"original_url"`
+	SharedURL   string                `json:"shared_url"`
+	SharedURLs  []models.InterfaceURL `json:"shared_urls,omitempty"` // One per interface the proxy listens on
 }
 
 // servicesHandler provides the list of currently shared proxies as a JSON response.
@@ -31,11 +32,14 @@ func (h *ServicesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Just use the first LAN IP for the response. The client can substitute it if needed.
 		ip := MyIP
 		for _, p := range proxies {
-			sharedURL := fmt.Sprintf("http://%s:%d%s", ip, p.RemotePort, p.Path)
-			response = append(response, sharedURLInfo{
+			info := sharedURLInfo{
 				OriginalURL: p.OriginalURL,
-				SharedURL:   sharedURL,
-			})
+				SharedURL:   p.SharedURL(ip),
+			}
+			if h.GetSharedURLs != nil {
+				info.SharedURLs = h.GetSharedURLs(p)
+			}
+			response = append(response, info)
 		}
 	}
 
@@ -4,12 +4,18 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"reflect"
 
 	"github.com/soda92/vpn-share-tool/core/models"
 )
 
 type UpdateSettingsHandler struct {
-	GetProxies func() []*models.SharedProxy
+	GetProxies    func() []*models.SharedProxy
+	SaveProxies   func()
+	ApplySettings func(p *models.SharedProxy, old models.ProxySettings)
+	// AllowLoginMacroEdit reports whether a request may change a proxy's login macro, which
+	// sends stored credentials upstream. Nil allows every caller.
+	AllowLoginMacroEdit func(r *http.Request) bool
 }
 
 func (h *UpdateSettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -18,12 +24,16 @@ func (h *UpdateSettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Either Settings replaces all settings, or Pinned/PinnedBy change only the pin, so
+	// callers acting on a stale snapshot don't overwrite newer edits.
 	var req struct {
-		URL      string               `json:"url"`
-		Settings models.ProxySettings `json:"settings"`
+		URL      string                `json:"url"`
+		Settings *models.ProxySettings `json:"settings"`
+		Pinned   *bool                 `json:"pinned"`
+		PinnedBy string                `json:"pinned_by"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Settings == nil && req.Pinned == nil) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -43,10 +53,32 @@ func (h *UpdateSettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	}
 
 	targetProxy.Mu.Lock()
-	targetProxy.Settings = req.Settings
+	old := targetProxy.Settings
+	if req.Settings != nil && h.AllowLoginMacroEdit != nil &&
+		!reflect.DeepEqual(req.Settings.LoginMacro, old.LoginMacro) && !h.AllowLoginMacroEdit(r) {
+		targetProxy.Mu.Unlock()
+		http.Error(w, "The login macro can only be changed on the node itself", http.StatusForbidden)
+		return
+	}
+	if req.Settings != nil {
+		targetProxy.Settings = *req.Settings
+	} else {
+		targetProxy.Settings.Pinned = *req.Pinned
+		targetProxy.Settings.PinnedBy = ""
+		if *req.Pinned {
+			targetProxy.Settings.PinnedBy = req.PinnedBy
+		}
+	}
+	updated := targetProxy.Settings
 	targetProxy.Mu.Unlock()
+	if h.ApplySettings != nil {
+		h.ApplySettings(targetProxy, old)
+	}
+	if h.SaveProxies != nil {
+		h.SaveProxies()
+	}
 
-	log.Printf("Updated settings for %s: %+v", req.URL, req.Settings)
+	log.Printf("Updated settings for %s: %+v", req.URL, updated)
 
 	w.WriteHeader(http.StatusOK)
 }
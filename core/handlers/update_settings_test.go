@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestUpdateSettingsHandler_PinKeepsOtherSettings(t *testing.T) {
+	proxy := &models.SharedProxy{
+		OriginalURL: "http://example.com",
+		Settings:    models.ProxySettings{EnableContentMod: true, IdleTTLMinutes: 30},
+	}
+	handler := &UpdateSettingsHandler{
+		GetProxies: func() []*models.SharedProxy { return []*models.SharedProxy{proxy} },
+	}
+
+	post := func(body map[string]interface{}) int {
+		reqBody, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/update-settings", bytes.NewBuffer(reqBody)))
+		return w.Code
+	}
+
+	if code := post(map[string]interface{}{"url": proxy.OriginalURL, "pinned": true, "pinned_by": models.PinnedByTaggedURL}); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	want := models.ProxySettings{EnableContentMod: true, IdleTTLMinutes: 30, Pinned: true, PinnedBy: models.PinnedByTaggedURL}
+	if proxy.Settings.Pinned != want.Pinned || proxy.Settings.PinnedBy != want.PinnedBy ||
+		proxy.Settings.EnableContentMod != want.EnableContentMod || proxy.Settings.IdleTTLMinutes != want.IdleTTLMinutes {
+		t.Errorf("Expected settings %+v after pinning, got %+v", want, proxy.Settings)
+	}
+
+	if code := post(map[string]interface{}{"url": proxy.OriginalURL, "pinned": false}); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if proxy.Settings.Pinned || proxy.Settings.PinnedBy != "" || !proxy.Settings.EnableContentMod {
+		t.Errorf("Expected only the pin to be cleared, got %+v", proxy.Settings)
+	}
+
+	if code := post(map[string]interface{}{"url": proxy.OriginalURL}); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without settings or pin, got %d", code)
+	}
+}
+
+func TestUpdateSettingsHandler_LoginMacroNeedsTrustedCaller(t *testing.T) {
+	proxy := &models.SharedProxy{OriginalURL: "http://example.com"}
+	handler := &UpdateSettingsHandler{
+		GetProxies:          func() []*models.SharedProxy { return []*models.SharedProxy{proxy} },
+		AllowLoginMacroEdit: func(r *http.Request) bool { return r.RemoteAddr == "127.0.0.1:1234" },
+	}
+
+	post := func(remoteAddr string, settings models.ProxySettings) int {
+		reqBody, _ := json.Marshal(map[string]interface{}{"url": proxy.OriginalURL, "settings": settings})
+		req := httptest.NewRequest("POST", "/update-settings", bytes.NewBuffer(reqBody))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	macro := models.ProxySettings{LoginMacro: &models.LoginMacro{Enabled: true, Credential: "phis", LoginPath: "/login"}}
+	if code := post("192.168.1.50:1234", macro); code != http.StatusForbidden || proxy.Settings.LoginMacro != nil {
+		t.Fatalf("Expected a LAN client to be refused a login macro, got %d", code)
+	}
+	if code := post("127.0.0.1:1234", macro); code != http.StatusOK || proxy.Settings.LoginMacro == nil {
+		t.Fatalf("Expected the node itself to set the login macro, got %d", code)
+	}
+
+	// Other settings can still be changed from the LAN while the macro stays as it is
+	unchanged := models.ProxySettings{EnableContentMod: true, LoginMacro: &models.LoginMacro{Enabled: true, Credential: "phis", LoginPath: "/login"}}
+	if code := post("192.168.1.50:1234", unchanged); code != http.StatusOK || !proxy.Settings.EnableContentMod {
+		t.Errorf("Expected settings leaving the macro alone to be accepted, got %d", code)
+	}
+}
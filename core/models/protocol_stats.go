@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// ProtocolCounts is a snapshot of requests per negotiated HTTP protocol ("HTTP/1.1", "HTTP/2.0").
+type ProtocolCounts struct {
+	Consumer map[string]int64 `json:"consumer"` // Browser -> proxy listener
+	Upstream map[string]int64 `json:"upstream"` // Proxy -> upstream server
+}
+
+// ProtocolStats counts proxied requests by the protocol used on each side of the proxy.
+type ProtocolStats struct {
+	mu     sync.Mutex
+	counts ProtocolCounts
+}
+
+func (s *ProtocolStats) RecordConsumer(proto string) {
+	s.record(&s.counts.Consumer, proto)
+}
+
+func (s *ProtocolStats) RecordUpstream(proto string) {
+	s.record(&s.counts.Upstream, proto)
+}
+
+func (s *ProtocolStats) record(m *map[string]int64, proto string) {
+	if proto == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if *m == nil {
+		*m = map[string]int64{}
+	}
+	(*m)[proto]++
+}
+
+// Snapshot returns a copy of the counters.
+func (s *ProtocolStats) Snapshot() ProtocolCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := ProtocolCounts{
+		Consumer: make(map[string]int64, len(s.counts.Consumer)),
+		Upstream: make(map[string]int64, len(s.counts.Upstream)),
+	}
+	for k, v := range s.counts.Consumer {
+		snapshot.Consumer[k] = v
+	}
+	for k, v := range s.counts.Upstream {
+		snapshot.Upstream[k] = v
+	}
+	return snapshot
+}
+
+func (s *ProtocolStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
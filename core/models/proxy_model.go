@@ -2,36 +2,140 @@ package models
 
 import (
 	"context"
+	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
 )
 
 type contextKey string
 
-const OriginalHostKey contextKey = "originalHost"
+const (
+	OriginalHostKey   contextKey = "originalHost"
+	OriginalSchemeKey contextKey = "originalScheme"
+	// CaptchaSessionKey identifies the consumer captcha solutions are stored for.
+	CaptchaSessionKey contextKey = "captchaSession"
+	// AutoLoginKey holds the ID of a consumer that opted in to the proxy's login macro.
+	AutoLoginKey contextKey = "autoLogin"
+)
 
 type PipelineServices struct {
 	CreateProxy func(url string, port int) (*SharedProxy, error)
+	GetProxies  func() []*SharedProxy // Currently shared proxies, for rewriting links to their upstreams
 	MyIP        string
 	APIPort     int
+	// LocalIPs returns the addresses of the node's interfaces, so URLs pointing back at the
+	// node on any of them are recognised.
+	LocalIPs func() []string
 }
 
 type ProcessingContext struct {
 	ReqURL     *url.URL
 	ReqContext context.Context
 	RespHeader http.Header
+	Status     int // Upstream response status
 	Proxy      *SharedProxy
 	Services   PipelineServices
+	// Drop is set by processors to answer 204 No Content instead of the response.
+	Drop bool
+	// Processors are the IDs of the processors that ran, in order.
+	Processors []string
+	// ModifiedBy are the IDs of the processors that changed the body, in order.
+	ModifiedBy []string
 }
 
+// PinnedByTaggedURL marks proxies pinned by discovery because they back a tagged URL.
+const PinnedByTaggedURL = "tagged-url"
+
 type ProxySettings struct {
 	EnableContentMod  bool `json:"enable_content_mod"`
 	EnableUrlRewrite  bool `json:"enable_url_rewrite"`
 	EnableDebugScript bool `json:"enable_debug_script"`
+	// EnableCompression gzip/brotli-compresses responses to consumers that accept it.
+	EnableCompression bool `json:"enable_compression"`
+	// ConsumerHTTP2/UpstreamHTTP2 override the node's HTTP/2 defaults (HTTP2Default, HTTP2On, HTTP2Off).
+	ConsumerHTTP2 string `json:"consumer_http2,omitempty"`
+	UpstreamHTTP2 string `json:"upstream_http2,omitempty"`
+	// Interfaces restricts the listener to these network interfaces (empty = all).
+	Interfaces []string `json:"interfaces,omitempty"`
+	// Pinned proxies never expire (e.g. proxies backing a discovery tagged URL).
+	Pinned bool `json:"pinned"`
+	// PinnedBy records who set Pinned, e.g. PinnedByTaggedURL (empty = pinned by hand).
+	PinnedBy string `json:"pinned_by,omitempty"`
+	// IdleTTLMinutes overrides the node's default idle TTL (0 = use the default).
+	IdleTTLMinutes int `json:"idle_ttl_minutes,omitempty"`
+	// LoginMacro signs opted-in consumers in to the upstream with stored credentials.
+	LoginMacro *LoginMacro `json:"login_macro,omitempty"`
+	// SystemDefaults lists the detected systems whose default settings were applied. They are
+	// applied once, so later edits of the settings stick.
+	SystemDefaults []string `json:"system_defaults,omitempty"`
+	// DisabledProcessors turns off individual content processors by ProcessorStep ID.
+	DisabledProcessors []string `json:"disabled_processors,omitempty"`
+	// ProcessorOrder moves the listed processors to the front of the chain, in this order.
+	ProcessorOrder []string `json:"processor_order,omitempty"`
+}
+
+// ProcessorStep is one content processor in a proxy's processing chain.
+type ProcessorStep struct {
+	// ID is the processor name, prefixed with "<system ID>:" for processors of a detected
+	// system, e.g. "PHIS:fix_legacy_js".
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	System  string `json:"system,omitempty"`
+	Enabled bool   `json:"enabled"` // Whether it runs, after the settings' switches and DisabledProcessors
+}
+
+// DetectedSystem is a system found on a proxy's upstream.
+type DetectedSystem struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Version    string  `json:"version,omitempty"`
+	Confidence float64 `json:"confidence"` // Weight of the matching probes, 0-1
+}
+
+// LoginMacro describes how to log in to an upstream on behalf of a consumer. It only runs for
+// consumers that opted in with the proxy's auto-login cookie.
+type LoginMacro struct {
+	Enabled bool `json:"enabled"`
+	// Credential names the vault entry holding the username and password.
+	Credential string `json:"credential"`
+	// LoginPath is the upstream login page. It is loaded first to start an upstream session,
+	// and opted-in consumers redirected to it are logged in instead.
+	LoginPath string `json:"login_path"`
+	// SubmitPath receives the login form by POST (empty = LoginPath).
+	SubmitPath string `json:"submit_path,omitempty"`
+	// Fields are the submitted form fields on top of the login page's hidden inputs.
+	// {username}, {password} and {captcha} in values are replaced.
+	Fields map[string]string `json:"fields"`
+	// CaptchaPath is the captcha image solved for {captcha}, using the settings of the
+	// captcha profile named CaptchaProfile.
+	CaptchaPath    string `json:"captcha_path,omitempty"`
+	CaptchaProfile string `json:"captcha_profile,omitempty"`
+	// The login succeeded if the response does not match Failure, and matches Success if set.
+	Failure *config.LoginRule `json:"failure,omitempty"`
+	Success *config.LoginRule `json:"success,omitempty"`
+	// MaxAttempts bounds the tries with a fresh captcha (0 = 3).
+	MaxAttempts int `json:"max_attempts,omitempty"`
 }
 
+// Values of the per-proxy HTTP/2 overrides in ProxySettings.
+const (
+	HTTP2Default = "" // Follow the node configuration
+	HTTP2On      = "on"
+	HTTP2Off     = "off"
+)
+
+// IdleTTLResolver returns the effective idle TTL of a proxy (0 = never expires).
+// It is set by the proxy package, which knows the node-wide defaults.
+var IdleTTLResolver = func(p *SharedProxy) time.Duration { return 0 }
+
 type SharedProxy struct {
 	OriginalURL   string                 `json:"original_url"`
 	RemotePort    int                    `json:"remote_port"`
@@ -40,10 +144,74 @@ type SharedProxy struct {
 	Server        *http.Server           `json:"-"`
 	Settings      ProxySettings          `json:"settings"`
 	ActiveSystems []string               `json:"active_systems"`
+	Systems       []DetectedSystem       `json:"systems"` // Details of ActiveSystems
 	RequestRate   float64                `json:"request_rate"`
 	TotalRequests int64                  `json:"total_requests"`
+	AutoCreated   bool                   `json:"auto_created"`            // Created while rewriting another proxy's responses
+	Parent        string                 `json:"parent,omitempty"`        // OriginalURL of the proxy that triggered auto-creation
+	LastAccess    int64                  `json:"-"`                       // Atomic UnixNano of the last proxied request
+	Protocols     ProtocolStats          `json:"protocols"`               // Requests per negotiated HTTP protocol
+	ListenErrors  []string               `json:"listen_errors,omitempty"` // Addresses the listener failed to bind, guarded by Mu
 	Mu            sync.RWMutex           `json:"-"`
 	ReqCounter    int64                  `json:"-"` // Atomic counter for current second
 	Ctx           context.Context        `json:"-"` // Context for lifecycle management
 	Cancel        context.CancelFunc     `json:"-"` // Function to cancel the context
 }
+
+// InterfaceURL is the shared URL of a proxy on one of the node's interfaces.
+type InterfaceURL struct {
+	Interface string `json:"interface"`
+	IP        string `json:"ip"`
+	URL       string `json:"url"`
+}
+
+// InterfaceURLsResolver returns the shared URLs of a proxy on each interface it listens on.
+// It is set by the proxy package, which knows the node's interfaces.
+var InterfaceURLsResolver = func(p *SharedProxy) []InterfaceURL { return nil }
+
+// ProcessorChainResolver returns the content processor chain of a proxy, in the order it runs.
+// It is set by the proxy package, which knows the processors.
+var ProcessorChainResolver = func(p *SharedProxy) []ProcessorStep { return nil }
+
+// SharedURL returns the URL consumers use to reach the proxy via host. IPv6 hosts are
+// bracketed.
+func (p *SharedProxy) SharedURL(host string) string {
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(p.RemotePort)) + p.Path
+}
+
+// LastAccessTime returns the time of the last proxied request (or creation).
+func (p *SharedProxy) LastAccessTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.LastAccess))
+}
+
+// ExpiresAt returns when the proxy will be removed for being idle, or the zero time if never.
+func (p *SharedProxy) ExpiresAt() time.Time {
+	ttl := IdleTTLResolver(p)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return p.LastAccessTime().Add(ttl)
+}
+
+// MarshalJSON adds the last access and expiry times, per-interface shared URLs and the
+// processor chain to the serialized proxy.
+func (p *SharedProxy) MarshalJSON() ([]byte, error) {
+	type alias SharedProxy
+	var expiresAt *time.Time
+	if t := p.ExpiresAt(); !t.IsZero() {
+		expiresAt = &t
+	}
+	return json.Marshal(struct {
+		*alias
+		LastAccess time.Time       `json:"last_access"`
+		ExpiresAt  *time.Time      `json:"expires_at,omitempty"`
+		SharedURLs []InterfaceURL  `json:"shared_urls,omitempty"`
+		Processors []ProcessorStep `json:"processor_chain,omitempty"`
+	}{
+		alias:      (*alias)(p),
+		LastAccess: p.LastAccessTime(),
+		ExpiresAt:  expiresAt,
+		SharedURLs: InterfaceURLsResolver(p),
+		Processors: ProcessorChainResolver(p),
+	})
+}
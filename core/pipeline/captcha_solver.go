@@ -0,0 +1,209 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/trace"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/resources"
+)
+
+var (
+	captchaPatterns     = map[string]*regexp.Regexp{}
+	captchaPatternsLock sync.Mutex
+)
+
+// captchaPattern compiles a profile pattern once. Patterns are validated when the config is
+// loaded, so an invalid one here never matches.
+func captchaPattern(pattern string) *regexp.Regexp {
+	captchaPatternsLock.Lock()
+	defer captchaPatternsLock.Unlock()
+	re, ok := captchaPatterns[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Invalid captcha pattern %q: %v", pattern, err)
+		}
+		captchaPatterns[pattern] = re
+	}
+	return re
+}
+
+// captchaProfiles returns the configured profiles that apply to the proxy's detected systems.
+func captchaProfiles(p *models.SharedProxy) []config.CaptchaProfile {
+	p.Mu.RLock()
+	active := p.ActiveSystems
+	p.Mu.RUnlock()
+
+	var profiles []config.CaptchaProfile
+	for _, profile := range config.Get().Captcha.Profiles {
+		if len(profile.Systems) > 0 && !slices.ContainsFunc(profile.Systems, func(id string) bool {
+			return slices.Contains(active, id)
+		}) {
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// CaptchaProfileForImage returns the profile whose image pattern matches the request path.
+func CaptchaProfileForImage(p *models.SharedProxy, path string) (config.CaptchaProfile, bool) {
+	for _, profile := range captchaProfiles(p) {
+		if re := captchaPattern(profile.ImagePattern); re != nil && re.MatchString(path) {
+			return profile, true
+		}
+	}
+	return config.CaptchaProfile{}, false
+}
+
+// CaptchaProfileForLogin returns the profile whose login pattern matches the request path.
+func CaptchaProfileForLogin(p *models.SharedProxy, path string) (config.CaptchaProfile, bool) {
+	for _, profile := range captchaProfiles(p) {
+		if profile.LoginPattern == "" {
+			continue
+		}
+		if re := captchaPattern(profile.LoginPattern); re != nil && re.MatchString(path) {
+			return profile, true
+		}
+	}
+	return config.CaptchaProfile{}, false
+}
+
+// CaptchaLoginAccepted reports whether a login response accepted the submitted captcha,
+// according to the profile's login rules.
+func CaptchaLoginAccepted(profile config.CaptchaProfile, status int, header http.Header, body string) bool {
+	return LoginAccepted(profile.LoginFailure, profile.LoginSuccess, status, header, body)
+}
+
+// LoginAccepted reports whether a login response succeeded: it must not match failure, and
+// must match success unless that is nil.
+func LoginAccepted(failure, success *config.LoginRule, status int, header http.Header, body string) bool {
+	if loginRuleMatches(failure, status, header, body) {
+		return false
+	}
+	return success == nil || loginRuleMatches(success, status, header, body)
+}
+
+func loginRuleMatches(rule *config.LoginRule, status int, header http.Header, body string) bool {
+	if rule == nil || (len(rule.Status) == 0 && rule.BodyPattern == "" && rule.LocationPattern == "") {
+		return false
+	}
+	if len(rule.Status) > 0 && !slices.Contains(rule.Status, status) {
+		return false
+	}
+	for _, check := range [][2]string{
+		{rule.BodyPattern, body},
+		{rule.LocationPattern, header.Get("Location")},
+	} {
+		if check[0] == "" {
+			continue
+		}
+		if re := captchaPattern(check[0]); re == nil || !re.MatchString(check[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// InjectCaptchaSolver adds the solver script to pages matching a captcha profile, configured
+// with that profile's selectors.
+func InjectCaptchaSolver(ctx *models.ProcessingContext, body string) string {
+	defer trace.StartRegion(ctx.ReqContext, "InjectCaptchaSolver").End()
+	profiles := pageCaptchaProfiles(ctx)
+	for _, profile := range profiles {
+		if !profile.re.MatchString(body) {
+			continue
+		}
+		if script, ok := captchaSolverHTML(profile.CaptchaProfile); ok {
+			return strings.Replace(body, "</body>", script+"</body>", 1)
+		}
+		return body
+	}
+	return body
+}
+
+// InjectCaptchaSolverStream is the streaming form of InjectCaptchaSolver. Page patterns are
+// matched against the text before </body>, which is where the script goes.
+func InjectCaptchaSolverStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	profiles := pageCaptchaProfiles(ctx)
+	if len(profiles) == 0 {
+		return r
+	}
+	matched := make([]bool, len(profiles))
+	done := false
+	return newWindowReader(r, DefaultLookahead, func(dst, window []byte, atEOF bool) ([]byte, int) {
+		limit := settled(window, atEOF, DefaultLookahead)
+		if done {
+			return append(dst, window[:limit]...), limit
+		}
+		end := bytes.Index(window, []byte("</body>"))
+		text := window
+		if end >= 0 {
+			text = window[:end]
+		}
+		for i, profile := range profiles {
+			matched[i] = matched[i] || profile.re.Match(text)
+		}
+		if end < 0 || end >= limit {
+			return append(dst, window[:limit]...), limit
+		}
+		done = true
+		if i := slices.Index(matched, true); i >= 0 {
+			if script, ok := captchaSolverHTML(profiles[i].CaptchaProfile); ok {
+				dst = append(dst, window[:end]...)
+				dst = append(dst, script...)
+				return append(dst, window[end:limit]...), limit
+			}
+		}
+		return append(dst, window[:limit]...), limit
+	})
+}
+
+type pageCaptchaProfile struct {
+	config.CaptchaProfile
+	re *regexp.Regexp
+}
+
+// pageCaptchaProfiles returns the profiles whose solver may be injected into an HTML response.
+func pageCaptchaProfiles(ctx *models.ProcessingContext) []pageCaptchaProfile {
+	if !strings.Contains(ctx.RespHeader.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	var profiles []pageCaptchaProfile
+	for _, profile := range captchaProfiles(ctx.Proxy) {
+		if profile.PageMatch == "" {
+			continue
+		}
+		if re := captchaPattern(profile.PageMatch); re != nil {
+			profiles = append(profiles, pageCaptchaProfile{profile, re})
+		}
+	}
+	return profiles
+}
+
+// captchaSolverHTML returns the solver script tag configured for profile.
+func captchaSolverHTML(profile config.CaptchaProfile) (string, bool) {
+	log.Printf("Injecting Captcha Solver Script (%s)", profile.Name)
+
+	// json.Marshal escapes '<', so the selectors cannot close the script tag
+	scriptConfig, err := json.Marshal(map[string]string{
+		"input":   profile.InputSelector,
+		"refresh": profile.RefreshSelector,
+	})
+	if err != nil {
+		return "", false
+	}
+	script := strings.Replace(string(resources.SolverScript), "__CAPTCHA_CONFIG__", string(scriptConfig), 1)
+	return `<script>` + script + `</script>`, true
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestCaptchaProfilesDriveInjection(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	original := config.Get()
+	defer config.Set(original)
+
+	cfg := config.Get()
+	cfg.Captcha.Profiles = append(config.DefaultCaptchaProfiles(), config.CaptchaProfile{
+		Name:            "erp",
+		Systems:         []string{"ERP"},
+		ImagePattern:    `^/auth/captcha\.png$`,
+		PageMatch:       `id="captcha-img"`,
+		InputSelector:   "input[name='captcha']",
+		RefreshSelector: "#captcha-img",
+		Backend:         "http",
+	})
+	if err := config.Set(cfg); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	p := &models.SharedProxy{}
+	if _, ok := CaptchaProfileForImage(p, "/auth/captcha.png"); ok {
+		t.Errorf("Expected the ERP profile to require the ERP system")
+	}
+	if profile, ok := CaptchaProfileForImage(p, "/phis/app/login/voCode"); !ok || profile.Name != "phis" {
+		t.Errorf("Expected the built-in PHIS profile, got %+v", profile)
+	}
+
+	p.ActiveSystems = []string{"ERP"}
+	profile, ok := CaptchaProfileForImage(p, "/auth/captcha.png")
+	if !ok || profile.Backend != "http" {
+		t.Fatalf("Expected the ERP profile, got %+v", profile)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	reqURL, _ := url.Parse("http://10.0.0.5/login")
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: context.Background(),
+		RespHeader: header,
+		Proxy:      p,
+	}
+	body := InjectCaptchaSolver(ctx, `<html><body><img id="captcha-img" src="/auth/captcha.png"></body></html>`)
+	if !strings.Contains(body, `"input":"input[name='captcha']"`) || !strings.Contains(body, `"refresh":"#captcha-img"`) {
+		t.Errorf("Expected script configured with the profile's selectors, got %s", body)
+	}
+	if strings.Contains(body, "__CAPTCHA_CONFIG__") {
+		t.Errorf("Expected the config placeholder to be replaced")
+	}
+
+	plain := `<html><body><p>No captcha here</p></body></html>`
+	if got := InjectCaptchaSolver(ctx, plain); got != plain {
+		t.Errorf("Expected pages without a captcha to be unchanged, got %s", got)
+	}
+}
+
+func TestInvalidCaptchaProfileRejected(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+
+	cfg := config.Get()
+	cfg.Captcha.Profiles = []config.CaptchaProfile{{Name: "bad", ImagePattern: "(", InputSelector: "#x"}}
+	if err := config.Set(cfg); err == nil {
+		t.Errorf("Expected an invalid image pattern to be rejected")
+	}
+}
+
+func TestCaptchaLoginAccepted(t *testing.T) {
+	profile := config.CaptchaProfile{
+		LoginFailure: &config.LoginRule{BodyPattern: `验证码错误`},
+		LoginSuccess: &config.LoginRule{Status: []int{http.StatusFound}, LocationPattern: `/index$`},
+	}
+
+	redirect := http.Header{}
+	redirect.Set("Location", "/app/index")
+	if !CaptchaLoginAccepted(profile, http.StatusFound, redirect, "") {
+		t.Errorf("Expected a redirect to the index to be accepted")
+	}
+	if CaptchaLoginAccepted(profile, http.StatusOK, http.Header{}, "<p>验证码错误</p>") {
+		t.Errorf("Expected the captcha error page to be rejected")
+	}
+	if CaptchaLoginAccepted(profile, http.StatusOK, http.Header{}, "<p>密码错误</p>") {
+		t.Errorf("Expected a response not matching the success rule to be rejected")
+	}
+
+	// Without a success rule anything but the failure counts as accepted
+	profile.LoginSuccess = nil
+	if !CaptchaLoginAccepted(profile, http.StatusOK, http.Header{}, "<p>密码错误</p>") {
+		t.Errorf("Expected a wrong password to still accept the captcha")
+	}
+}
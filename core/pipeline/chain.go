@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"cmp"
+	"io"
+	"slices"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// Names of the built-in processors that run for every proxy, around the system processors.
+const (
+	ProcRewriteInternalURLs = "rewrite_internal_urls"
+	ProcRewriteRefreshURLs  = "rewrite_refresh_urls"
+	ProcInjectDebugScript   = "inject_debug_script"
+	ProcApplyRules          = "apply_rules"
+	ProcInjectCaptchaSolver = "inject_captcha_solver"
+)
+
+// chainProcessor is a step of a processing chain with its string and streaming forms.
+type chainProcessor struct {
+	step    models.ProcessorStep
+	content ContentProcessor
+	stream  StreamProcessor
+}
+
+// ApplyRulesStream is the streaming form of ApplyRules. The rules need the whole body, so it is
+// only buffered when a rule matches the response, which is known before the body is read.
+func ApplyRulesStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	compiled := activeRules.Load()
+	if compiled == nil || !slices.ContainsFunc(*compiled, func(rule compiledRule) bool {
+		return !rule.Disabled && rule.matches(ctx)
+	}) {
+		return r
+	}
+	return StreamContent(ApplyRules)(ctx, r)
+}
+
+// processorChain returns every processor that may run for p, in the order they run, including
+// the disabled ones. The URL processors follow EnableUrlRewrite and the others EnableContentMod;
+// DisabledProcessors turns off single processors and ProcessorOrder moves them to the front.
+func processorChain(p *models.SharedProxy) []chainProcessor {
+	p.Mu.RLock()
+	settings := p.Settings
+	active := slices.Clone(p.ActiveSystems)
+	p.Mu.RUnlock()
+
+	builtin := func(name string, enabled bool, content ContentProcessor, stream StreamProcessor) chainProcessor {
+		return chainProcessor{models.ProcessorStep{ID: name, Name: name, Enabled: enabled}, content, stream}
+	}
+	chain := []chainProcessor{
+		builtin(ProcRewriteInternalURLs, settings.EnableUrlRewrite, RewriteInternalURLs, RewriteInternalURLsStream),
+		builtin(ProcRewriteRefreshURLs, settings.EnableUrlRewrite, RewriteRefreshURLs, RewriteRefreshURLsStream),
+		builtin(ProcInjectDebugScript, settings.EnableContentMod && settings.EnableDebugScript, InjectDebugScript, InjectDebugScriptStream),
+	}
+
+	systems := config.Get().Systems
+	for _, activeSysID := range active {
+		for _, sys := range systems {
+			if sys.ID != activeSysID {
+				continue
+			}
+			for _, name := range sys.Processors {
+				content, ok := Processors[name]
+				if !ok {
+					continue
+				}
+				stream, ok := StreamProcessors[name]
+				if !ok {
+					stream = StreamContent(content)
+				}
+				step := models.ProcessorStep{ID: sys.ID + ":" + name, Name: name, System: sys.ID, Enabled: settings.EnableContentMod}
+				chain = append(chain, chainProcessor{step, content, stream})
+			}
+		}
+	}
+
+	// The runtime rules run after the compiled-in fixes they may extend, and the captcha solver
+	// last so other processors don't touch its script
+	chain = append(chain,
+		builtin(ProcApplyRules, settings.EnableContentMod, ApplyRules, ApplyRulesStream),
+		builtin(ProcInjectCaptchaSolver, settings.EnableContentMod, InjectCaptchaSolver, InjectCaptchaSolverStream),
+	)
+
+	for i := range chain {
+		if slices.Contains(settings.DisabledProcessors, chain[i].step.ID) {
+			chain[i].step.Enabled = false
+		}
+	}
+	if order := settings.ProcessorOrder; len(order) > 0 {
+		rank := func(c chainProcessor) int {
+			if i := slices.Index(order, c.step.ID); i >= 0 {
+				return i
+			}
+			return len(order)
+		}
+		slices.SortStableFunc(chain, func(a, b chainProcessor) int { return cmp.Compare(rank(a), rank(b)) })
+	}
+	return chain
+}
+
+// ProcessorChain returns the effective processor chain of a proxy, in the order it runs.
+func ProcessorChain(p *models.SharedProxy) []models.ProcessorStep {
+	chain := processorChain(p)
+	steps := make([]models.ProcessorStep, len(chain))
+	for i, c := range chain {
+		steps[i] = c.step
+	}
+	return steps
+}
@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func chainIDs(steps []models.ProcessorStep, enabledOnly bool) []string {
+	var ids []string
+	for _, step := range steps {
+		if step.Enabled || !enabledOnly {
+			ids = append(ids, step.ID)
+		}
+	}
+	return ids
+}
+
+func TestProcessorChain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	newCtx := newStreamContext(t, upstream.URL)
+
+	p := newCtx().Proxy
+	want := []string{
+		ProcRewriteInternalURLs, ProcRewriteRefreshURLs, ProcInjectDebugScript,
+		"PHIS:fix_legacy_js", "PHIS:rewrite_phis_urls", ProcApplyRules, ProcInjectCaptchaSolver,
+	}
+	if got := chainIDs(ProcessorChain(p), true); !slices.Equal(got, want) {
+		t.Errorf("Unexpected default chain:\n got %v\nwant %v", got, want)
+	}
+
+	p.Settings.EnableContentMod = false
+	if got := chainIDs(ProcessorChain(p), true); !slices.Equal(got, want[:2]) {
+		t.Errorf("Expected only the URL processors without content modification, got %v", got)
+	}
+	if got := chainIDs(ProcessorChain(p), false); !slices.Equal(got, want) {
+		t.Errorf("Expected the chain to list disabled processors too, got %v", got)
+	}
+
+	// Disabled processors are skipped and ordered ones move to the front, with unknown IDs ignored
+	ctx := newCtx()
+	ctx.Proxy.Settings.DisabledProcessors = []string{"PHIS:fix_legacy_js", ProcInjectDebugScript}
+	ctx.Proxy.Settings.ProcessorOrder = []string{ProcInjectCaptchaSolver, "HIS:fix_legacy_js", "PHIS:rewrite_phis_urls"}
+	want = []string{
+		ProcInjectCaptchaSolver, "PHIS:rewrite_phis_urls",
+		ProcRewriteInternalURLs, ProcRewriteRefreshURLs, ProcApplyRules,
+	}
+	if got := chainIDs(ProcessorChain(ctx.Proxy), true); !slices.Equal(got, want) {
+		t.Errorf("Unexpected configured chain:\n got %v\nwant %v", got, want)
+	}
+
+	page := legacyPage(upstream.URL, 1<<10)
+	body := RunPipeline(ctx, page)
+	if !slices.Equal(ctx.Processors, want) {
+		t.Errorf("Expected RunPipeline to run the configured chain, ran %v", ctx.Processors)
+	}
+	if !strings.Contains(body, "window.showModalDialog == undefined") {
+		t.Error("Expected the disabled legacy JS fix not to run")
+	}
+
+	streamCtx := newCtx()
+	streamCtx.Proxy.Settings = ctx.Proxy.Settings
+	if err := RunStreamPipeline(streamCtx, strings.NewReader(page), io.Discard); err != nil {
+		t.Fatalf("RunStreamPipeline failed: %v", err)
+	}
+	if !slices.Equal(streamCtx.Processors, want) {
+		t.Errorf("Expected RunStreamPipeline to run the configured chain, ran %v", streamCtx.Processors)
+	}
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// HostKey returns host:port for u with the default port of its scheme filled in,
+// so that http://host and http://host:80 compare equal.
+func HostKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// ConsumerOrigin returns the scheme://host:port under which the consumer reaches the proxy
+// listening on port. The host comes from the incoming Host header so that the rewritten URL
+// stays on the interface the consumer actually used; fallbackHost is used when it is missing.
+func ConsumerOrigin(reqCtx context.Context, fallbackHost string, port int) string {
+	scheme := "http"
+	if s, ok := reqCtx.Value(models.OriginalSchemeKey).(string); ok && s != "" {
+		scheme = s
+	}
+
+	host := fallbackHost
+	if originalHost, ok := reqCtx.Value(models.OriginalHostKey).(string); ok && originalHost != "" {
+		if h, _, err := net.SplitHostPort(originalHost); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(originalHost, "[]")
+		}
+	}
+	if host == "" {
+		return ""
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// internalSuffixes are name suffixes only used on private networks.
+var internalSuffixes = []string{".local", ".lan", ".internal", ".intranet", ".corp", ".home.arpa"}
+
+// lookupHost resolves host names for isInternalHost.
+var lookupHost = func(ctx context.Context, host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// isInternalHost reports whether host is a loopback, private or link-local address, a name
+// only used on private networks, or a name resolving only to such addresses.
+func isInternalHost(ctx context.Context, host string) bool {
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == "localhost" || !strings.Contains(host, ".") {
+			return true
+		}
+		for _, suffix := range internalSuffixes {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		}
+		if addrs, err = lookupHost(ctx, host); err != nil {
+			return false
+		}
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() {
+			return false
+		}
+	}
+	return len(addrs) > 0
+}
+
+// isSelf reports whether u already points at this node, as URLs rewritten to consumer form
+// do: at the host the consumer used, at the port of a running proxy or of the API, or at a
+// host that is or resolves to one of the node's addresses.
+func isSelf(ctx context.Context, services models.PipelineServices, u *url.URL) bool {
+	if originalHost, ok := ctx.Value(models.OriginalHostKey).(string); ok && strings.EqualFold(u.Host, originalHost) {
+		return true
+	}
+	if port, err := strconv.Atoi(u.Port()); err == nil && port > 0 {
+		if port == services.APIPort {
+			return true
+		}
+		if services.GetProxies != nil {
+			for _, p := range services.GetProxies() {
+				if p.RemotePort == port {
+					return true
+				}
+			}
+		}
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = lookupHost(ctx, u.Hostname()); err != nil {
+		return false
+	}
+	local := []string{services.MyIP}
+	if services.LocalIPs != nil {
+		local = append(local, services.LocalIPs()...)
+	}
+	for _, addr := range addrs {
+		for _, ip := range local {
+			if localAddr, err := netip.ParseAddr(ip); err == nil && localAddr.Unmap() == addr.Unmap() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSharedHost reports whether u's host is the upstream of a shared proxy.
+func isSharedHost(services models.PipelineServices, u *url.URL) bool {
+	if services.GetProxies == nil {
+		return false
+	}
+	key := HostKey(u)
+	for _, p := range services.GetProxies() {
+		if pu, err := url.Parse(p.OriginalURL); err == nil && HostKey(pu) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteUpstreamURL maps an absolute upstream URL onto the proxy serving its host, creating
+// the proxy through services.CreateProxy if needed. Proxies are only created for internal
+// hosts, so a page can't make the node proxy arbitrary internet hosts; URLs on other hosts
+// that aren't shared yet are left alone. Relative URLs are left alone too since the browser
+// already resolves them against the proxy. It returns false if raw was not rewritten.
+func RewriteUpstreamURL(reqCtx context.Context, services models.PipelineServices, raw string) (string, bool) {
+	myIP, create := services.MyIP, services.CreateProxy
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return raw, false
+	}
+	if u.Scheme == "" {
+		// Protocol-relative URL; assume plain HTTP upstream
+		u.Scheme = "http"
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return raw, false
+	}
+
+	if isSelf(reqCtx, services, u) {
+		return raw, false
+	}
+
+	if create == nil {
+		return raw, false
+	}
+	if !isSharedHost(services, u) && !isInternalHost(reqCtx, u.Hostname()) {
+		log.Printf("Not proxying %s: not an internal host", u.Host)
+		return raw, false
+	}
+	p, err := create(u.Scheme+"://"+u.Host, 0)
+	if err != nil || p == nil {
+		return raw, false
+	}
+
+	origin := ConsumerOrigin(reqCtx, myIP, p.RemotePort)
+	if origin == "" {
+		return raw, false
+	}
+	rewritten := origin + u.RequestURI()
+	if u.Fragment != "" {
+		rewritten += "#" + u.EscapedFragment()
+	}
+	return rewritten, true
+}
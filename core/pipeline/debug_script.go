@@ -1,7 +1,9 @@
 package pipeline
 
 import (
-	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/soda92/vpn-share-tool/core/models"
@@ -9,18 +11,33 @@ import (
 )
 
 func InjectDebugScript(ctx *models.ProcessingContext, body string) string {
+	if script, ok := debugScriptHTML(ctx); ok {
+		return strings.Replace(body, "</body>", script+"</body>", 1)
+	}
+	return body
+}
+
+// InjectDebugScriptStream is the streaming form of InjectDebugScript.
+func InjectDebugScriptStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	if script, ok := debugScriptHTML(ctx); ok {
+		return streamInsertBefore(r, "</body>", script)
+	}
+	return r
+}
+
+// debugScriptHTML returns the script tag to inject into the response, if it gets one.
+func debugScriptHTML(ctx *models.ProcessingContext) (string, bool) {
 	if !ctx.Proxy.Settings.EnableDebugScript {
-		return body
+		return "", false
 	}
 	if strings.Contains(ctx.RespHeader.Get("Content-Type"), "text/html") {
 		myIP := ctx.Services.MyIP
 		apiPort := ctx.Services.APIPort
 		if myIP != "" && apiPort != 0 {
-			debugURL := fmt.Sprintf("http://%s:%d/debug", myIP, apiPort)
+			debugURL := "http://" + net.JoinHostPort(myIP, strconv.Itoa(apiPort)) + "/debug"
 			script := strings.Replace(string(resources.InjectorScript), "__DEBUG_URL__", debugURL, 1)
-			injectionHTML := "<script>" + string(script) + "</script>"
-			return strings.Replace(body, "</body>", injectionHTML+"</body>", 1)
+			return "<script>" + string(script) + "</script>", true
 		}
 	}
-	return body
+	return "", false
 }
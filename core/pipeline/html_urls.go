@@ -0,0 +1,166 @@
+package pipeline
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// urlAttributes hold a single URL.
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"data":       true,
+	"background": true,
+	"cite":       true,
+	"longdesc":   true,
+	"codebase":   true,
+	"manifest":   true,
+}
+
+// reCSSURL matches url(...) with any quoting, and @import with a plain string.
+var reCSSURL = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)|@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// rewriteHTMLURLs tokenizes an HTML body and rewrites internal URLs in URL attributes, srcset,
+// style attributes and elements, event handlers and inline scripts. Everything else, including
+// text and tags without internal URLs, is copied through byte for byte.
+func rewriteHTMLURLs(r *urlRewriter, body string) string {
+	var out strings.Builder
+	out.Grow(len(body))
+	// strings.Reader can't fail
+	io.Copy(&out, newHTMLURLReader(r, strings.NewReader(body)))
+	return out.String()
+}
+
+// htmlURLReader is the streaming form of rewriteHTMLURLs. It holds one token at a time.
+type htmlURLReader struct {
+	r          *urlRewriter
+	z          *html.Tokenizer
+	rawTextTag string // script or style whose content is the next text token
+	out        []byte
+	err        error
+}
+
+func newHTMLURLReader(r *urlRewriter, src io.Reader) *htmlURLReader {
+	return &htmlURLReader{r: r, z: html.NewTokenizer(src)}
+}
+
+func (h *htmlURLReader) Read(p []byte) (int, error) {
+	for len(h.out) == 0 {
+		if h.err != nil {
+			return 0, h.err
+		}
+		h.out = h.next(h.out[:0])
+	}
+	n := copy(p, h.out)
+	h.out = h.out[n:]
+	return n, nil
+}
+
+// next appends the next token, rewritten, to dst.
+func (h *htmlURLReader) next(dst []byte) []byte {
+	z := h.z
+	tt := z.Next()
+	if tt == html.ErrorToken {
+		// Raw holds whatever unterminated markup was left at EOF
+		h.err = z.Err()
+		return append(dst, z.Raw()...)
+	}
+
+	switch tt {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		// Raw must be copied before Token, which may lower-case the buffer in place
+		raw := append(dst, z.Raw()...)
+		token := z.Token()
+		h.rawTextTag = ""
+		if tt == html.StartTagToken && (token.Data == "script" || token.Data == "style") {
+			h.rawTextTag = token.Data
+		}
+		if rewriteTagURLs(h.r, &token) {
+			return append(dst, token.String()...)
+		}
+		return raw
+	case html.TextToken:
+		rawTextTag := h.rawTextTag
+		h.rawTextTag = ""
+		switch rawTextTag {
+		case "script":
+			return append(dst, h.r.rewriteText(string(z.Raw()))...)
+		case "style":
+			return append(dst, rewriteCSSURLs(h.r, string(z.Raw()))...)
+		}
+	}
+	h.rawTextTag = ""
+	return append(dst, z.Raw()...)
+}
+
+// rewriteTagURLs rewrites the attributes of a tag, reporting whether any changed.
+func rewriteTagURLs(r *urlRewriter, token *html.Token) bool {
+	changed := false
+	for i, attr := range token.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+		value := attr.Val
+		switch key := attr.Key; {
+		case urlAttributes[key]:
+			value, _ = r.rewriteURL(value)
+		case key == "srcset" || key == "imagesrcset":
+			value = rewriteSrcset(r, value)
+		case key == "style":
+			value = rewriteCSSURLs(r, value)
+		case strings.HasPrefix(key, "on"):
+			value = r.rewriteText(value)
+		}
+		if value != attr.Val {
+			token.Attr[i].Val = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteSrcset rewrites the URL of each "url [descriptor]" candidate in a srcset.
+func rewriteSrcset(r *urlRewriter, srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		trimmed := strings.TrimLeft(candidate, " \t\n\r\f")
+		lead := candidate[:len(candidate)-len(trimmed)]
+		end := strings.IndexAny(trimmed, " \t\n\r\f")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		if rewritten, ok := r.rewriteURL(trimmed[:end]); ok {
+			candidates[i] = lead + rewritten + trimmed[end:]
+		}
+	}
+	return strings.Join(candidates, ",")
+}
+
+// rewriteCSSURLs rewrites internal URLs in url() and @import of a stylesheet or style attribute.
+func rewriteCSSURLs(r *urlRewriter, css string) string {
+	return reCSSURL.ReplaceAllStringFunc(css, func(match string) string {
+		return cssURLReplacement(r, match)
+	})
+}
+
+// cssURLReplacement rewrites the URL of one url() or @import match.
+func cssURLReplacement(r *urlRewriter, match string) string {
+	m := reCSSURL.FindStringSubmatchIndex(match)
+	// The URL is whichever of the alternatives' groups took part in the match
+	for g := 2; g < len(m); g += 2 {
+		if m[g] < 0 {
+			continue
+		}
+		if rewritten, ok := r.rewriteURL(match[m[g]:m[g+1]]); ok {
+			return match[:m[g]] + rewritten + match[m[g+1]:]
+		}
+		break
+	}
+	return match
+}
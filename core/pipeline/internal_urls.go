@@ -1,10 +1,15 @@
 package pipeline
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +22,9 @@ var (
 	rePrivate10  = regexp.MustCompile(`(https?://)(10\.\d{1,3}\.\d{1,3}\.\d{1,3})(:\d+)?`)
 	rePrivate172 = regexp.MustCompile(`(https?://)(172\.(?:1[6-9]|2\d|3[0-1])\.\d{1,3}\.\d{1,3})(:\d+)?`)
 	rePrivate192 = regexp.MustCompile(`(https?://)(192\.168\.\d{1,3}\.\d{1,3})(:\d+)?`)
+	// IPv6 literals are bracketed in URLs: loopback ::1 and unique local fc00::/7
+	reLocalhostV6 = regexp.MustCompile(`(https?://)(\[::1\])(:\d+)?`)
+	rePrivateV6   = regexp.MustCompile(`(?i)(https?://)(\[f[cd][0-9a-f]{2}:[0-9a-f:]*\])(:\d+)?`)
 )
 
 // Reachability Cache
@@ -69,75 +77,288 @@ func isReachableFast(urlStr string) bool {
 	return reachable
 }
 
+// RewriteInternalURLs points absolute URLs to internal hosts, and to upstreams that are already
+// shared (including the proxy's own), at proxies for those hosts, so the consumer can follow
+// them. HTML and CSS are tokenized so only URLs in links, resources and inline code are
+// touched; other text such as JS and JSON falls back to matching URLs anywhere.
 func RewriteInternalURLs(ctx *models.ProcessingContext, body string) string {
-	// 1. Rewrite specific internal URLs (e.g. 10.x.x.x)
 	contentType := ctx.RespHeader.Get("Content-Type")
-	if strings.Contains(contentType, "text/") ||
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "" && strings.Contains(ctx.ReqURL.Path, ".jsp") {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType([]byte(body)))
+	}
+
+	r := newURLRewriter(ctx)
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return rewriteHTMLURLs(r, body)
+	case mediaType == "text/css":
+		return rewriteCSSURLs(r, body)
+	case strings.HasPrefix(mediaType, "text/") ||
 		strings.Contains(contentType, "application/javascript") ||
 		strings.Contains(contentType, "application/json") ||
-		strings.Contains(ctx.ReqURL.Path, ".jsp") {
+		strings.Contains(ctx.ReqURL.Path, ".jsp"):
+		return r.rewriteText(body)
+	}
+	return body
+}
 
-		regexes := []*regexp.Regexp{reLocalhost, rePrivate10, rePrivate172, rePrivate192}
+// RewriteInternalURLsStream is the streaming form of RewriteInternalURLs.
+func RewriteInternalURLsStream(ctx *models.ProcessingContext, src io.Reader) io.Reader {
+	contentType := ctx.RespHeader.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "" && strings.Contains(ctx.ReqURL.Path, ".jsp") {
+		br := bufio.NewReaderSize(src, 512)
+		// Peek fails on bodies shorter than 512 bytes, but still returns them
+		head, _ := br.Peek(512)
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+		src = br
+	}
 
-		uniqueMatches := make(map[string]bool)
-		for _, re := range regexes {
-			matches := re.FindAllString(body, -1)
-			for _, match := range matches {
-				uniqueMatches[match] = true
-			}
+	r := newURLRewriter(ctx)
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return newHTMLURLReader(r, src)
+	case mediaType == "text/css":
+		return newWindowReader(src, DefaultLookahead, replaceEdit(reCSSURL, DefaultLookahead, func(dst, window []byte, m []int) []byte {
+			return append(dst, cssURLReplacement(r, string(window[m[0]:m[1]]))...)
+		}))
+	case strings.HasPrefix(mediaType, "text/") ||
+		strings.Contains(contentType, "application/javascript") ||
+		strings.Contains(contentType, "application/json") ||
+		strings.Contains(ctx.ReqURL.Path, ".jsp"):
+		return r.streamText(src)
+	}
+	return src
+}
+
+var internalOriginRegexes = []*regexp.Regexp{reLocalhost, rePrivate10, rePrivate172, rePrivate192, reLocalhostV6, rePrivateV6}
+
+// reInternalOrigin matches any internal origin, so a body can be rewritten in one pass without
+// rescanning the consumer origins it inserts.
+var reInternalOrigin = func() *regexp.Regexp {
+	patterns := make([]string, len(internalOriginRegexes))
+	for i, re := range internalOriginRegexes {
+		patterns[i] = "(?:" + re.String() + ")"
+	}
+	return regexp.MustCompile(strings.Join(patterns, "|"))
+}()
+
+// isInternalOrigin reports whether origin (scheme://host[:port]) is a loopback or private address.
+func isInternalOrigin(origin string) bool {
+	for _, re := range internalOriginRegexes {
+		if re.FindString(origin) == origin {
+			return true
 		}
+	}
+	return false
+}
 
-		if len(uniqueMatches) > 0 {
-			replacements := make(map[string]string)
-			originalHost, ctxOk := ctx.ReqContext.Value(models.OriginalHostKey).(string)
-
-			for match := range uniqueMatches {
-				if _, processed := replacements[match]; processed {
-					continue
-				}
-
-				if ctx.Services.MyIP != "" && strings.Contains(match, ctx.Services.MyIP) {
-					continue
-				}
-
-				// Verify if the detected internal URL is actually reachable (Fast Cached Check)
-				if !isReachableFast(match) {
-					continue
-				}
-
-				var newProxy *models.SharedProxy
-				var err error
-
-				// Use injected CreateProxy service
-				if ctx.Services.CreateProxy != nil {
-					newProxy, err = ctx.Services.CreateProxy(match, 0)
-				} else {
-					err = fmt.Errorf("CreateProxy service not available")
-				}
-
-				if err != nil {
-					log.Printf("Error creating proxy for internal URL %s: %v", match, err)
-					continue
-				}
-
-				if !ctxOk {
-					if ctx.Services.MyIP != "" {
-						replacements[match] = fmt.Sprintf("http://%s:%d", ctx.Services.MyIP, newProxy.RemotePort)
-					}
-				} else {
-					hostParts := strings.Split(originalHost, ":")
-					proxyHost := hostParts[0]
-					replacements[match] = fmt.Sprintf("http://%s:%d", proxyHost, newProxy.RemotePort)
-				}
-			}
+// originRegex caches the pattern matching internal origins and the origins of the currently
+// shared upstreams, which only changes when a proxy is added or removed.
+var originRegex struct {
+	sync.Mutex
+	key string
+	re  *regexp.Regexp
+}
 
-			for oldURL, newURL := range replacements {
-				if oldURL != newURL {
-					log.Printf("Rewriting body URL: %s -> %s", oldURL, newURL)
-					body = strings.ReplaceAll(body, oldURL, newURL)
-				}
+// reOrigin returns a pattern matching internal origins, and absolute or protocol-relative
+// origins on hosts.
+func reOrigin(hosts []string) *regexp.Regexp {
+	if len(hosts) == 0 {
+		return reInternalOrigin
+	}
+	hosts = slices.Sorted(slices.Values(hosts))
+	key := strings.Join(hosts, "|")
+
+	originRegex.Lock()
+	defer originRegex.Unlock()
+	if originRegex.key != key {
+		patterns := make([]string, len(hosts))
+		for i, host := range hosts {
+			patterns[i] = regexp.QuoteMeta(host)
+			if strings.Contains(host, ":") {
+				patterns[i] = `\[` + patterns[i] + `\]`
 			}
 		}
+		originRegex.key = key
+		originRegex.re = regexp.MustCompile(reInternalOrigin.String() + `|(?i:(?:https?:)?//(?:` + strings.Join(patterns, "|") + `)(?::\d+)?)`)
 	}
-	return body
+	return originRegex.re
+}
+
+// urlRewriter maps the origins found in one body to the consumer-facing origins of their
+// proxies. Each origin is checked and proxied at most once per body.
+type urlRewriter struct {
+	ctx     *models.ProcessingContext
+	origins map[string]string // Origin -> consumer origin, "" if it is left alone
+	shared  map[string]*models.SharedProxy
+	hosts   []string // Hostnames of shared upstreams
+}
+
+func newURLRewriter(ctx *models.ProcessingContext) *urlRewriter {
+	r := &urlRewriter{ctx: ctx, origins: map[string]string{}, shared: map[string]*models.SharedProxy{}}
+	proxies := []*models.SharedProxy{}
+	if ctx.Services.GetProxies != nil {
+		proxies = ctx.Services.GetProxies()
+	}
+	// The proxy's own upstream, even if it was removed while this response was in flight
+	if ctx.Proxy != nil {
+		proxies = append(proxies, ctx.Proxy)
+	}
+	for _, p := range proxies {
+		u, err := url.Parse(p.OriginalURL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		key := HostKey(u)
+		if _, ok := r.shared[key]; ok {
+			continue
+		}
+		r.shared[key] = p
+		if host := strings.ToLower(u.Hostname()); !slices.Contains(r.hosts, host) {
+			r.hosts = append(r.hosts, host)
+		}
+	}
+	return r
+}
+
+// origin returns the consumer origin replacing origin, or "" to leave it alone.
+func (r *urlRewriter) origin(origin string) string {
+	if replacement, ok := r.origins[origin]; ok {
+		return replacement
+	}
+	replacement := r.resolve(origin)
+	if replacement == origin {
+		replacement = ""
+	}
+	if replacement != "" {
+		log.Printf("Rewriting body URL: %s -> %s", origin, replacement)
+	}
+	r.origins[origin] = replacement
+	return replacement
+}
+
+func (r *urlRewriter) resolve(origin string) string {
+	ctx := r.ctx
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return ""
+	}
+	// Upstreams that are already shared, including this proxy's own, by name or address
+	if p := r.shared[HostKey(u)]; p != nil {
+		return ConsumerOrigin(ctx.ReqContext, ctx.Services.MyIP, p.RemotePort)
+	}
+
+	if !isInternalOrigin(origin) || isSelf(ctx.ReqContext, ctx.Services, u) {
+		return ""
+	}
+
+	// Verify if the detected internal URL is actually reachable (Fast Cached Check)
+	if !isReachableFast(origin) {
+		return ""
+	}
+
+	var newProxy *models.SharedProxy
+
+	// Use injected CreateProxy service
+	if ctx.Services.CreateProxy != nil {
+		newProxy, err = ctx.Services.CreateProxy(origin, 0)
+	} else {
+		err = fmt.Errorf("CreateProxy service not available")
+	}
+
+	if err != nil {
+		log.Printf("Error creating proxy for internal URL %s: %v", origin, err)
+		return ""
+	}
+
+	return ConsumerOrigin(ctx.ReqContext, ctx.Services.MyIP, newProxy.RemotePort)
+}
+
+// rewriteURL rewrites a single absolute or protocol-relative URL, keeping everything after
+// its host as written.
+func (r *urlRewriter) rewriteURL(raw string) (string, bool) {
+	trimmed := strings.TrimSpace(raw)
+	u, err := url.Parse(trimmed)
+	if err != nil || u.Host == "" {
+		return raw, false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return raw, false
+	}
+
+	authority := trimmed[strings.Index(trimmed, "//")+2:]
+	rest := ""
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		rest = authority[i:]
+	}
+	replacement := r.origin(scheme + "://" + strings.ToLower(u.Host))
+	if replacement == "" {
+		return raw, false
+	}
+	return replacement + rest, true
+}
+
+// rewriteText replaces internal and shared origins anywhere in body. It is the fallback for
+// content that isn't tokenized, such as JS and JSON.
+func (r *urlRewriter) rewriteText(body string) string {
+	var out []byte
+	last := 0
+	for _, m := range reOrigin(r.hosts).FindAllStringIndex(body, -1) {
+		if replacement, ok := r.textReplacement(body[m[0]:m[1]], body[m[1]:]); ok {
+			out = append(out, body[last:m[0]]...)
+			out = append(out, replacement...)
+			last = m[1]
+		}
+	}
+	if last == 0 {
+		return body
+	}
+	return string(append(out, body[last:]...))
+}
+
+// textReplacement returns the consumer origin replacing an origin matched in text, followed by rest.
+func (r *urlRewriter) textReplacement(match, rest string) (string, bool) {
+	// Skip longer hostnames that merely start with a known one
+	if continuesHostname(rest) {
+		return "", false
+	}
+	origin := match
+	if strings.HasPrefix(origin, "//") {
+		origin = "http:" + origin
+	}
+	replacement := r.origin(strings.ToLower(origin))
+	return replacement, replacement != ""
+}
+
+// streamText is the streaming form of rewriteText.
+func (r *urlRewriter) streamText(src io.Reader) io.Reader {
+	return newWindowReader(src, DefaultLookahead, replaceEdit(reOrigin(r.hosts), DefaultLookahead, func(dst, window []byte, m []int) []byte {
+		rest := window[m[1]:min(m[1]+2, len(window))]
+		if replacement, ok := r.textReplacement(string(window[m[0]:m[1]]), string(rest)); ok {
+			return append(dst, replacement...)
+		}
+		return append(dst, window[m[0]:m[1]]...)
+	}))
+}
+
+// continuesHostname reports whether rest, the text after a matched host, continues the hostname.
+func continuesHostname(rest string) bool {
+	for i := 0; i < len(rest) && i < 2; i++ {
+		c := rest[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			return true
+		case c == '.' && i == 0:
+			continue
+		}
+		return false
+	}
+	return false
 }
@@ -0,0 +1,215 @@
+package pipeline
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestRewriteInternalURLsIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Listener = listener
+	upstream.Start()
+	defer upstream.Close()
+
+	var requested string
+	services := models.PipelineServices{
+		MyIP: "fd00::1",
+		CreateProxy: func(u string, port int) (*models.SharedProxy, error) {
+			requested = u
+			return &models.SharedProxy{OriginalURL: u, RemotePort: 10100}, nil
+		},
+	}
+	reqCtx := context.WithValue(context.Background(), models.OriginalHostKey, "[fd00::1]:10081")
+	reqURL, _ := url.Parse("http://[fd00::5]/index.jsp")
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: reqCtx,
+		RespHeader: header,
+		Services:   services,
+	}
+
+	input := `<a href="` + upstream.URL + `/app">app</a> <a href="http://[fd00::1]:10081/self">self</a>`
+	output := RewriteInternalURLs(ctx, input)
+
+	if requested != upstream.URL {
+		t.Errorf("Expected proxy to be created for %s, got %q", upstream.URL, requested)
+	}
+	for _, expected := range []string{
+		`href="http://[fd00::1]:10100/app"`,
+		`href="http://[fd00::1]:10081/self"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain %q\nGot:\n%s", expected, output)
+		}
+	}
+}
+
+func newRewriteContext(t *testing.T, contentType string) (*models.ProcessingContext, string) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	reqURL, _ := url.Parse("http://192.168.1.9/index.jsp")
+	return &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: context.WithValue(context.Background(), models.OriginalHostKey, "192.168.1.2:10081"),
+		RespHeader: header,
+		Services: models.PipelineServices{
+			MyIP: "192.168.1.2",
+			CreateProxy: func(u string, port int) (*models.SharedProxy, error) {
+				if u != upstream.URL {
+					t.Errorf("Unexpected proxy for %s", u)
+				}
+				return &models.SharedProxy{OriginalURL: u, RemotePort: 10100}, nil
+			},
+		},
+	}, upstream.URL
+}
+
+func TestRewriteInternalURLsHTML(t *testing.T) {
+	ctx, upstream := newRewriteContext(t, "text/html; charset=utf-8")
+	host := strings.TrimPrefix(upstream, "http://")
+	const proxied = "http://192.168.1.2:10100"
+
+	input := `<!DOCTYPE html><HTML><Body class=main>` +
+		`<a href="` + upstream + `/app?a=1&amp;b=2">go</a>` +
+		`<img src="//` + host + `/logo.png" srcset="` + upstream + `/a.png 1x, /b.png 2x">` +
+		`<form ACTION='http:&#47;&#47;` + host + `/submit'></form>` +
+		`<div style="background: url('` + upstream + `/bg.png')" onclick="location.href='` + upstream + `/x'"></div>` +
+		`<p>Server at ` + upstream + ` is down</p>` +
+		`<script>var api = "` + upstream + `/api";</script>` +
+		`<style>.x { background: url(` + upstream + `/y.png) }</style>` +
+		`<input disabled value=` + upstream + `></Body></HTML><div cl`
+	output := RewriteInternalURLs(ctx, input)
+
+	for _, expected := range []string{
+		`<!DOCTYPE html><HTML><Body class=main>`,
+		`<a href="` + proxied + `/app?a=1&amp;b=2">`,
+		`src="` + proxied + `/logo.png"`,
+		`srcset="` + proxied + `/a.png 1x, /b.png 2x"`,
+		`action="` + proxied + `/submit"`,
+		`url(&#39;` + proxied + `/bg.png&#39;)`,
+		`location.href=&#39;` + proxied + `/x&#39;`,
+		`<p>Server at ` + upstream + ` is down</p>`,
+		`var api = "` + proxied + `/api";`,
+		`url(` + proxied + `/y.png)`,
+		`<input disabled value=` + upstream + `></Body></HTML><div cl`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain %q\nGot:\n%s", expected, output)
+		}
+	}
+}
+
+func TestRewriteInternalURLsUntouchedHTML(t *testing.T) {
+	ctx, _ := newRewriteContext(t, "text/html")
+	input := "<html ><HEAD><title>a &amp; b</title></HEAD>\n<body onload='init()'><a href=/rel>x</a><!-- c --></body></html>"
+	if output := RewriteInternalURLs(ctx, input); output != input {
+		t.Errorf("Expected HTML without internal URLs to be unchanged, got:\n%s", output)
+	}
+}
+
+func TestRewriteInternalURLsFallbacks(t *testing.T) {
+	const proxied = "http://192.168.1.2:10100"
+
+	ctx, upstream := newRewriteContext(t, "text/css")
+	css := `@import "` + upstream + `/base.css"; .a { background: url("` + upstream + `/a.png") }`
+	want := `@import "` + proxied + `/base.css"; .a { background: url("` + proxied + `/a.png") }`
+	if output := RewriteInternalURLs(ctx, css); output != want {
+		t.Errorf("Unexpected CSS rewrite:\n got %s\nwant %s", output, want)
+	}
+
+	ctx, upstream = newRewriteContext(t, "application/json")
+	json := `{"url": "` + upstream + `/a", "other": "` + upstream + `5/b"}`
+	want = `{"url": "` + proxied + `/a", "other": "` + upstream + `5/b"}`
+	if output := RewriteInternalURLs(ctx, json); output != want {
+		t.Errorf("Unexpected JSON rewrite:\n got %s\nwant %s", output, want)
+	}
+}
+
+func TestRewriteSharedHostnames(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	reqURL, _ := url.Parse("http://his.hospital.local/app/index.jsp")
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: context.WithValue(context.Background(), models.OriginalHostKey, "192.168.1.2:10081"),
+		RespHeader: header,
+		Proxy:      &models.SharedProxy{OriginalURL: "http://his.hospital.local/app", RemotePort: 10081},
+		Services: models.PipelineServices{
+			MyIP: "192.168.1.2",
+			GetProxies: func() []*models.SharedProxy {
+				return []*models.SharedProxy{{OriginalURL: "https://lab.hospital.local", RemotePort: 10082}}
+			},
+			CreateProxy: func(u string, port int) (*models.SharedProxy, error) {
+				t.Errorf("Unexpected proxy for %s", u)
+				return nil, nil
+			},
+		},
+	}
+
+	input := `<a href="http://his.hospital.local/app/x">x</a>` +
+		`<a href="http://HIS.hospital.local:80/y">y</a>` +
+		`<img src="https://lab.hospital.local/i.png">` +
+		`<a href="http://his.hospital.local:8080/z">z</a>` +
+		`<script>var a = "http://his.hospital.local.example.com/", b = '//his.hospital.local/api';</script>`
+	want := `<a href="http://192.168.1.2:10081/app/x">x</a>` +
+		`<a href="http://192.168.1.2:10081/y">y</a>` +
+		`<img src="http://192.168.1.2:10082/i.png">` +
+		`<a href="http://his.hospital.local:8080/z">z</a>` +
+		`<script>var a = "http://his.hospital.local.example.com/", b = 'http://192.168.1.2:10081/api';</script>`
+	if output := RewriteInternalURLs(ctx, input); output != want {
+		t.Errorf("Unexpected rewrite:\n got %s\nwant %s", output, want)
+	}
+}
+
+func TestRewriteInternalURLsSkipsNodeAddresses(t *testing.T) {
+	reachCacheLock.Lock()
+	for _, origin := range []string{"http://10.0.0.10:8080", "http://192.168.5.1:10100", "http://192.168.5.1:9000"} {
+		reachCache[origin] = reachabilityResult{reachable: true, timestamp: time.Now()}
+	}
+	reachCacheLock.Unlock()
+
+	var created []string
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	reqURL, _ := url.Parse("http://10.0.0.5/index.jsp")
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: context.WithValue(context.Background(), models.OriginalHostKey, "10.0.0.1:10081"),
+		RespHeader: header,
+		Services: models.PipelineServices{
+			MyIP:     "10.0.0.1",
+			LocalIPs: func() []string { return []string{"10.0.0.1", "192.168.5.1"} },
+			CreateProxy: func(u string, port int) (*models.SharedProxy, error) {
+				created = append(created, u)
+				return &models.SharedProxy{OriginalURL: u, RemotePort: 10100}, nil
+			},
+		},
+	}
+
+	// 10.0.0.10 merely starts with the node's address; 192.168.5.1 is the node on another interface
+	input := `<a href="http://10.0.0.10:8080/a">a</a><a href="http://192.168.5.1:10100/b">b</a><a href="http://192.168.5.1:9000/c">c</a>`
+	want := `<a href="http://10.0.0.1:10100/a">a</a><a href="http://192.168.5.1:10100/b">b</a><a href="http://192.168.5.1:9000/c">c</a>`
+	if output := RewriteInternalURLs(ctx, input); output != want {
+		t.Errorf("Unexpected rewrite:\n got %s\nwant %s", output, want)
+	}
+	if len(created) != 1 || created[0] != "http://10.0.0.10:8080" {
+		t.Errorf("Expected a proxy for 10.0.0.10:8080 only, got %v", created)
+	}
+}
@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"io"
 	"regexp"
 	"runtime/trace"
 
@@ -15,15 +16,32 @@ var (
 	reEhrWindowOpen      = regexp.MustCompile(`window\.open\(\s*url\s*,\s*""\s*,\s*[^;]+\);`)
 )
 
-func FixLegacyJS(ctx *models.ProcessingContext, body string) string {
-	defer trace.StartRegion(ctx.ReqContext, "FixLegacyJS").End()
+// legacyJSFixes are applied in order by FixLegacyJS.
+var legacyJSFixes = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
 	// Remove disable_backspace script using regex
-	body = reStopItBlock.ReplaceAllString(body, "")
-
+	{reStopItBlock, ""},
 	// Replace openModalDialog logic
-	body = reShowModalCheck.ReplaceAllString(body, "if(true)")
-	body = reWindowOpenFallback.ReplaceAllString(body, `window.open(url, "_blank");`)
-	body = reEhrOpenChrome.ReplaceAllString(body, `Ehr.openChrome = function(url){ window.open(url, "_blank"); return;`)
-	body = reEhrWindowOpen.ReplaceAllString(body, `window.open(url, "_blank");`)
+	{reShowModalCheck, "if(true)"},
+	{reWindowOpenFallback, `window.open(url, "_blank");`},
+	{reEhrOpenChrome, `Ehr.openChrome = function(url){ window.open(url, "_blank"); return;`},
+	{reEhrWindowOpen, `window.open(url, "_blank");`},
+}
+
+func FixLegacyJS(ctx *models.ProcessingContext, body string) string {
+	defer trace.StartRegion(ctx.ReqContext, "FixLegacyJS").End()
+	for _, fix := range legacyJSFixes {
+		body = fix.re.ReplaceAllString(body, fix.repl)
+	}
 	return body
 }
+
+// FixLegacyJSStream is the streaming form of FixLegacyJS.
+func FixLegacyJSStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	for _, fix := range legacyJSFixes {
+		r = streamRegexReplace(r, fix.re, fix.repl)
+	}
+	return r
+}
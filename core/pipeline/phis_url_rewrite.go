@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"regexp"
 	"runtime/trace"
@@ -17,59 +18,99 @@ var (
 
 func RewritePhisURLs(ctx *models.ProcessingContext, body string) string {
 	defer trace.StartRegion(ctx.ReqContext, "RewritePhisURLs").End()
-	if strings.Contains(ctx.ReqURL.Path, "showView.jsp") {
-		matchesHttpPhis := reHttpPhis.FindStringSubmatch(body)
-		matchesPhisUrl := rePhisUrl.FindStringSubmatch(body)
-
-		var originalPhisURL string
-		var foundMatch bool
+	if !strings.Contains(ctx.ReqURL.Path, "showView.jsp") {
+		return body
+	}
+	if oldURL, newURL := phisReplacement(ctx, body); newURL != "" {
+		body = strings.ReplaceAll(body, oldURL, newURL)
+	}
+	return body
+}
 
-		if len(matchesPhisUrl) > 1 {
-			originalPhisURL = matchesPhisUrl[1]
-			foundMatch = true
-		} else if len(matchesHttpPhis) > 1 {
-			originalPhisURL = matchesHttpPhis[1]
-			foundMatch = true
+// RewritePhisURLsStream is the streaming form of RewritePhisURLs. The page is held back until
+// the phis URL declaration is found, so mentions of the URL before it are replaced as well; a
+// page without one is held back whole.
+func RewritePhisURLsStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	if !strings.Contains(ctx.ReqURL.Path, "showView.jsp") {
+		return r
+	}
+	var replace editFunc
+	scanned := 0
+	return newWindowReader(r, DefaultLookahead, func(dst, window []byte, atEOF bool) ([]byte, int) {
+		if replace == nil {
+			// Declarations are shorter than the lookahead, so one cut off at the end of the
+			// last scan starts in its final DefaultLookahead bytes
+			rest := window[max(scanned-DefaultLookahead, 0):]
+			scanned = len(window)
+			if !atEOF && !rePhisUrl.Match(rest) && !reHttpPhis.Match(rest) {
+				return dst, 0
+			}
+			replace = func(dst, window []byte, atEOF bool) ([]byte, int) {
+				return append(dst, window...), len(window)
+			}
+			if oldURL, newURL := phisReplacement(ctx, string(window)); newURL != "" {
+				re := regexp.MustCompile(regexp.QuoteMeta(oldURL))
+				replace = replaceEdit(re, len(oldURL), func(dst, _ []byte, _ []int) []byte {
+					return append(dst, newURL...)
+				})
+			}
 		}
+		return replace(dst, window, atEOF)
+	})
+}
+
+// phisReplacement finds the phis URL declared in body and proxies it, pointing the Location
+// header at the new proxy. It returns the URL to replace and its replacement, or "" if none.
+func phisReplacement(ctx *models.ProcessingContext, body string) (string, string) {
+	matchesHttpPhis := reHttpPhis.FindStringSubmatch(body)
+	matchesPhisUrl := rePhisUrl.FindStringSubmatch(body)
+
+	var originalPhisURL string
+	var foundMatch bool
+
+	if len(matchesPhisUrl) > 1 {
+		originalPhisURL = matchesPhisUrl[1]
+		foundMatch = true
+	} else if len(matchesHttpPhis) > 1 {
+		originalPhisURL = matchesHttpPhis[1]
+		foundMatch = true
+	}
 
-		if foundMatch {
-			log.Printf("Found phis URL: %s", originalPhisURL)
+	if foundMatch {
+		log.Printf("Found phis URL: %s", originalPhisURL)
 
-			var newProxy *models.SharedProxy
-			var err error
+		var newProxy *models.SharedProxy
+		var err error
 
-			if originalPhisURL != "" {
-				// Use the CreateProxy service injected in the context
-				if ctx.Services.CreateProxy != nil {
-					newProxy, err = ctx.Services.CreateProxy(originalPhisURL, 0)
-				} else {
-					err = fmt.Errorf("CreateProxy service not available")
-				}
+		if originalPhisURL != "" {
+			// Use the CreateProxy service injected in the context
+			if ctx.Services.CreateProxy != nil {
+				newProxy, err = ctx.Services.CreateProxy(originalPhisURL, 0)
+			} else {
+				err = fmt.Errorf("CreateProxy service not available")
+			}
 
-				if err == nil && newProxy != nil {
-					// We created a proxy for the anti-phishing redirect destination.
-					// Now we should rewrite the Location header to point to our proxy.
-					sharedURL := fmt.Sprintf("http://%s:%d%s", ctx.Services.MyIP, newProxy.RemotePort, newProxy.Path)
-					ctx.RespHeader.Set("Location", sharedURL)
-					log.Printf("Rewrote anti-phishing redirect to: %s", sharedURL)
-				}
+			if err == nil && newProxy != nil {
+				// We created a proxy for the anti-phishing redirect destination.
+				// Now we should rewrite the Location header to point to our proxy.
+				sharedURL := ConsumerOrigin(ctx.ReqContext, ctx.Services.MyIP, newProxy.RemotePort) + newProxy.Path
+				ctx.RespHeader.Set("Location", sharedURL)
+				log.Printf("Rewrote anti-phishing redirect to: %s", sharedURL)
 			}
+		}
 
-			if err != nil {
-				log.Printf("Error creating proxy for phis URL: %v", err)
-			} else if newProxy != nil {
-				originalHost, ok := ctx.ReqContext.Value(models.OriginalHostKey).(string)
-				if !ok {
-					log.Printf("Error: originalHost not found in request context for URL %s", ctx.ReqURL.String())
-				} else {
-					hostParts := strings.Split(originalHost, ":")
-					newProxyURL := fmt.Sprintf("http://%s:%d%s", hostParts[0], newProxy.RemotePort, newProxy.Path)
+		if err != nil {
+			log.Printf("Error creating proxy for phis URL: %v", err)
+		} else if newProxy != nil {
+			if _, ok := ctx.ReqContext.Value(models.OriginalHostKey).(string); !ok {
+				log.Printf("Error: originalHost not found in request context for URL %s", ctx.ReqURL.String())
+			} else {
+				newProxyURL := ConsumerOrigin(ctx.ReqContext, ctx.Services.MyIP, newProxy.RemotePort) + newProxy.Path
 
-					log.Printf("Replacing phis URL with: %s", newProxyURL)
-					body = strings.ReplaceAll(body, originalPhisURL, newProxyURL)
-				}
+				log.Printf("Replacing phis URL with: %s", newProxyURL)
+				return originalPhisURL, newProxyURL
 			}
 		}
 	}
-	return body
+	return "", ""
 }
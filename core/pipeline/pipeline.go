@@ -2,7 +2,11 @@ package pipeline
 
 import (
 	_ "embed"
+	"hash/maphash"
+	"io"
+	"runtime/trace"
 	"strings"
+	"time"
 
 	"github.com/soda92/vpn-share-tool/core/models"
 )
@@ -16,27 +20,53 @@ func RunPipeline(ctx *models.ProcessingContext, body string) string {
 		return body
 	}
 
-	// 1. Internal URL Rewrite
-	if ctx.Proxy.Settings.EnableUrlRewrite {
-		body = RewriteInternalURLs(ctx, body)
+	for _, proc := range processorChain(ctx.Proxy) {
+		if !proc.step.Enabled {
+			continue
+		}
+		ctx.Processors = append(ctx.Processors, proc.step.ID)
+		in := body
+		start := time.Now()
+		body = proc.content(ctx, body)
+		recordRun(ctx, proc.step, time.Since(start), int64(len(in)), int64(len(body)), body != in)
+		if ctx.Drop {
+			return body
+		}
 	}
 
-	// 2. Content Modification (System Specific & Debug)
-	if ctx.Proxy.Settings.EnableContentMod {
-		// Run Debug Script injection (if it's HTML)
-		body = InjectDebugScript(ctx, body)
-
-		// Run System Specific Processors
-		for _, activeSysID := range ctx.Proxy.ActiveSystems {
-			for _, defSys := range DefinedSystems {
-				if defSys.ID == activeSysID {
-					for _, p := range defSys.Processors {
-						body = p(ctx, body)
-					}
-				}
-			}
+	return body
+}
+
+// RunStreamPipeline is the streaming form of RunPipeline: it copies the processed body from r
+// to w. Processors that need the whole body, such as the runtime rules, buffer it themselves.
+// If a rule drops the response, ctx.Drop is set and nothing after the rules is written.
+func RunStreamPipeline(ctx *models.ProcessingContext, r io.Reader, w io.Writer) error {
+	defer trace.StartRegion(ctx.ReqContext, "RunStreamPipeline").End()
+	// Skip processing for a specific system that use "*.js?name=xxx" for dynamic streaming js
+	path := strings.ToLower(ctx.ReqURL.Path)
+	if strings.HasPrefix(path, "*.js") {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	// Each processor reads the metered output of the one before it
+	seed := maphash.MakeSeed()
+	meters := []*meteredReader{newMeteredReader(r, seed)}
+	var steps []models.ProcessorStep
+	for _, proc := range processorChain(ctx.Proxy) {
+		if proc.step.Enabled {
+			ctx.Processors = append(ctx.Processors, proc.step.ID)
+			steps = append(steps, proc.step)
+			meters = append(meters, newMeteredReader(proc.stream(ctx, meters[len(meters)-1]), seed))
 		}
 	}
 
-	return body
+	_, err := io.Copy(w, meters[len(meters)-1])
+	if err != nil {
+		return err
+	}
+	for i, step := range steps {
+		recordStreamRun(ctx, step, meters[i], meters[i+1])
+	}
+	return nil
 }
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"runtime/trace"
+	"strings"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+var (
+	reMetaRefresh    = regexp.MustCompile(`(?i)<meta[^>]+http-equiv\s*=\s*["']?refresh["']?[^>]*>`)
+	reMetaRefreshURL = regexp.MustCompile(`(?i)(content\s*=\s*["']?\s*\d*\s*;\s*url\s*=\s*['"]?)([^"'\s>]+)`)
+	reJSLocation     = regexp.MustCompile(`((?:(?:window|document|top|self|parent)\.)?location(?:\.href)?\s*=\s*|location\.(?:replace|assign)\(\s*)(["'])((?:https?:)?//[^"']+)(["'])`)
+)
+
+// RewriteRefreshURLs rewrites client-side redirects in HTML (meta refresh tags and
+// JavaScript location assignments) so they stay on the proxy.
+func RewriteRefreshURLs(ctx *models.ProcessingContext, body string) string {
+	defer trace.StartRegion(ctx.ReqContext, "RewriteRefreshURLs").End()
+	if !refreshApplies(ctx) {
+		return body
+	}
+	metaRefresh, jsLocation := refreshRewriters(ctx)
+	body = reMetaRefresh.ReplaceAllStringFunc(body, metaRefresh)
+	body = reJSLocation.ReplaceAllStringFunc(body, jsLocation)
+	return body
+}
+
+// RewriteRefreshURLsStream is the streaming form of RewriteRefreshURLs.
+func RewriteRefreshURLsStream(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+	if !refreshApplies(ctx) {
+		return r
+	}
+	metaRefresh, jsLocation := refreshRewriters(ctx)
+	r = streamReplaceFunc(r, reMetaRefresh, metaRefresh)
+	return streamReplaceFunc(r, reJSLocation, jsLocation)
+}
+
+func refreshApplies(ctx *models.ProcessingContext) bool {
+	return strings.Contains(ctx.RespHeader.Get("Content-Type"), "text/html") ||
+		strings.Contains(ctx.ReqURL.Path, ".jsp")
+}
+
+// refreshRewriters returns the replacement functions for meta refresh tags and JavaScript
+// location assignments.
+func refreshRewriters(ctx *models.ProcessingContext) (metaRefresh, jsLocation func(string) string) {
+	rewrite := func(raw string) string {
+		newURL, ok := RewriteUpstreamURL(ctx.ReqContext, ctx.Services, raw)
+		if ok {
+			log.Printf("Rewriting client-side redirect: %s -> %s", raw, newURL)
+		}
+		return newURL
+	}
+
+	metaRefresh = func(tag string) string {
+		m := reMetaRefreshURL.FindStringSubmatchIndex(tag)
+		if m == nil {
+			return tag
+		}
+		return tag[:m[4]] + rewrite(tag[m[4]:m[5]]) + tag[m[5]:]
+	}
+	jsLocation = func(stmt string) string {
+		m := reJSLocation.FindStringSubmatch(stmt)
+		return m[1] + m[2] + rewrite(m[3]) + m[4]
+	}
+	return metaRefresh, jsLocation
+}
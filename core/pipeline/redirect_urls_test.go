@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestRewriteRefreshURLs(t *testing.T) {
+	proxies := map[string]*models.SharedProxy{
+		"http://10.0.0.5":        {OriginalURL: "http://10.0.0.5", RemotePort: 10081},
+		"https://his.local:8443": {OriginalURL: "https://his.local:8443", RemotePort: 10082},
+	}
+	services := models.PipelineServices{
+		MyIP: "192.168.1.100",
+		CreateProxy: func(u string, port int) (*models.SharedProxy, error) {
+			return proxies[u], nil
+		},
+	}
+
+	reqCtx := context.WithValue(context.Background(), models.OriginalHostKey, "192.168.1.100:10081")
+	reqCtx = context.WithValue(reqCtx, models.OriginalSchemeKey, "https")
+	reqURL, _ := url.Parse("http://10.0.0.5/index.html")
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		ReqContext: reqCtx,
+		RespHeader: header,
+		Services:   services,
+	}
+
+	input := `<meta http-equiv="refresh" content="0; url=http://10.0.0.5/login?x=1">
+<script>window.location.href = "https://his.local:8443/app/main";
+location.replace('/relative/path');</script>`
+
+	output := RewriteRefreshURLs(ctx, input)
+
+	for _, expected := range []string{
+		`content="0; url=https://192.168.1.100:10081/login?x=1"`,
+		`window.location.href = "https://192.168.1.100:10082/app/main"`,
+		`location.replace('/relative/path')`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain %q\nGot:\n%s", expected, output)
+		}
+	}
+}
+
+func TestRewriteUpstreamURLInternalOnly(t *testing.T) {
+	defer func(orig func(context.Context, string) ([]netip.Addr, error)) { lookupHost = orig }(lookupHost)
+	lookupHost = func(_ context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "his.hospital.org":
+			return []netip.Addr{netip.MustParseAddr("10.1.2.3")}, nil
+		case "shared.example.com":
+			return []netip.Addr{netip.MustParseAddr("203.0.113.9")}, nil
+		case "node.lan":
+			return []netip.Addr{netip.MustParseAddr("10.8.0.2")}, nil
+		}
+		return []netip.Addr{netip.MustParseAddr("93.184.216.34")}, nil
+	}
+
+	var created []string
+	services := models.PipelineServices{
+		MyIP: "192.168.1.100",
+		CreateProxy: func(u string, _ int) (*models.SharedProxy, error) {
+			created = append(created, u)
+			return &models.SharedProxy{OriginalURL: u, RemotePort: 10100}, nil
+		},
+		GetProxies: func() []*models.SharedProxy {
+			return []*models.SharedProxy{{OriginalURL: "https://shared.example.com/app/", RemotePort: 10101}}
+		},
+		LocalIPs: func() []string { return []string{"192.168.1.100", "10.8.0.2", "fd00::1"} },
+	}
+	reqCtx := context.WithValue(context.Background(), models.OriginalHostKey, "192.168.1.100:10081")
+
+	for raw, want := range map[string]bool{
+		"http://172.16.0.9/a":              true,
+		"http://his/a":                     true,
+		"http://his.hospital.org/a":        true,
+		"https://shared.example.com/b":     true,
+		"http://93.184.216.34/a":           false,
+		"https://evil.example.net/a":       false,
+		"http://[2001:db8::1]/a":           false,
+		"http://192.168.1.100:10081/login": false,
+		// Consumer URLs of the node on its other addresses and names
+		"http://10.8.0.2:10081/login":  false,
+		"http://[fd00::1]/login":       false,
+		"http://node.lan:10081/login":  false,
+		"http://[::1]:10101/app/":      false,
+		"http://localhost:10101/app/":  false,
+		"http://172.16.0.9:10101/app/": false,
+	} {
+		created = nil
+		if _, ok := RewriteUpstreamURL(reqCtx, services, raw); ok != want || (len(created) > 0) != want {
+			t.Errorf("%s: expected rewritten=%v, got %v (created %v)", raw, want, ok, created)
+		}
+	}
+}
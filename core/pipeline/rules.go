@@ -0,0 +1,364 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/trace"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+const rulesFile = "rules.json"
+
+// rulesPollInterval is how often rules.json is checked for edits.
+const rulesPollInterval = 2 * time.Second
+
+// Rule action types.
+const (
+	ActionReplace      = "replace"       // Replace every occurrence of Find with Value
+	ActionRegexReplace = "regex_replace" // Replace matches of the regexp Find with Value ($1 expands)
+	ActionInsertBefore = "insert_before" // Insert Value before the first occurrence of Find
+	ActionInsertAfter  = "insert_after"  // Insert Value after the first occurrence of Find
+	ActionInjectScript = "inject_script" // Add a <script> with Value before </head>, or </body>
+	ActionInjectStyle  = "inject_style"  // Add a <style> with Value before </head>, or </body>
+	ActionDrop         = "drop"          // Answer 204 No Content instead of the response
+)
+
+// Rule is a content fix loaded at runtime instead of compiled in. A response is rewritten by
+// a rule if it matches all of the rule's non-empty conditions.
+type Rule struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// URLPattern is a regular expression matched against the request path and query.
+	URLPattern string `json:"url_pattern,omitempty"`
+	// ContentTypes are media type prefixes, e.g. "text/html" or "application/javascript".
+	// Rules only see responses that go through the pipeline: assets served from the static
+	// cache (images, fonts and the jquery, bootstrap and moment scripts, see
+	// cache.IsCacheable) are never rewritten, whatever their content type.
+	ContentTypes []string `json:"content_types,omitempty"`
+	// Systems limits the rule to proxies where one of these systems was detected.
+	Systems []string     `json:"systems,omitempty"`
+	Status  []int        `json:"status,omitempty"`
+	Actions []RuleAction `json:"actions"`
+}
+
+// RuleAction is one edit of a matched response; see the Action constants.
+type RuleAction struct {
+	Type  string `json:"type"`
+	Find  string `json:"find,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// RuleSet is the content of rules.json and of rules pushed by the discovery server.
+type RuleSet struct {
+	Rules []Rule `json:"rules"`
+}
+
+type compiledRule struct {
+	Rule
+	url     *regexp.Regexp
+	actions []compiledAction
+}
+
+type compiledAction struct {
+	RuleAction
+	re *regexp.Regexp
+}
+
+var (
+	activeRules   atomic.Pointer[[]compiledRule]
+	rulesFileLock sync.Mutex
+	rulesModTime  time.Time
+)
+
+func compileRules(rules []Rule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		c := compiledRule{Rule: rule}
+		if rule.URLPattern != "" {
+			re, err := regexp.Compile(rule.URLPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: url pattern: %w", name, err)
+			}
+			c.url = re
+		}
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("rule %s has no actions", name)
+		}
+		for _, action := range rule.Actions {
+			a := compiledAction{RuleAction: action}
+			switch action.Type {
+			case ActionReplace, ActionInsertBefore, ActionInsertAfter:
+				if action.Find == "" {
+					return nil, fmt.Errorf("rule %s: %s needs find", name, action.Type)
+				}
+			case ActionRegexReplace:
+				re, err := regexp.Compile(action.Find)
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %w", name, err)
+				}
+				a.re = re
+			case ActionInjectScript, ActionInjectStyle, ActionDrop:
+			default:
+				return nil, fmt.Errorf("rule %s: unknown action %q", name, action.Type)
+			}
+			c.actions = append(c.actions, a)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// ValidateRules reports the first invalid pattern or action in rules.
+func ValidateRules(rules []Rule) error {
+	_, err := compileRules(rules)
+	return err
+}
+
+// GetRules returns the active rules.
+func GetRules() []Rule {
+	var rules []Rule
+	if compiled := activeRules.Load(); compiled != nil {
+		for _, c := range *compiled {
+			rules = append(rules, c.Rule)
+		}
+	}
+	return rules
+}
+
+// SetRules validates and activates rules, and saves them to rules.json.
+func SetRules(rules []Rule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		rules = []Rule{}
+	}
+	data, err := json.MarshalIndent(RuleSet{Rules: rules}, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := config.FilePath(rulesFile)
+	if err != nil {
+		return err
+	}
+
+	rulesFileLock.Lock()
+	defer rulesFileLock.Unlock()
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return err
+	}
+	if info, err := os.Stat(file); err == nil {
+		rulesModTime = info.ModTime()
+	}
+	activeRules.Store(&compiled)
+	log.Printf("Activated %d content rules", len(compiled))
+	return nil
+}
+
+// LoadRules (re)loads rules.json. Invalid files are logged and leave the active rules as they
+// are, so a typo in an edit doesn't drop every rule.
+func LoadRules() {
+	file, err := config.FilePath(rulesFile)
+	if err != nil {
+		log.Printf("Failed to get rules path: %v", err)
+		return
+	}
+
+	rulesFileLock.Lock()
+	defer rulesFileLock.Unlock()
+	info, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to stat rules: %v", err)
+		} else if activeRules.Load() != nil {
+			activeRules.Store(nil)
+			rulesModTime = time.Time{}
+			log.Printf("Content rules removed")
+		}
+		return
+	}
+	if info.ModTime().Equal(rulesModTime) {
+		return
+	}
+	rulesModTime = info.ModTime()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Printf("Failed to read rules: %v", err)
+		return
+	}
+	var set RuleSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		log.Printf("Failed to parse %s, keeping the active rules: %v", file, err)
+		return
+	}
+	compiled, err := compileRules(set.Rules)
+	if err != nil {
+		log.Printf("Invalid rules in %s, keeping the active rules: %v", file, err)
+		return
+	}
+	activeRules.Store(&compiled)
+	log.Printf("Loaded %d content rules from %s", len(compiled), file)
+}
+
+// WatchRules reloads rules.json whenever it changes.
+func WatchRules() {
+	LoadRules()
+	ticker := time.NewTicker(rulesPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		LoadRules()
+	}
+}
+
+// ApplyRules runs the active rules over a response body. A drop action sets ctx.Drop.
+func ApplyRules(ctx *models.ProcessingContext, body string) string {
+	defer trace.StartRegion(ctx.ReqContext, "ApplyRules").End()
+	compiled := activeRules.Load()
+	if compiled == nil {
+		return body
+	}
+	body, _ = applyRules(*compiled, ctx, body)
+	return body
+}
+
+func applyRules(rules []compiledRule, ctx *models.ProcessingContext, body string) (string, []string) {
+	var matched []string
+	for _, rule := range rules {
+		if rule.Disabled || !rule.matches(ctx) {
+			continue
+		}
+		matched = append(matched, rule.Name)
+		for _, action := range rule.actions {
+			if body = action.apply(body); action.Type == ActionDrop {
+				ctx.Drop = true
+				return "", matched
+			}
+		}
+	}
+	return body, matched
+}
+
+func (r *compiledRule) matches(ctx *models.ProcessingContext) bool {
+	if r.url != nil && (ctx.ReqURL == nil || !r.url.MatchString(ctx.ReqURL.RequestURI())) {
+		return false
+	}
+	if len(r.Status) > 0 && !slices.Contains(r.Status, ctx.Status) {
+		return false
+	}
+	if len(r.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(ctx.RespHeader.Get("Content-Type"))
+		if !slices.ContainsFunc(r.ContentTypes, func(prefix string) bool {
+			return prefix != "" && strings.HasPrefix(mediaType, strings.ToLower(prefix))
+		}) {
+			return false
+		}
+	}
+	if len(r.Systems) > 0 {
+		var active []string
+		if ctx.Proxy != nil {
+			ctx.Proxy.Mu.RLock()
+			active = ctx.Proxy.ActiveSystems
+			ctx.Proxy.Mu.RUnlock()
+		}
+		if !slices.ContainsFunc(r.Systems, func(id string) bool { return slices.Contains(active, id) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *compiledAction) apply(body string) string {
+	switch a.Type {
+	case ActionReplace:
+		return strings.ReplaceAll(body, a.Find, a.Value)
+	case ActionRegexReplace:
+		return a.re.ReplaceAllString(body, a.Value)
+	case ActionInsertBefore:
+		if i := strings.Index(body, a.Find); i >= 0 {
+			return body[:i] + a.Value + body[i:]
+		}
+	case ActionInsertAfter:
+		if i := strings.Index(body, a.Find); i >= 0 {
+			i += len(a.Find)
+			return body[:i] + a.Value + body[i:]
+		}
+	case ActionInjectScript:
+		return injectIntoHead(body, "<script>"+a.Value+"</script>")
+	case ActionInjectStyle:
+		return injectIntoHead(body, "<style>"+a.Value+"</style>")
+	}
+	return body
+}
+
+// injectIntoHead inserts html before </head>, or before </body> if there is no head, or at
+// the end of the document.
+func injectIntoHead(body, html string) string {
+	lower := strings.ToLower(body)
+	for _, marker := range []string{"</head>", "</body>"} {
+		if i := strings.Index(lower, marker); i >= 0 {
+			return body[:i] + html + body[i:]
+		}
+	}
+	return body + html
+}
+
+// RuleSample describes a response to test rules against.
+type RuleSample struct {
+	URL         string
+	ContentType string
+	Status      int
+	Systems     []string
+	Body        string
+}
+
+// RuleTestResult is the outcome of running rules over a sample.
+type RuleTestResult struct {
+	Body    string   `json:"body"`
+	Matched []string `json:"matched"` // Names of the rules that matched, in order
+	Dropped bool     `json:"dropped"`
+}
+
+// TestRules runs rules over a sample response without activating them.
+func TestRules(rules []Rule, sample RuleSample) (RuleTestResult, error) {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return RuleTestResult{}, err
+	}
+	reqURL, err := url.Parse(sample.URL)
+	if err != nil {
+		return RuleTestResult{}, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", sample.ContentType)
+	status := sample.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ctx := &models.ProcessingContext{
+		ReqURL:     reqURL,
+		RespHeader: header,
+		Status:     status,
+		Proxy:      &models.SharedProxy{ActiveSystems: sample.Systems},
+	}
+	body, matched := applyRules(compiled, ctx, sample.Body)
+	return RuleTestResult{Body: body, Matched: matched, Dropped: ctx.Drop}, nil
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestRuleActions(t *testing.T) {
+	rules := []Rule{
+		{
+			Name:         "phis-fixes",
+			URLPattern:   `^/phis/.*\.jsp`,
+			ContentTypes: []string{"text/html"},
+			Systems:      []string{"PHIS"},
+			Actions: []RuleAction{
+				{Type: ActionReplace, Find: "showModalDialog", Value: "open"},
+				{Type: ActionRegexReplace, Find: `width=(\d+)`, Value: "w=$1"},
+				{Type: ActionInsertBefore, Find: "<p>", Value: "<hr>"},
+				{Type: ActionInsertAfter, Find: "</p>", Value: "<br>"},
+				{Type: ActionInjectScript, Value: "fix()"},
+				{Type: ActionInjectStyle, Value: "p{color:red}"},
+			},
+		},
+	}
+	sample := RuleSample{
+		URL:         "/phis/app/view.jsp?id=1",
+		ContentType: "text/html; charset=GBK",
+		Systems:     []string{"PHIS"},
+		Body:        `<html><HEAD></HEAD><body><p>showModalDialog(width=10)</p></body></html>`,
+	}
+
+	result, err := TestRules(rules, sample)
+	if err != nil {
+		t.Fatalf("TestRules failed: %v", err)
+	}
+	want := `<html><HEAD><script>fix()</script><style>p{color:red}</style></HEAD><body><hr><p>open(w=10)</p><br></body></html>`
+	if result.Body != want || len(result.Matched) != 1 {
+		t.Errorf("Unexpected result:\n got %s (%v)\nwant %s", result.Body, result.Matched, want)
+	}
+
+	rules[0].Status = []int{http.StatusOK}
+	for name, s := range map[string]RuleSample{
+		"url":          {URL: "/other.jsp", ContentType: sample.ContentType, Systems: sample.Systems, Body: sample.Body},
+		"content type": {URL: sample.URL, ContentType: "application/json", Systems: sample.Systems, Body: sample.Body},
+		"system":       {URL: sample.URL, ContentType: sample.ContentType, Systems: []string{"HIS"}, Body: sample.Body},
+		"status":       {URL: sample.URL, ContentType: sample.ContentType, Systems: sample.Systems, Status: http.StatusNotFound, Body: sample.Body},
+	} {
+		result, err := TestRules(rules, s)
+		if err != nil || result.Body != sample.Body || len(result.Matched) != 0 {
+			t.Errorf("Expected a different %s not to match, got %v", name, result.Matched)
+		}
+	}
+}
+
+func TestRuleDrop(t *testing.T) {
+	rules := []Rule{{Name: "no-tracker", URLPattern: `/tracker\.js$`, Actions: []RuleAction{{Type: ActionDrop}}}}
+	result, err := TestRules(rules, RuleSample{URL: "/static/tracker.js", ContentType: "application/javascript", Body: "track()"})
+	if err != nil || !result.Dropped || result.Body != "" {
+		t.Errorf("Expected the response to be dropped, got %+v, %v", result, err)
+	}
+}
+
+func TestInvalidRulesRejected(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{Name: "bad-url", URLPattern: "(", Actions: []RuleAction{{Type: ActionDrop}}}},
+		{{Name: "bad-regex", Actions: []RuleAction{{Type: ActionRegexReplace, Find: "("}}}},
+		{{Name: "no-find", Actions: []RuleAction{{Type: ActionReplace}}}},
+		{{Name: "unknown", Actions: []RuleAction{{Type: "rewrite"}}}},
+		{{Name: "no-actions"}},
+	} {
+		if err := ValidateRules(rules); err == nil {
+			t.Errorf("Expected rule %s to be rejected", rules[0].Name)
+		}
+	}
+}
+
+func TestRulesHotReload(t *testing.T) {
+	dir := t.TempDir()
+	debug.DebugStoragePath = dir
+	defer func() { debug.DebugStoragePath = "" }()
+	defer activeRules.Store(nil)
+
+	if err := SetRules([]Rule{{Name: "first", Actions: []RuleAction{{Type: ActionReplace, Find: "a", Value: "b"}}}}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	if rules := GetRules(); len(rules) != 1 || rules[0].Name != "first" {
+		t.Fatalf("Expected the set rules to be active, got %+v", rules)
+	}
+
+	file := filepath.Join(dir, rulesFile)
+	edit := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to edit rules: %v", err)
+		}
+		// Make sure the edit is seen even on filesystems with coarse timestamps
+		later := time.Now().Add(time.Duration(len(content)) * time.Second)
+		os.Chtimes(file, later, later)
+		LoadRules()
+	}
+
+	edit(`{"rules": [{"name": "second", "actions": [{"type": "drop"}]}]}`)
+	if rules := GetRules(); len(rules) != 1 || rules[0].Name != "second" {
+		t.Errorf("Expected the edited file to be reloaded, got %+v", rules)
+	}
+
+	edit(`{"rules": [{"name": "broken", "url_pattern": "(", "actions": [{"type": "drop"}]}]}`)
+	if rules := GetRules(); len(rules) != 1 || rules[0].Name != "second" {
+		t.Errorf("Expected an invalid edit to keep the active rules, got %+v", rules)
+	}
+}
+
+func TestApplyRulesStreamOnlyBuffersMatchingResponses(t *testing.T) {
+	compiled, err := compileRules([]Rule{{Name: "js-only", ContentTypes: []string{"application/javascript"}, Actions: []RuleAction{{Type: ActionReplace, Find: "a", Value: "b"}}}})
+	if err != nil {
+		t.Fatalf("compileRules failed: %v", err)
+	}
+	activeRules.Store(&compiled)
+	defer activeRules.Store(nil)
+
+	for contentType, want := range map[string]string{"text/html": "aaa", "application/javascript": "bbb"} {
+		header := http.Header{}
+		header.Set("Content-Type", contentType)
+		reqURL, _ := url.Parse("http://10.0.0.5/app")
+		ctx := &models.ProcessingContext{ReqURL: reqURL, ReqContext: context.Background(), RespHeader: header, Status: http.StatusOK}
+		src := strings.NewReader("aaa")
+		r := ApplyRulesStream(ctx, src)
+		if contentType == "text/html" && r != io.Reader(src) {
+			t.Errorf("Expected a response no rule matches to be passed through as is")
+		}
+		if body, _ := io.ReadAll(r); string(body) != want {
+			t.Errorf("Expected %q for %s, got %q", want, contentType, body)
+		}
+	}
+}
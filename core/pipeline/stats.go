@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"cmp"
+	"hash/maphash"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// statsSamples is how many recent durations of each processor its p95 is computed from.
+const statsSamples = 512
+
+// ProcessorStats summarizes the runs of one processor on one proxy.
+type ProcessorStats struct {
+	Proxy           string  `json:"proxy"`
+	System          string  `json:"system,omitempty"`
+	Processor       string  `json:"processor"`
+	Invocations     int64   `json:"invocations"`
+	Modified        int64   `json:"modified"` // Bodies the processor changed
+	BytesAdded      int64   `json:"bytes_added"`
+	BytesRemoved    int64   `json:"bytes_removed"`
+	TotalDurationMs float64 `json:"total_duration_ms"`
+	P95DurationMs   float64 `json:"p95_duration_ms"` // Over the most recent invocations
+
+	totalDuration time.Duration
+	samples       []time.Duration // Ring of the most recent durations
+	next          int
+}
+
+type statsKey struct {
+	proxy string
+	id    string
+}
+
+var (
+	stats     = map[statsKey]*ProcessorStats{}
+	statsLock sync.Mutex
+)
+
+// recordRun adds a processor run over a body of inLen bytes giving outLen bytes to its stats,
+// and to the processors that modified the response.
+func recordRun(ctx *models.ProcessingContext, step models.ProcessorStep, d time.Duration, inLen, outLen int64, modified bool) {
+	if modified {
+		ctx.ModifiedBy = append(ctx.ModifiedBy, step.ID)
+	}
+
+	key := statsKey{ctx.Proxy.OriginalURL, step.ID}
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	s, ok := stats[key]
+	if !ok {
+		s = &ProcessorStats{Proxy: key.proxy, System: step.System, Processor: step.Name}
+		stats[key] = s
+	}
+	s.Invocations++
+	s.totalDuration += d
+	if len(s.samples) < statsSamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+		s.next = (s.next + 1) % statsSamples
+	}
+	if modified {
+		s.Modified++
+		if outLen > inLen {
+			s.BytesAdded += outLen - inLen
+		} else {
+			s.BytesRemoved += inLen - outLen
+		}
+	}
+}
+
+// Stats returns the stats of every processor that ran, by proxy, system and processor.
+func Stats() []ProcessorStats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	result := make([]ProcessorStats, 0, len(stats))
+	for _, s := range stats {
+		snapshot := *s
+		snapshot.samples = nil
+		snapshot.TotalDurationMs = durationMs(s.totalDuration)
+		if len(s.samples) > 0 {
+			sorted := slices.Sorted(slices.Values(s.samples))
+			snapshot.P95DurationMs = durationMs(sorted[(len(sorted)*95+99)/100-1])
+		}
+		result = append(result, snapshot)
+	}
+	slices.SortFunc(result, func(a, b ProcessorStats) int {
+		return cmp.Or(cmp.Compare(a.Proxy, b.Proxy), cmp.Compare(a.System, b.System), cmp.Compare(a.Processor, b.Processor))
+	})
+	return result
+}
+
+// ResetStats clears the processor stats.
+func ResetStats() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	clear(stats)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// meteredReader counts and hashes what is read through it and the time spent reading. In a
+// chain of stream processors, a processor's own time is the time spent reading its output less
+// the time its input took to produce.
+type meteredReader struct {
+	r       io.Reader
+	n       int64
+	hash    maphash.Hash
+	elapsed time.Duration
+}
+
+func newMeteredReader(r io.Reader, seed maphash.Seed) *meteredReader {
+	m := &meteredReader{r: r}
+	m.hash.SetSeed(seed)
+	return m
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := m.r.Read(p)
+	m.elapsed += time.Since(start)
+	m.n += int64(n)
+	m.hash.Write(p[:n])
+	return n, err
+}
+
+// recordStreamRun records the run of a stream processor that read in and produced out.
+func recordStreamRun(ctx *models.ProcessingContext, step models.ProcessorStep, in, out *meteredReader) {
+	modified := in.n != out.n || in.hash.Sum64() != out.hash.Sum64()
+	recordRun(ctx, step, out.elapsed-in.elapsed, in.n, out.n, modified)
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProcessorStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	newCtx := newStreamContext(t, upstream.URL)
+	ResetStats()
+	defer ResetStats()
+
+	page := legacyPage(upstream.URL, 3*streamChunkSize)
+	stringCtx := newCtx()
+	RunPipeline(stringCtx, page)
+	streamCtx := newCtx()
+	if err := RunStreamPipeline(streamCtx, strings.NewReader(page), io.Discard); err != nil {
+		t.Fatalf("RunStreamPipeline failed: %v", err)
+	}
+
+	if !slices.Contains(stringCtx.ModifiedBy, "PHIS:fix_legacy_js") || slices.Contains(stringCtx.ModifiedBy, ProcApplyRules) {
+		t.Errorf("Unexpected processors modifying the page: %v", stringCtx.ModifiedBy)
+	}
+	if !slices.Equal(streamCtx.ModifiedBy, stringCtx.ModifiedBy) {
+		t.Errorf("Expected the stream pipeline to report the same changes, got %v, want %v", streamCtx.ModifiedBy, stringCtx.ModifiedBy)
+	}
+
+	stats := Stats()
+	if len(stats) != len(stringCtx.Processors) {
+		t.Fatalf("Expected stats for each of %v, got %+v", stringCtx.Processors, stats)
+	}
+	for _, s := range stats {
+		if s.Proxy != "http://192.168.1.9" || s.Invocations != 2 || s.P95DurationMs > s.TotalDurationMs {
+			t.Errorf("Unexpected stats %+v", s)
+		}
+		switch s.Processor {
+		case ProcApplyRules:
+			if s.Modified != 0 || s.BytesAdded != 0 || s.BytesRemoved != 0 {
+				t.Errorf("Expected no changes by the rules without any, got %+v", s)
+			}
+		case ProcInjectDebugScript:
+			if s.Modified != 2 || s.BytesAdded == 0 || s.BytesRemoved != 0 {
+				t.Errorf("Expected the debug script to be added twice, got %+v", s)
+			}
+		case "fix_legacy_js":
+			if s.System != "PHIS" || s.Modified != 2 {
+				t.Errorf("Expected the legacy JS fix of PHIS to change both pages, got %+v", s)
+			}
+		}
+	}
+}
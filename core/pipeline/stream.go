@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// StreamProcessor is the streaming form of ContentProcessor. It wraps r in a reader yielding
+// the processed body, holding back no more than a bounded lookahead instead of the whole body.
+// Stream processors chain by wrapping each other's readers, so a pipeline runs in the caller's
+// goroutine and processors may update ctx like string processors do.
+type StreamProcessor func(ctx *models.ProcessingContext, r io.Reader) io.Reader
+
+const (
+	streamChunkSize = 32 << 10
+	// DefaultLookahead bounds how far a match may reach past the text that is already settled.
+	DefaultLookahead = 4 << 10
+)
+
+// StreamContent adapts a ContentProcessor to a StreamProcessor. The adapted processor needs
+// the whole body, so it is read into memory first.
+func StreamContent(p ContentProcessor) StreamProcessor {
+	return func(ctx *models.ProcessingContext, r io.Reader) io.Reader {
+		return &bufferedReader{src: r, process: func(body string) string { return p(ctx, body) }}
+	}
+}
+
+// ProcessString runs a StreamProcessor over a string body.
+func ProcessString(ctx *models.ProcessingContext, p StreamProcessor, body string) string {
+	var out strings.Builder
+	if _, err := io.Copy(&out, p(ctx, strings.NewReader(body))); err != nil {
+		// Only a failing source can fail, and strings.Reader doesn't
+		return body
+	}
+	return out.String()
+}
+
+// bufferedReader reads its whole source and yields it after process.
+type bufferedReader struct {
+	src     io.Reader
+	process func(string) string
+	out     *strings.Reader
+}
+
+func (b *bufferedReader) Read(p []byte) (int, error) {
+	if b.out == nil {
+		body, err := io.ReadAll(b.src)
+		if err != nil {
+			return 0, err
+		}
+		b.out = strings.NewReader(b.process(string(body)))
+	}
+	return b.out.Read(p)
+}
+
+// editFunc edits the buffered window of a stream. It appends the edited text for the settled
+// part of the window to dst and reports how much of the window that was; the rest is presented
+// again with more input. At EOF the whole window must be consumed.
+type editFunc func(dst, window []byte, atEOF bool) (out []byte, consumed int)
+
+// windowReader runs an editFunc over its source a window at a time. A window holds at most
+// streamChunkSize bytes plus the lookahead held back from the previous edit.
+type windowReader struct {
+	src       io.Reader
+	edit      editFunc
+	lookahead int
+	buf       []byte // Input not yet edited
+	out       []byte // Edited output not yet read, in outBuf
+	outBuf    []byte
+	eof       bool
+}
+
+func newWindowReader(src io.Reader, lookahead int, edit editFunc) *windowReader {
+	return &windowReader{src: src, edit: edit, lookahead: lookahead, buf: make([]byte, 0, streamChunkSize+lookahead)}
+}
+
+func (w *windowReader) Read(p []byte) (int, error) {
+	for len(w.out) == 0 {
+		if w.eof && len(w.buf) == 0 {
+			return 0, io.EOF
+		}
+		if !w.eof {
+			n, err := w.src.Read(w.buf[len(w.buf):cap(w.buf)])
+			w.buf = w.buf[:len(w.buf)+n]
+			if err == io.EOF {
+				w.eof = true
+			} else if err != nil {
+				return 0, err
+			}
+			if !w.eof && len(w.buf) < cap(w.buf) {
+				continue
+			}
+		}
+		out, consumed := w.edit(w.outBuf[:0], w.buf, w.eof)
+		w.outBuf, w.out = out, out
+		w.buf = append(w.buf[:0], w.buf[consumed:]...)
+		if len(w.buf) == cap(w.buf) {
+			// The edit held back its whole window; read on into a larger one
+			w.buf = slices.Grow(w.buf, streamChunkSize)
+		}
+	}
+	n := copy(p, w.out)
+	w.out = w.out[n:]
+	return n, nil
+}
+
+// settled returns how much of a window can be edited without more input.
+func settled(window []byte, atEOF bool, lookahead int) int {
+	if atEOF {
+		return len(window)
+	}
+	return max(len(window)-lookahead, 0)
+}
+
+// replaceEdit replaces the matches of re that start in the settled part of each window with
+// repl's result. Matches must be shorter than the lookahead to be found across windows. Only
+// m[0] and m[1] are set; see replaceSubmatchEdit.
+func replaceEdit(re *regexp.Regexp, lookahead int, repl func(dst, window []byte, m []int) []byte) editFunc {
+	return matchEdit(re.FindAllIndex, lookahead, repl)
+}
+
+// replaceSubmatchEdit is replaceEdit for a repl that needs the submatches. Finding them is
+// markedly slower, so replaceEdit does without.
+func replaceSubmatchEdit(re *regexp.Regexp, lookahead int, repl func(dst, window []byte, m []int) []byte) editFunc {
+	return matchEdit(re.FindAllSubmatchIndex, lookahead, repl)
+}
+
+func matchEdit(findAll func(b []byte, n int) [][]int, lookahead int, repl func(dst, window []byte, m []int) []byte) editFunc {
+	return func(dst, window []byte, atEOF bool) ([]byte, int) {
+		limit := settled(window, atEOF, lookahead)
+		last := 0
+		for _, m := range findAll(window, -1) {
+			if m[0] >= limit {
+				break
+			}
+			dst = append(dst, window[last:m[0]]...)
+			dst = repl(dst, window, m)
+			last = m[1]
+		}
+		if last < limit {
+			dst = append(dst, window[last:limit]...)
+			last = limit
+		}
+		return dst, last
+	}
+}
+
+// streamRegexReplace is the streaming form of re.ReplaceAllString(body, template).
+func streamRegexReplace(r io.Reader, re *regexp.Regexp, template string) io.Reader {
+	tmpl := []byte(template)
+	return newWindowReader(r, DefaultLookahead, replaceSubmatchEdit(re, DefaultLookahead, func(dst, window []byte, m []int) []byte {
+		return re.Expand(dst, tmpl, window, m)
+	}))
+}
+
+// streamReplaceFunc is the streaming form of re.ReplaceAllStringFunc(body, repl).
+func streamReplaceFunc(r io.Reader, re *regexp.Regexp, repl func(string) string) io.Reader {
+	return newWindowReader(r, DefaultLookahead, replaceEdit(re, DefaultLookahead, func(dst, window []byte, m []int) []byte {
+		return append(dst, repl(string(window[m[0]:m[1]]))...)
+	}))
+}
+
+// streamInsertBefore is the streaming form of strings.Replace(body, marker, html+marker, 1).
+// The marker must be shorter than the lookahead.
+func streamInsertBefore(r io.Reader, marker, html string) io.Reader {
+	done := false
+	return newWindowReader(r, DefaultLookahead, func(dst, window []byte, atEOF bool) ([]byte, int) {
+		limit := settled(window, atEOF, DefaultLookahead)
+		if !done {
+			if i := bytes.Index(window, []byte(marker)); i >= 0 && i < limit {
+				done = true
+				dst = append(dst, window[:i]...)
+				dst = append(dst, html...)
+				return append(dst, window[i:limit]...), limit
+			}
+		}
+		return append(dst, window[:limit]...), limit
+	})
+}
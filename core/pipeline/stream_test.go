@@ -0,0 +1,226 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// legacyPage returns a showView.jsp page of about size bytes that every built-in processor
+// has something to do in, linking to upstream.
+func legacyPage(upstream string, size int) string {
+	var b strings.Builder
+	b.WriteString(`<html><head><title>EHR</title><script>var cfg = {phisUrl: 'http://phis.example/phis/'};</script></head><body>`)
+	b.WriteString(`<img src="/phis/app/login/voCode" id="img">`)
+	section := `<div class="row"><a href="` + upstream + `/app/view.jsp?id=1&amp;t=2">Open</a>` +
+		`<img src="//` + strings.TrimPrefix(upstream, "http://") + `/logo.png" style="background:url('` + upstream + `/bg.png')">` +
+		`<script>function _stopIt(e){ if(e.keyCode==8) return false; } if (window.showModalDialog == undefined) { go("` + upstream + `/x"); }` +
+		` Ehr.openChrome = function(url) { window.open(url, "", "width=800"); }; var p = 'http://phis.example/phis/a';</script>` +
+		`<p>Plain text mentioning ` + upstream + ` stays.</p><meta http-equiv="refresh" content="5; url=` + upstream + `/r"></div>` + "\n"
+	for b.Len() < size {
+		b.WriteString(section)
+	}
+	b.WriteString(`</body></html>`)
+	return b.String()
+}
+
+func newStreamContext(t testing.TB, upstream string) func() *models.ProcessingContext {
+	return func() *models.ProcessingContext {
+		header := http.Header{}
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		reqURL, _ := url.Parse("http://192.168.1.9/phis/app/showView.jsp")
+		p := &models.SharedProxy{OriginalURL: "http://192.168.1.9", RemotePort: 10081, ActiveSystems: []string{"PHIS"}}
+		p.Settings.EnableUrlRewrite = true
+		p.Settings.EnableContentMod = true
+		p.Settings.EnableDebugScript = true
+		return &models.ProcessingContext{
+			ReqURL:     reqURL,
+			ReqContext: context.WithValue(context.Background(), models.OriginalHostKey, "192.168.1.2:10081"),
+			RespHeader: header,
+			Status:     http.StatusOK,
+			Proxy:      p,
+			Services: models.PipelineServices{
+				MyIP:    "192.168.1.2",
+				APIPort: 10080,
+				CreateProxy: func(u string, _ int) (*models.SharedProxy, error) {
+					switch u {
+					case upstream:
+						return &models.SharedProxy{OriginalURL: u, RemotePort: 10100}, nil
+					case "http://phis.example/phis/":
+						return &models.SharedProxy{OriginalURL: u, RemotePort: 10101, Path: "/phis/"}, nil
+					}
+					t.Errorf("Unexpected proxy for %s", u)
+					return nil, fmt.Errorf("unexpected proxy")
+				},
+			},
+		}
+	}
+}
+
+func TestStreamPipelineMatchesString(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	newCtx := newStreamContext(t, upstream.URL)
+
+	for _, size := range []int{1 << 10, 3 * streamChunkSize} {
+		page := legacyPage(upstream.URL, size)
+		stringCtx := newCtx()
+		want := RunPipeline(stringCtx, page)
+		for _, expected := range []string{
+			`href="http://192.168.1.2:10100/app/view.jsp?id=1&amp;t=2"`, // Internal URLs
+			`url=http://192.168.1.2:10100/r`,                            // Meta refresh
+			`window.open(url, "_blank");`,                               // Legacy JS fixes
+			`'http://192.168.1.2:10101/phis/a'`,                         // Phis URL
+			`http://192.168.1.2:10080/debug`,                            // Debug script
+			`#verifyCode`,                                               // Captcha solver
+		} {
+			if !strings.Contains(want, expected) {
+				t.Fatalf("Expected the string pipeline to produce %s", expected)
+			}
+		}
+
+		for name, wrap := range map[string]func(io.Reader) io.Reader{
+			"reader":     func(r io.Reader) io.Reader { return r },
+			"one byte":   iotest.OneByteReader,
+			"half reads": iotest.HalfReader,
+		} {
+			streamCtx := newCtx()
+			var got strings.Builder
+			if err := RunStreamPipeline(streamCtx, wrap(strings.NewReader(page)), &got); err != nil {
+				t.Fatalf("RunStreamPipeline failed: %v", err)
+			}
+			if got.String() != want {
+				t.Errorf("Stream output (%d bytes, %s) differs from string output at byte %d", size, name, firstDifference(got.String(), want))
+			}
+			if l := streamCtx.RespHeader.Get("Location"); l != stringCtx.RespHeader.Get("Location") || l == "" {
+				t.Errorf("Expected the phis redirect to be set by both pipelines, got %q", l)
+			}
+		}
+	}
+}
+
+func firstDifference(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func TestStreamReplaceAcrossWindows(t *testing.T) {
+	for _, offset := range []int{-10, -3, 0, 3, DefaultLookahead - 2} {
+		prefix := strings.Repeat("x", streamChunkSize+offset)
+		body := prefix + "needle" + prefix + "needle"
+		r := streamReplaceFunc(iotest.HalfReader(strings.NewReader(body)), regexp.MustCompile("needle"), func(string) string { return "pin" })
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if want := prefix + "pin" + prefix + "pin"; string(got) != want {
+			t.Errorf("Expected matches around offset %d to be replaced", offset)
+		}
+	}
+
+	r := streamInsertBefore(strings.NewReader(strings.Repeat("y", streamChunkSize-3)+"</body></body>"), "</body>", "<s>")
+	if got, _ := io.ReadAll(r); !strings.HasSuffix(string(got), "y<s></body></body>") {
+		t.Errorf("Expected a single insertion before the first marker, got %q", got[len(got)-30:])
+	}
+}
+
+func TestPhisURLsStreamMatchesString(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	newCtx := newStreamContext(t, upstream.URL)
+
+	// The URL is mentioned before its declaration, which comes well past the first window
+	mention := `<script>var p = 'http://phis.example/phis/a';</script>` + "\n"
+	filler := strings.Repeat(mention, 3*(streamChunkSize+DefaultLookahead)/len(mention))
+	page := `<html><body>` + filler + `<script>var cfg = {phisUrl: 'http://phis.example/phis/'};</script>` + filler + `</body></html>`
+
+	stringCtx := newCtx()
+	want := RewritePhisURLs(stringCtx, page)
+	if strings.Contains(want, "http://phis.example/") {
+		t.Fatalf("Expected the string processor to replace every phis URL")
+	}
+	for name, wrap := range map[string]func(io.Reader) io.Reader{
+		"reader":     func(r io.Reader) io.Reader { return r },
+		"half reads": iotest.HalfReader,
+	} {
+		streamCtx := newCtx()
+		got, err := io.ReadAll(RewritePhisURLsStream(streamCtx, wrap(strings.NewReader(page))))
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Stream output (%s) differs from string output at byte %d", name, firstDifference(string(got), want))
+		}
+		if l := streamCtx.RespHeader.Get("Location"); l != stringCtx.RespHeader.Get("Location") {
+			t.Errorf("Expected the stream to set Location %q, got %q", stringCtx.RespHeader.Get("Location"), l)
+		}
+	}
+
+	// Without a declaration the page passes through
+	plain := strings.Repeat("x", 3*streamChunkSize)
+	got, _ := io.ReadAll(RewritePhisURLsStream(newCtx(), strings.NewReader(plain)))
+	if string(got) != plain {
+		t.Errorf("Expected a page without a phis URL to pass through")
+	}
+}
+
+func TestStreamContentAdapter(t *testing.T) {
+	ctx := &models.ProcessingContext{}
+	upper := StreamContent(func(_ *models.ProcessingContext, body string) string { return strings.ToUpper(body) })
+	if got := ProcessString(ctx, upper, "abc"); got != "ABC" {
+		t.Errorf("Expected the adapted processor to run, got %q", got)
+	}
+}
+
+// BenchmarkPipeline compares the string and streaming pipelines on large legacy pages. Run
+// with -benchmem; B/op shows the allocation spikes the streaming pipeline avoids.
+func BenchmarkPipeline(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	newCtx := newStreamContext(b, upstream.URL)
+
+	for _, size := range []struct {
+		name  string
+		bytes int
+	}{{"1MB", 1 << 20}, {"10MB", 10 << 20}} {
+		page := []byte(legacyPage(upstream.URL, size.bytes))
+
+		b.Run("string/"+size.name, func(b *testing.B) {
+			b.SetBytes(int64(len(page)))
+			b.ReportAllocs()
+			for b.Loop() {
+				out := []byte(RunPipeline(newCtx(), string(page)))
+				_ = out
+			}
+		})
+		b.Run("stream/"+size.name, func(b *testing.B) {
+			b.SetBytes(int64(len(page)))
+			b.ReportAllocs()
+			for b.Loop() {
+				var out bytes.Buffer
+				out.Grow(len(page))
+				if err := RunStreamPipeline(newCtx(), bytes.NewReader(page), &out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,45 +1,32 @@
 package pipeline
 
-type SystemDefinition struct {
-	ID         string
-	Name       string
-	ProbeURLs  []string
-	Processors []ContentProcessor
-}
+import (
+	"github.com/soda92/vpn-share-tool/core/config"
+)
 
-// We need to move ContentProcessor definition to models or keep it here and import models?
-// ContentProcessor is defined in pipeline.go. It depends on models.ProcessingContext.
-// SystemDefinition needs ContentProcessor.
+// Processors are the compiled-in content processors system definitions refer to by name.
+var Processors = map[string]ContentProcessor{
+	"fix_legacy_js":     FixLegacyJS,
+	"rewrite_phis_urls": RewritePhisURLs,
+}
 
-// Let's rely on string IDs for processors to avoid circular imports if we define Systems in models?
-// No, Systems should be defined in pipeline package.
+// StreamProcessors are the streaming forms of Processors.
+var StreamProcessors = map[string]StreamProcessor{
+	"fix_legacy_js":     FixLegacyJSStream,
+	"rewrite_phis_urls": RewritePhisURLsStream,
+}
 
-var DefinedSystems = []SystemDefinition{
-	{
-		ID:        "HIS",
-		Name:      "Legacy HIS",
-		ProbeURLs: []string{"/cis/images/img/LOGO-HIS-LOGIN.png"},
-		Processors: []ContentProcessor{
-			FixLegacyJS,
-		},
-	},
-	{
-		ID:        "PHIS",
-		Name:      "Public Health",
-		ProbeURLs: []string{"/phis/static/images/logins/bg-denglu.png"},
-		Processors: []ContentProcessor{
-			FixLegacyJS,
-			RewritePhisURLs,
-			InjectCaptchaSolver,
-		},
-	},
-	{
-		ID:        "DEMO",
-		Name:      "Demo Site",
-		ProbeURLs: []string{"/demo/probe.png"},
-		Processors: []ContentProcessor{
-			FixLegacyJS,
-			InjectCaptchaSolver,
-		},
-	},
+// SystemProcessors returns the processors of a system in order, and the names that don't
+// refer to a known processor.
+func SystemProcessors(sys config.SystemDefinition) ([]ContentProcessor, []string) {
+	var processors []ContentProcessor
+	var unknown []string
+	for _, name := range sys.Processors {
+		if p, ok := Processors[name]; ok {
+			processors = append(processors, p)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	return processors, unknown
 }
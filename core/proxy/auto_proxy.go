@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// CreateAutoProxy returns the proxy for rawURL's host, creating it on behalf of parent if the
+// node's auto-proxy policy allows it. Existing proxies are always returned as-is.
+func CreateAutoProxy(rawURL string, parent *models.SharedProxy) (*models.SharedProxy, error) {
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		rawURL = "http://" + rawURL
+	}
+	target, err := url.Parse(strings.ReplaceAll(rawURL, "localhost", "127.0.0.1"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	if p := findProxyByHost(target); p != nil {
+		return p, nil
+	}
+
+	policy := config.Get().AutoProxy
+	if err := checkAutoProxyPolicy(policy, target.Hostname()); err != nil {
+		log.Printf("Auto-proxy for %s refused: %v", rawURL, err)
+		return nil, err
+	}
+
+	if err := reserveAutoProxy(policy.MaxProxies); err != nil {
+		log.Printf("Auto-proxy for %s refused: %v", rawURL, err)
+		return nil, err
+	}
+	defer releaseAutoProxy()
+
+	parentURL := ""
+	if parent != nil {
+		parentURL = parent.OriginalURL
+	}
+	log.Printf("Auto-creating proxy for %s (parent: %s)", rawURL, parentURL)
+	return shareURL(rawURL, 0, parent, nil)
+}
+
+var (
+	// pendingAutoProxies counts auto-proxies being created, which count against the limit
+	// until they are in Proxies.
+	pendingAutoProxies int
+	autoProxyLock      sync.Mutex
+)
+
+// reserveAutoProxy reserves room for one more auto-proxy under the limit (0 = unlimited).
+// The reservation must be released with releaseAutoProxy once the proxy is created or failed.
+func reserveAutoProxy(limit int) error {
+	autoProxyLock.Lock()
+	defer autoProxyLock.Unlock()
+	if limit > 0 && countAutoProxies()+pendingAutoProxies >= limit {
+		return fmt.Errorf("auto-proxy limit of %d reached", limit)
+	}
+	pendingAutoProxies++
+	return nil
+}
+
+func releaseAutoProxy() {
+	autoProxyLock.Lock()
+	pendingAutoProxies--
+	autoProxyLock.Unlock()
+}
+
+func countAutoProxies() int {
+	count := 0
+	for _, p := range GetProxies() {
+		p.Mu.RLock()
+		if p.AutoCreated {
+			count++
+		}
+		p.Mu.RUnlock()
+	}
+	return count
+}
+
+// checkAutoProxyPolicy returns an error if host may not be auto-proxied. Hostnames are
+// resolved so that CIDR rules also apply to DNS names.
+func checkAutoProxyPolicy(policy config.AutoProxyPolicy, host string) error {
+	if !policy.Enabled {
+		return fmt.Errorf("automatic proxy creation is disabled")
+	}
+
+	host = strings.ToLower(host)
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if len(policy.AllowCIDRs) > 0 || len(policy.DenyCIDRs) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err == nil {
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+	}
+
+	if matchesHost(policy.DenyHosts, host) || matchesCIDR(policy.DenyCIDRs, ips) {
+		return fmt.Errorf("%s is denied by the auto-proxy policy", host)
+	}
+
+	if len(policy.AllowHosts) == 0 && len(policy.AllowCIDRs) == 0 {
+		return nil
+	}
+	if matchesHost(policy.AllowHosts, host) || matchesCIDR(policy.AllowCIDRs, ips) {
+		return nil
+	}
+	return fmt.Errorf("%s is not in the auto-proxy allowlist", host)
+}
+
+// matchesHost reports whether host equals one of the patterns. A leading "*." matches any
+// subdomain.
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesCIDR(cidrs []string, ips []net.IP) bool {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Printf("Invalid CIDR in auto-proxy policy: %s", cidr)
+			continue
+		}
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
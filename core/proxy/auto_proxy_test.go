@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+func TestCheckAutoProxyPolicy(t *testing.T) {
+	policy := config.AutoProxyPolicy{
+		Enabled:    true,
+		AllowCIDRs: []string{"10.0.0.0/8"},
+		AllowHosts: []string{"*.hospital.local"},
+		DenyCIDRs:  []string{"10.1.0.0/16"},
+		DenyHosts:  []string{"admin.hospital.local"},
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"10.0.0.5", true},
+		{"10.1.2.3", false},     // Denied CIDR wins over allowed CIDR
+		{"192.168.1.10", false}, // Not in allowlist
+		{"his.hospital.local", true},
+		{"admin.hospital.local", false},
+	}
+
+	for _, tt := range tests {
+		err := checkAutoProxyPolicy(policy, tt.host)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkAutoProxyPolicy(%q) error = %v, want allowed=%v", tt.host, err, tt.allowed)
+		}
+	}
+
+	policy.Enabled = false
+	if err := checkAutoProxyPolicy(policy, "10.0.0.5"); err == nil {
+		t.Errorf("Expected disabled policy to refuse auto-creation")
+	}
+}
+
+func TestReserveAutoProxyLimit(t *testing.T) {
+	var granted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveAutoProxy(3) == nil {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := granted.Load(); got != 3 {
+		t.Errorf("Expected 3 reservations under a limit of 3, got %d", got)
+	}
+	for i := int32(0); i < granted.Load(); i++ {
+		releaseAutoProxy()
+	}
+	if err := reserveAutoProxy(3); err != nil {
+		t.Errorf("Expected released reservations to free the limit, got %v", err)
+	}
+	releaseAutoProxy()
+}
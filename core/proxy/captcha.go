@@ -1,72 +1,171 @@
 package proxy
 
 import (
-	"bytes"
-	_ "embed"
+	"context"
 	"fmt"
-	"io"
 	"log"
+	"reflect"
 	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/soda92/vpn-share-tool/common"
+	"github.com/soda92/vpn-share-tool/core/captchadata"
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
 )
 
+var captchaSolutions = newCaptchaStore(func() (time.Duration, int) {
+	cfg := config.Get().Captcha
+	return time.Duration(cfg.SolutionTTLSeconds) * time.Second, cfg.MaxSessions
+})
+
+// StoreCaptchaSolution saves the solution for a consumer session
+func StoreCaptchaSolution(session, solution string) {
+	captchaSolutions.Store(session, solution)
+	log.Printf("Stored captcha solution for %s: %s", session, solution)
+}
+
+// ClearCaptchaSolution removes the stored solution for a consumer session
+func ClearCaptchaSolution(session string) {
+	captchaSolutions.Clear(session)
+}
+
+// GetCaptchaSolution retrieves the solution for a consumer session without waiting
+func GetCaptchaSolution(session string) string {
+	return captchaSolutions.Get(session)
+}
+
+// WaitCaptchaSolution waits for the solution for a consumer session until ctx is done
+func WaitCaptchaSolution(ctx context.Context, session string) string {
+	return captchaSolutions.Wait(ctx, session)
+}
+
+// solvedCaptchas maps consumer sessions to the image key of their last solution, so a
+// solution the login rejects can be evicted from the solver cache.
+var solvedCaptchas, _ = lru.New[string, string](1024)
+
 var (
-	captchaSolutions = make(map[string]string) // Map[ClientIP] -> Solution
-	captchaLock      sync.RWMutex
+	captchaSolver           = common.NewSolverChain(10 * time.Second)
+	captchaSolverConfig     *config.CaptchaConfig
+	captchaSolverConfigLock sync.Mutex
 )
 
-// StoreCaptchaSolution saves the solution for a client
-func StoreCaptchaSolution(clientIP, solution string) {
-	captchaLock.Lock()
-	defer captchaLock.Unlock()
-	captchaSolutions[clientIP] = solution
-	log.Printf("Stored captcha solution for %s: %s", clientIP, solution)
+// solverChain returns the captcha solver, reconfiguring its backends when the node config
+// changed. Stats and cached solutions survive reconfiguration.
+func solverChain() *common.SolverChain {
+	cfg := config.Get().Captcha
+	captchaSolverConfigLock.Lock()
+	defer captchaSolverConfigLock.Unlock()
+	if captchaSolverConfig != nil && reflect.DeepEqual(*captchaSolverConfig, cfg) {
+		return captchaSolver
+	}
+
+	var backends []common.Solver
+	for _, name := range cfg.Backends {
+		if backend := captchaBackend(name, cfg); backend != nil {
+			backends = append(backends, backend)
+		}
+	}
+	captchaSolver.Configure(time.Duration(cfg.TimeoutSeconds)*time.Second, backends...)
+	captchaSolverConfig = &cfg
+	log.Printf("Captcha solver backends: %v", cfg.Backends)
+	return captchaSolver
 }
 
-// ClearCaptchaSolution removes the stored solution for a client
-func ClearCaptchaSolution(clientIP string) {
-	captchaLock.Lock()
-	defer captchaLock.Unlock()
-	delete(captchaSolutions, clientIP)
+// captchaBackend returns the solver backend with the given name, or nil if it is unknown.
+func captchaBackend(name string, cfg config.CaptchaConfig) common.Solver {
+	switch name {
+	case common.SolverDiscovery:
+		return &common.HTTPSolver{
+			BackendName: common.SolverDiscovery,
+			URL: func() string {
+				if DiscoveryServerURL == "" {
+					return ""
+				}
+				return DiscoveryServerURL + "/solve-captcha"
+			},
+			Client: HTTPClientProvider,
+		}
+	case common.SolverHTTP:
+		httpURL := cfg.HTTPURL
+		return &common.HTTPSolver{
+			BackendName: common.SolverHTTP,
+			URL:         func() string { return httpURL },
+		}
+	case common.SolverPython:
+		return common.DefaultPythonWorker()
+	default:
+		log.Printf("Unknown captcha solver backend: %s", name)
+		return nil
+	}
 }
 
-// GetCaptchaSolution retrieves the solution for a client
-func GetCaptchaSolution(clientIP string) string {
-	captchaLock.Lock()
-	defer captchaLock.Unlock()
-	if sol, ok := captchaSolutions[clientIP]; ok {
-		// will be deleted in ClearCaptchaSolution
-		return sol
+// solveCaptcha solves the image with the given backend (from the captcha profile), or the
+// configured chain if backend is "".
+func solveCaptcha(imgData []byte, backend string) (common.SolveResult, error) {
+	chain := solverChain()
+	if backend == "" {
+		return chain.SolveWith(imgData)
 	}
-	return ""
+	solver := captchaBackend(backend, config.Get().Captcha)
+	if solver == nil {
+		return common.SolveResult{}, fmt.Errorf("unknown backend %s", backend)
+	}
+	return chain.SolveWith(imgData, solver)
 }
 
-func SolveCaptcha(imgData []byte) string {
-	if DiscoveryServerURL != "" && HTTPClientProvider != nil {
-		log.Printf("trying to use server to solve...")
-
-		// 1. Format the endpoint URL
-		url := fmt.Sprintf("%s/solve-captcha", DiscoveryServerURL)
-		client := HTTPClientProvider()
-		// 2. Post the raw bytes
-		resp, err := client.Post(url, "application/octet-stream", bytes.NewBuffer(imgData))
-		if err != nil {
-			log.Printf("server request failed: %v", err)
-			return common.SolveCaptchaLocal(imgData)
-		}
-		defer resp.Body.Close()
+// SolveCaptcha solves an image of the profile's captcha for a consumer of proxy p, or returns
+// "" if it could not be solved. Images no backend solved confidently are sent to operators
+// on the discovery dashboard when HumanFallback is on, until ctx is done. The solution is
+// recorded in the dataset until the session's login shows whether it was correct.
+func SolveCaptcha(ctx context.Context, p *models.SharedProxy, session string, profile config.CaptchaProfile, imgData []byte) string {
+	start := time.Now()
+	result, err := solveCaptcha(imgData, profile.Backend)
+	if err != nil {
+		log.Printf("Failed to solve captcha: %v", err)
+	}
 
-		// 3. Read the response from the server
-		solution, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("failed to read server response: %v", err)
-			return common.SolveCaptchaLocal(imgData)
+	cfg := config.Get().Captcha
+	if cfg.HumanFallback && !confidentSolution(profile, result.Text) && ctx.Err() == nil {
+		task, humanErr := askOperator(ctx, p, profile, imgData, result.Text, time.Duration(cfg.HumanTimeoutSeconds)*time.Second)
+		if humanErr == nil {
+			log.Printf("Captcha answered by operator %s: '%s'", task.SolvedBy, task.Solution)
+			result = common.SolveResult{Text: task.Solution, Backend: SolverHuman, Duration: time.Since(start)}
+		} else {
+			log.Printf("Operator fallback failed: %v", humanErr)
 		}
+	}
+	if result.Text == "" || ctx.Err() != nil {
+		return ""
+	}
+
+	solvedCaptchas.Add(session, common.ImageKey(imgData))
+	captchadata.Solved(session, captchadata.Record{
+		Time:      time.Now(),
+		Profile:   profile.Name,
+		Backend:   result.Backend,
+		Solution:  result.Text,
+		LatencyMs: float64(result.Duration.Microseconds()) / 1000,
+		Cached:    result.Cached,
+	}, imgData)
+	return result.Text
+}
 
-		return string(solution)
+// CaptchaLoginResult records whether the session's login accepted its last captcha solution.
+// A rejected solution is evicted from the solver cache so a repeated image is not answered
+// with it again.
+func CaptchaLoginResult(session string, correct bool) {
+	if key, ok := solvedCaptchas.Get(session); ok {
+		solvedCaptchas.Remove(session)
+		if !correct {
+			captchaSolver.Forget(key)
+		}
 	}
+	captchadata.LoginResult(session, correct)
+}
 
-	log.Printf("no discovery server. trying locally...")
-	return common.SolveCaptchaLocal(imgData)
+// CaptchaStats returns the per-backend captcha solver stats.
+func CaptchaStats() []common.SolverStats {
+	return captchaSolver.Stats()
 }
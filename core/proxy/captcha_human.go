@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// SolverHuman is the dataset backend name of answers given by operators on the dashboard.
+const SolverHuman = "human"
+
+// operatorTask is the discovery server's view of a queued captcha.
+type operatorTask struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Solution string `json:"solution"`
+	SolvedBy string `json:"solved_by"`
+}
+
+// confidentSolution reports whether a solver's answer can be used without asking an operator.
+func confidentSolution(profile config.CaptchaProfile, solution string) bool {
+	if solution == "" {
+		return false
+	}
+	if profile.SolutionPattern == "" {
+		return true
+	}
+	re, err := regexp.Compile(profile.SolutionPattern)
+	return err != nil || re.MatchString(solution)
+}
+
+// askOperator queues the image on the discovery dashboard and waits until an operator answers
+// it or timeout passes. If ctx is cancelled first (the consumer loaded a new captcha) or the
+// proxy is removed, the task is withdrawn from the dashboard.
+func askOperator(ctx context.Context, p *models.SharedProxy, profile config.CaptchaProfile, imgData []byte, guess string, timeout time.Duration) (operatorTask, error) {
+	if DiscoveryServerURL == "" {
+		return operatorTask{}, fmt.Errorf("no discovery server")
+	}
+	client := http.DefaultClient
+	if HTTPClientProvider != nil {
+		if c := HTTPClientProvider(); c != nil {
+			client = c
+		}
+	}
+
+	query := url.Values{}
+	query.Set("node", net.JoinHostPort(MyIP, strconv.Itoa(APIPort)))
+	query.Set("upstream", p.OriginalURL)
+	query.Set("profile", profile.Name)
+	query.Set("guess", guess)
+	query.Set("ttl", strconv.Itoa(int(timeout.Seconds())))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := context.AfterFunc(p.Ctx, cancel)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, DiscoveryServerURL+"/captcha-queue?"+query.Encode(), bytes.NewReader(imgData))
+	if err != nil {
+		return operatorTask{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return operatorTask{}, err
+	}
+	var task operatorTask
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return operatorTask{}, fmt.Errorf("discovery server returned %s", resp.Status)
+	}
+	if err != nil {
+		return operatorTask{}, err
+	}
+	log.Printf("Captcha for %s queued for operators (%s)", p.OriginalURL, task.ID)
+
+	// done explains why waiting stopped early, withdrawing the task if nobody needs it anymore
+	done := func() error {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			withdrawOperatorTask(client, task.ID)
+			return fmt.Errorf("captcha %s was superseded", task.ID)
+		}
+		return fmt.Errorf("no operator answered in %v", timeout)
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, DiscoveryServerURL+"/captcha-queue/wait?id="+url.QueryEscape(task.ID), nil)
+		if err != nil {
+			return operatorTask{}, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return operatorTask{}, done()
+			}
+			// The discovery server may be restarting; keep waiting until the deadline
+			log.Printf("Waiting for captcha answer failed: %v", err)
+			select {
+			case <-time.After(2 * time.Second):
+				continue
+			case <-ctx.Done():
+				return operatorTask{}, done()
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&task)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return operatorTask{}, fmt.Errorf("captcha %s is no longer queued", task.ID)
+		}
+		if err != nil {
+			return operatorTask{}, err
+		}
+		switch task.Status {
+		case "solved":
+			return task, nil
+		case "expired":
+			return operatorTask{}, fmt.Errorf("no operator answered in %v", timeout)
+		case "cancelled":
+			return operatorTask{}, fmt.Errorf("captcha %s was withdrawn", task.ID)
+		}
+	}
+}
+
+// withdrawOperatorTask removes a task nobody waits for anymore from the dashboard.
+func withdrawOperatorTask(client *http.Client, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, DiscoveryServerURL+"/captcha-queue/cancel?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to withdraw captcha %s: %v", id, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("Withdrew captcha %s from operators", id)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestLowConfidenceCaptchaFallsBackToOperator(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+
+	var queuedGuess string
+	var waits atomic.Int32
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/solve-captcha":
+			io.WriteString(w, "a?") // Does not match the profile's solution pattern
+		case "/captcha-queue":
+			queuedGuess = r.URL.Query().Get("guess")
+			io.WriteString(w, `{"id":"task-1","status":"pending"}`)
+		case "/captcha-queue/wait":
+			// The first wait times out, the second sees the operator's answer
+			if waits.Add(1) == 1 {
+				io.WriteString(w, `{"id":"task-1","status":"pending"}`)
+				return
+			}
+			io.WriteString(w, `{"id":"task-1","status":"solved","solution":"ab12","solved_by":"alice"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer discovery.Close()
+	oldURL, oldClient := DiscoveryServerURL, HTTPClientProvider
+	DiscoveryServerURL, HTTPClientProvider = discovery.URL, nil
+	defer func() { DiscoveryServerURL, HTTPClientProvider = oldURL, oldClient }()
+
+	profile := config.DefaultCaptchaProfiles()[0]
+	p := &models.SharedProxy{OriginalURL: "http://10.0.0.5", Ctx: context.Background()}
+	if got := SolveCaptcha(context.Background(), p, "session:a", profile, []byte("operator-fallback-image")); got != "ab12" {
+		t.Errorf("Expected the operator's answer, got %q", got)
+	}
+	if queuedGuess != "a?" {
+		t.Errorf("Expected the solver's guess to be shown to operators, got %q", queuedGuess)
+	}
+	if waits.Load() != 2 {
+		t.Errorf("Expected the node to keep waiting after a timed out poll, got %d waits", waits.Load())
+	}
+}
+
+func TestConfidentSolution(t *testing.T) {
+	profile := config.CaptchaProfile{SolutionPattern: `^[0-9a-z]{4}$`}
+	if !confidentSolution(profile, "ab12") {
+		t.Errorf("Expected a well-formed solution to be confident")
+	}
+	if confidentSolution(profile, "ab1") || confidentSolution(profile, "") {
+		t.Errorf("Expected malformed or empty solutions to need an operator")
+	}
+	if !confidentSolution(config.CaptchaProfile{}, "anything") {
+		t.Errorf("Expected any non-empty solution to be confident without a pattern")
+	}
+}
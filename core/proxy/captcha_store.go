@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptchaCookieName is the cookie the proxy issues to tell consumers apart, so users behind
+// the same NAT don't receive each other's captcha solutions.
+const CaptchaCookieName = "vst_captcha_session"
+
+// captchaStore holds the latest captcha solution per consumer session. Entries expire after
+// a TTL and the oldest ones are evicted once the store is full.
+type captchaStore struct {
+	mu      sync.Mutex
+	entries map[string]*captchaEntry
+	// limits returns the entry TTL and the maximum number of sessions.
+	limits func() (time.Duration, int)
+}
+
+type captchaEntry struct {
+	solution string
+	updated  time.Time
+	// ready is closed when a solution is stored or the entry is dropped, waking waiters.
+	ready  chan struct{}
+	closed bool
+}
+
+func newCaptchaStore(limits func() (time.Duration, int)) *captchaStore {
+	return &captchaStore{
+		entries: make(map[string]*captchaEntry),
+		limits:  limits,
+	}
+}
+
+func (e *captchaEntry) wake() {
+	if !e.closed {
+		close(e.ready)
+		e.closed = true
+	}
+}
+
+// entry returns the live entry for key, creating a pending one if needed. Callers hold s.mu.
+func (s *captchaStore) entry(key string, now time.Time) *captchaEntry {
+	ttl, maxEntries := s.limits()
+	if e, ok := s.entries[key]; ok {
+		if ttl <= 0 || now.Sub(e.updated) < ttl {
+			return e
+		}
+		s.drop(key)
+	}
+
+	if maxEntries > 0 && len(s.entries) >= maxEntries {
+		s.expire(now, ttl)
+		for len(s.entries) >= maxEntries {
+			s.evictOldest()
+		}
+	}
+	e := &captchaEntry{updated: now, ready: make(chan struct{})}
+	s.entries[key] = e
+	return e
+}
+
+func (s *captchaStore) drop(key string) {
+	if e, ok := s.entries[key]; ok {
+		e.wake()
+		delete(s.entries, key)
+	}
+}
+
+func (s *captchaStore) expire(now time.Time, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	for key, e := range s.entries {
+		if now.Sub(e.updated) >= ttl {
+			s.drop(key)
+		}
+	}
+}
+
+func (s *captchaStore) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, e := range s.entries {
+		if oldestKey == "" || e.updated.Before(oldest) {
+			oldestKey, oldest = key, e.updated
+		}
+	}
+	s.drop(oldestKey)
+}
+
+// Store saves the solution for a session and wakes anyone waiting for it.
+func (s *captchaStore) Store(key, solution string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.entry(key, now)
+	if e.closed {
+		// A previous solution was already delivered; start a fresh entry for this one
+		e = &captchaEntry{ready: make(chan struct{})}
+		s.entries[key] = e
+	}
+	e.solution = solution
+	e.updated = now
+	e.wake()
+}
+
+// Clear forgets the solution for a session, e.g. when a new captcha image was loaded.
+// Waiters keep waiting for the next solution.
+func (s *captchaStore) Clear(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	if e.closed {
+		s.entries[key] = &captchaEntry{updated: time.Now(), ready: make(chan struct{})}
+		return
+	}
+	e.solution = ""
+	e.updated = time.Now()
+}
+
+// Get returns the current solution for a session without waiting.
+func (s *captchaStore) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ttl, _ := s.limits()
+	e, ok := s.entries[key]
+	if !ok || (ttl > 0 && time.Since(e.updated) >= ttl) {
+		return ""
+	}
+	return e.solution
+}
+
+// Wait returns the solution for a session, blocking until one is stored or ctx is done.
+// It returns "" if no solution arrived in time.
+func (s *captchaStore) Wait(ctx context.Context, key string) string {
+	s.mu.Lock()
+	e := s.entry(key, time.Now())
+	if e.solution != "" {
+		s.mu.Unlock()
+		return e.solution
+	}
+	ready := e.ready
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return e.solution
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+// Len returns the number of sessions held.
+func (s *captchaStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// captchaSession returns the key captcha solutions are stored under for this consumer. It
+// issues the session cookie when the request doesn't carry one, and strips it from the request
+// so it is never forwarded upstream. Until the cookie comes back the consumer is keyed by its
+// connection address; X-Forwarded-For is ignored because any client can set it.
+func captchaSession(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(CaptchaCookieName); err == nil && c.Value != "" {
+		removeCookie(r, CaptchaCookieName)
+		return "session:" + c.Value
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     CaptchaCookieName,
+			Value:    hex.EncodeToString(buf),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// removeCookie drops one cookie from the request's Cookie headers. The headers are split on
+// ";" rather than parsed, so the other cookies reach the upstream byte for byte even when
+// their values are not valid by Go's rules.
+func removeCookie(r *http.Request, name string) {
+	var kept []string
+	for _, line := range r.Header.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			pairName, _, _ := strings.Cut(pair, "=")
+			if strings.TrimSpace(pairName) == name || strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kept = append(kept, strings.TrimSpace(pair))
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fixedLimits(ttl time.Duration, maxEntries int) func() (time.Duration, int) {
+	return func() (time.Duration, int) { return ttl, maxEntries }
+}
+
+func TestCaptchaStoreConcurrentSessions(t *testing.T) {
+	store := newCaptchaStore(fixedLimits(time.Minute, 1000))
+
+	const users = 50
+	var wg sync.WaitGroup
+	results := make([]string, users)
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			results[i] = store.Wait(ctx, fmt.Sprintf("session:%d", i))
+		}(i)
+	}
+
+	// Solutions arrive in arbitrary order while the users are waiting
+	for i := users - 1; i >= 0; i-- {
+		go store.Store(fmt.Sprintf("session:%d", i), fmt.Sprintf("code%d", i))
+	}
+	wg.Wait()
+
+	for i, got := range results {
+		if want := fmt.Sprintf("code%d", i); got != want {
+			t.Errorf("User %d got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestCaptchaStoreClearAndTimeout(t *testing.T) {
+	store := newCaptchaStore(fixedLimits(time.Minute, 1000))
+
+	store.Store("a", "1234")
+	store.Clear("a")
+	if got := store.Get("a"); got != "" {
+		t.Errorf("Expected cleared solution, got %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if got := store.Wait(ctx, "a"); got != "" {
+		t.Errorf("Expected no solution before timeout, got %q", got)
+	}
+
+	// A waiter for the new image receives the next solution
+	done := make(chan string)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- store.Wait(ctx, "a")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	store.Store("a", "5678")
+	if got := <-done; got != "5678" {
+		t.Errorf("Expected 5678, got %q", got)
+	}
+}
+
+func TestCaptchaStoreLimits(t *testing.T) {
+	store := newCaptchaStore(fixedLimits(50*time.Millisecond, 3))
+
+	for i := range 10 {
+		store.Store(fmt.Sprintf("s%d", i), "x")
+	}
+	if n := store.Len(); n != 3 {
+		t.Errorf("Expected 3 sessions, got %d", n)
+	}
+	if got := store.Get("s9"); got != "x" {
+		t.Errorf("Expected newest session to be kept, got %q", got)
+	}
+	if got := store.Get("s0"); got != "" {
+		t.Errorf("Expected oldest session to be evicted, got %q", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := store.Get("s9"); got != "" {
+		t.Errorf("Expected expired solution, got %q", got)
+	}
+}
+
+func TestCaptchaSessionCookie(t *testing.T) {
+	// Two users behind the same NAT get different sessions once they have a cookie
+	first := httptest.NewRequest(http.MethodGet, "/login", nil)
+	first.RemoteAddr = "203.0.113.7:50000"
+	first.Header.Set("X-Forwarded-For", "10.0.0.1")
+	w := httptest.NewRecorder()
+	if key := captchaSession(w, first); key != "ip:203.0.113.7" {
+		t.Errorf("Expected connection IP fallback, got %q", key)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CaptchaCookieName {
+		t.Fatalf("Expected session cookie, got %v", cookies)
+	}
+
+	keys := map[string]bool{}
+	for _, value := range []string{cookies[0].Value, "other"} {
+		r := httptest.NewRequest(http.MethodGet, "/_proxy/captcha-solution", nil)
+		r.RemoteAddr = "203.0.113.7:50001"
+		r.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: "abc"})
+		r.AddCookie(&http.Cookie{Name: CaptchaCookieName, Value: value})
+		w := httptest.NewRecorder()
+		keys[captchaSession(w, r)] = true
+
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Expected no new cookie for an existing session")
+		}
+		if got := r.Header.Get("Cookie"); got != "JSESSIONID=abc" {
+			t.Errorf("Expected session cookie stripped before forwarding, got %q", got)
+		}
+	}
+	if len(keys) != 2 {
+		t.Errorf("Expected distinct sessions, got %v", keys)
+	}
+}
+
+func TestRemoveCookieKeepsOtherCookiesVerbatim(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("Cookie", `name=张三; pref="a b"; `+CaptchaCookieName+`=abc`)
+	r.Header.Add("Cookie", `path=C:\tmp`)
+	removeCookie(r, CaptchaCookieName)
+
+	want := `name=张三; pref="a b"; path=C:\tmp`
+	if got := r.Header.Get("Cookie"); got != want || len(r.Header.Values("Cookie")) != 1 {
+		t.Errorf("Expected %q, got %q", want, r.Header.Values("Cookie"))
+	}
+}
@@ -0,0 +1,10 @@
+package proxy
+
+import (
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+func init() {
+	models.ProcessorChainResolver = pipeline.ProcessorChain
+}
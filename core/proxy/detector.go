@@ -1,36 +1,93 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/soda92/vpn-share-tool/core/cache"
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/models"
 	"github.com/soda92/vpn-share-tool/core/pipeline"
 )
 
-// StartSystemDetector runs periodically to detect which systems are active on the proxy target
-func StartSystemDetector(p *models.SharedProxy) {
+const (
+	probeTimeout = 5 * time.Second
+	maxProbeBody = 2 << 20
+)
+
+var reTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// StartSystemDetector runs periodically to detect which systems are active on the proxy target.
+// Probes go through transport, so they use the same CA and outbound settings as proxied requests.
+func StartSystemDetector(p *models.SharedProxy, transport http.RoundTripper) {
 	ticker := time.NewTicker(5 * time.Minute) // Check every 5 minutes (or once at start)
 	defer ticker.Stop()
 
 	// Initial check
-	detectSystems(p)
+	detectSystems(p, transport)
 
 	for {
 		select {
 		case <-ticker.C:
-			detectSystems(p)
+			detectSystems(p, transport)
 		case <-p.Ctx.Done():
 			return
 		}
 	}
 }
 
-func detectSystems(p *models.SharedProxy) {
-	detected := []string{}
+type probeResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// prober fetches probe paths from the upstream, once per path and method in a detection run.
+type prober struct {
+	ctx       context.Context
+	client    *http.Client
+	base      *url.URL
+	responses map[string]*probeResponse
+}
+
+func (pr *prober) fetch(method, path string) *probeResponse {
+	key := method + " " + path
+	if resp, ok := pr.responses[key]; ok {
+		return resp
+	}
+	pr.responses[key] = nil
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(pr.ctx, method, pr.base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := pr.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	if err != nil {
+		return nil
+	}
+	pr.responses[key] = &probeResponse{status: resp.StatusCode, header: resp.Header, body: body}
+	return pr.responses[key]
+}
+
+func detectSystems(p *models.SharedProxy, transport http.RoundTripper) {
 	baseURL := p.OriginalURL
 	if !strings.HasSuffix(baseURL, "/") {
 		baseURL += "/"
@@ -42,40 +99,166 @@ func detectSystems(p *models.SharedProxy) {
 		return
 	}
 
-	for _, sys := range pipeline.DefinedSystems {
-		for _, probe := range sys.ProbeURLs {
-			probeURL, err := url.Parse(probe)
-			if err != nil {
-				continue
-			}
-			targetURL := baseParsed.ResolveReference(probeURL).String()
-
-			// We can use IsURLReachable from utils, but we might want more specific check (200 OK)
-			// IsURLReachable returns true for 403/401 too.
-			// For asset probing, we usually expect 200.
-			if checkProbe(targetURL) {
-				log.Printf("Detected system %s on %s", sys.Name, p.OriginalURL)
-				detected = append(detected, sys.ID)
-				break // Found one probe, system matches
-			}
+	pr := &prober{
+		ctx:       p.Ctx,
+		client:    &http.Client{Transport: transport, Timeout: probeTimeout},
+		base:      baseParsed,
+		responses: map[string]*probeResponse{},
+	}
+
+	ids := []string{}
+	detected := []models.DetectedSystem{}
+	for _, sys := range config.Get().Systems {
+		system, ok := matchSystem(pr, sys)
+		if !ok {
+			continue
 		}
+		log.Printf("Detected system %s %s on %s (confidence %.2f)", sys.Name, system.Version, p.OriginalURL, system.Confidence)
+		if _, unknown := pipeline.SystemProcessors(sys); len(unknown) > 0 {
+			log.Printf("System %s names unknown content processors: %v", sys.ID, unknown)
+		}
+		ids = append(ids, sys.ID)
+		detected = append(detected, system)
+		applySystemDefaults(p, sys)
 	}
 
 	p.Mu.Lock()
-	p.ActiveSystems = detected
+	p.ActiveSystems = ids
+	p.Systems = detected
 	p.Mu.Unlock()
 }
 
-func checkProbe(targetURL string) bool {
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("HEAD", targetURL, nil)
-	if err != nil {
-		return false
+// matchSystem runs the system's probes. The system is detected if the weight of the matching
+// probes reaches its minimum confidence.
+func matchSystem(pr *prober, sys config.SystemDefinition) (models.DetectedSystem, bool) {
+	var total, matched float64
+	version := ""
+	for _, probe := range sys.Probes {
+		weight := probe.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		if ok, v := checkProbe(pr, probe); ok {
+			matched += weight
+			if version == "" {
+				version = v
+			}
+		}
+	}
+	if matched == 0 || matched/total < sys.MinConfidence {
+		return models.DetectedSystem{}, false
+	}
+	return models.DetectedSystem{ID: sys.ID, Name: sys.Name, Version: version, Confidence: matched / total}, true
+}
+
+// checkProbe reports whether a probe matches and the version captured by its pattern, if any.
+func checkProbe(pr *prober, probe config.SystemProbe) (bool, string) {
+	path := probe.Path
+	if path == "" {
+		path = "/"
+		if probe.Type == config.ProbeFavicon {
+			path = "/favicon.ico"
+		}
+	}
+
+	switch probe.Type {
+	case config.ProbeStatus:
+		resp := pr.fetch(http.MethodHead, path)
+		want := probe.Status
+		if want == 0 {
+			want = http.StatusOK
+		}
+		return resp != nil && resp.status == want, ""
+	case config.ProbeFavicon:
+		resp := pr.fetch(http.MethodGet, path)
+		if resp == nil || resp.status != http.StatusOK {
+			return false, ""
+		}
+		sum := sha256.Sum256(resp.body)
+		return strings.EqualFold(hex.EncodeToString(sum[:]), probe.Hash), ""
+	}
+
+	resp := pr.fetch(http.MethodGet, path)
+	if resp == nil {
+		return false, ""
+	}
+	var subject string
+	switch probe.Type {
+	case config.ProbeBody:
+		subject, _ = cache.DecodeText(resp.header.Get("Content-Type"), resp.body)
+		if probe.Contains != "" && !strings.Contains(subject, probe.Contains) {
+			return false, ""
+		}
+	case config.ProbeHeader:
+		values := resp.header.Values(probe.Header)
+		if len(values) == 0 {
+			return false, ""
+		}
+		subject = strings.Join(values, ", ")
+	case config.ProbeTitle:
+		text, _ := cache.DecodeText(resp.header.Get("Content-Type"), resp.body)
+		m := reTitle.FindStringSubmatch(text)
+		if m == nil {
+			return false, ""
+		}
+		subject = strings.TrimSpace(m[1])
+	default:
+		return false, ""
+	}
+	return matchProbePattern(probe.Pattern, subject)
+}
+
+// matchProbePattern matches an optional pattern, returning its first capture group as the version.
+func matchProbePattern(pattern, subject string) (bool, string) {
+	if pattern == "" {
+		return true, ""
 	}
-	resp, err := client.Do(req)
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		return false
+		return false, ""
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+	m := re.FindStringSubmatch(subject)
+	if m == nil {
+		return false, ""
+	}
+	if len(m) > 1 {
+		return true, strings.TrimSpace(m[1])
+	}
+	return true, ""
+}
+
+// applySystemDefaults applies a detected system's default settings to the proxy, once.
+func applySystemDefaults(p *models.SharedProxy, sys config.SystemDefinition) {
+	defaults := sys.DefaultSettings
+	if defaults == nil {
+		return
+	}
+	p.Mu.Lock()
+	if slices.Contains(p.Settings.SystemDefaults, sys.ID) {
+		p.Mu.Unlock()
+		return
+	}
+	s := &p.Settings
+	for _, field := range []struct {
+		value  *bool
+		target *bool
+	}{
+		{defaults.EnableContentMod, &s.EnableContentMod},
+		{defaults.EnableUrlRewrite, &s.EnableUrlRewrite},
+		{defaults.EnableCompression, &s.EnableCompression},
+		{defaults.EnableDebugScript, &s.EnableDebugScript},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	if defaults.IdleTTLMinutes != nil {
+		s.IdleTTLMinutes = *defaults.IdleTTLMinutes
+	}
+	s.SystemDefaults = append(slices.Clone(s.SystemDefaults), sys.ID)
+	p.Mu.Unlock()
+
+	log.Printf("Applied default settings of %s to %s", sys.ID, p.OriginalURL)
+	SaveProxies()
 }
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestDetectSystems(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	original := config.Get()
+	defer config.Set(original)
+
+	icon := []byte("favicon-bytes")
+	sum := sha256.Sum256(icon)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("X-Powered-By", "JSP/2.2")
+			io.WriteString(w, `<html><head><title> Public Health 3.4.1 </title></head><body>phis-app</body></html>`)
+		case "/favicon.ico":
+			w.Write(icon)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	compression := false
+	cfg := config.Get()
+	cfg.Systems = []config.SystemDefinition{
+		{
+			ID:   "PHIS",
+			Name: "Public Health",
+			Probes: []config.SystemProbe{
+				{Type: config.ProbeTitle, Pattern: `Public Health ([\d.]+)`, Weight: 2},
+				{Type: config.ProbeBody, Contains: "phis-app"},
+				{Type: config.ProbeHeader, Header: "X-Powered-By", Pattern: "JSP"},
+				{Type: config.ProbeFavicon, Hash: hex.EncodeToString(sum[:])},
+				{Type: config.ProbeStatus, Path: "/phis/", Status: http.StatusOK},
+			},
+			MinConfidence:   0.8,
+			DefaultSettings: &config.SystemSettings{EnableCompression: &compression},
+		},
+		{
+			ID:            "HIS",
+			Probes:        []config.SystemProbe{{Type: config.ProbeBody, Contains: "his-main"}, {Type: config.ProbeStatus}},
+			MinConfidence: 0.6,
+		},
+	}
+	if err := config.Set(cfg); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	p := &models.SharedProxy{OriginalURL: upstream.URL, Ctx: context.Background()}
+	p.Settings.EnableCompression = true
+	detectSystems(p, http.DefaultTransport)
+
+	if len(p.Systems) != 1 || p.Systems[0].ID != "PHIS" || len(p.ActiveSystems) != 1 {
+		t.Fatalf("Expected only PHIS to be detected, got %+v", p.Systems)
+	}
+	if got := p.Systems[0]; got.Version != "3.4.1" || got.Confidence < 0.83 || got.Confidence > 0.84 {
+		t.Errorf("Expected version 3.4.1 with confidence 5/6, got %+v", got)
+	}
+	if p.Settings.EnableCompression || len(p.Settings.SystemDefaults) != 1 {
+		t.Errorf("Expected the system defaults to be applied, got %+v", p.Settings)
+	}
+
+	// Defaults are applied once, so later changes by the user stick
+	p.Settings.EnableCompression = true
+	detectSystems(p, http.DefaultTransport)
+	if !p.Settings.EnableCompression {
+		t.Errorf("Expected the system defaults not to be applied again")
+	}
+}
+
+func TestInvalidSystemDefinitionsRejected(t *testing.T) {
+	original := config.Get()
+	defer config.Set(original)
+
+	for name, probe := range map[string]config.SystemProbe{
+		"unknown type": {Type: "cookie"},
+		"empty body":   {Type: config.ProbeBody},
+		"no header":    {Type: config.ProbeHeader},
+		"no hash":      {Type: config.ProbeFavicon},
+		"bad pattern":  {Type: config.ProbeTitle, Pattern: "("},
+	} {
+		cfg := config.Get()
+		cfg.Systems = []config.SystemDefinition{{ID: "X", Probes: []config.SystemProbe{probe}}}
+		if err := config.Set(cfg); err == nil {
+			t.Errorf("Expected a probe with %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func init() {
+	models.IdleTTLResolver = idleTTL
+}
+
+// idleTTL returns how long p may stay unused before it is removed (0 = never).
+// Pinned proxies never expire. A per-proxy TTL overrides the node default, and
+// auto-created proxies are additionally bounded by the auto-proxy policy TTL.
+func idleTTL(p *models.SharedProxy) time.Duration {
+	p.Mu.RLock()
+	settings := p.Settings
+	auto := p.AutoCreated
+	p.Mu.RUnlock()
+
+	if settings.Pinned {
+		return 0
+	}
+
+	cfg := config.Get()
+	ttl := time.Duration(cfg.IdleTTLMinutes) * time.Minute
+	if settings.IdleTTLMinutes > 0 {
+		ttl = time.Duration(settings.IdleTTLMinutes) * time.Minute
+	}
+	if auto && cfg.AutoProxy.TTLMinutes > 0 {
+		autoTTL := time.Duration(cfg.AutoProxy.TTLMinutes) * time.Minute
+		if ttl <= 0 || autoTTL < ttl {
+			ttl = autoTTL
+		}
+	}
+	return ttl
+}
+
+// StartExpiryReaper periodically shuts down and removes proxies that have been idle for
+// longer than their TTL.
+func StartExpiryReaper() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, p := range GetProxies() {
+			expiresAt := p.ExpiresAt()
+			if expiresAt.IsZero() || now.Before(expiresAt) {
+				continue
+			}
+			log.Printf("Proxy %s idle since %s, expiring.", p.OriginalURL, p.LastAccessTime().Format(time.RFC3339))
+			removeProxy(p)
+		}
+	}
+}
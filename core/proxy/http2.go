@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+// http2Enabled resolves a per-proxy HTTP/2 override against the node default.
+func http2Enabled(override string, nodeDefault bool) bool {
+	switch override {
+	case models.HTTP2On:
+		return true
+	case models.HTTP2Off:
+		return false
+	default:
+		return nodeDefault
+	}
+}
+
+func consumerHTTP2Enabled(p *models.SharedProxy) bool {
+	p.Mu.RLock()
+	defer p.Mu.RUnlock()
+	return http2Enabled(p.Settings.ConsumerHTTP2, config.Get().HTTP2.Consumer)
+}
+
+func upstreamHTTP2Enabled(p *models.SharedProxy) bool {
+	p.Mu.RLock()
+	defer p.Mu.RUnlock()
+	return http2Enabled(p.Settings.UpstreamHTTP2, config.Get().HTTP2.Upstream)
+}
+
+// consumerProtocols returns the protocols a proxy listener serves. Browsers only speak HTTP/2
+// over TLS; h2c helps other nodes and tools that use prior knowledge.
+func consumerProtocols(p *models.SharedProxy) *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	if consumerHTTP2Enabled(p) {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+var (
+	upstreamTransports     = map[*http.Transport][2]*http.Transport{}
+	upstreamTransportsLock sync.Mutex
+)
+
+// upstreamTransportPair returns HTTP/2-capable and HTTP/1-only clones of base. They are shared
+// by all proxies so connections are pooled across them.
+func upstreamTransportPair(base *http.Transport) (h2, h1 *http.Transport) {
+	upstreamTransportsLock.Lock()
+	defer upstreamTransportsLock.Unlock()
+	if pair, ok := upstreamTransports[base]; ok {
+		return pair[0], pair[1]
+	}
+
+	h2 = base.Clone()
+	h2.Protocols = &http.Protocols{}
+	h2.Protocols.SetHTTP1(true)
+	h2.Protocols.SetHTTP2(true)
+
+	h1 = base.Clone()
+	h1.Protocols = &http.Protocols{}
+	h1.Protocols.SetHTTP1(true)
+
+	upstreamTransports[base] = [2]*http.Transport{h2, h1}
+	return h2, h1
+}
+
+// protocolTransport sends upstream requests over HTTP/2 or HTTP/1 according to the proxy's
+// settings and records the protocol that was negotiated.
+type protocolTransport struct {
+	proxy *models.SharedProxy
+	h2    http.RoundTripper
+	h1    http.RoundTripper
+}
+
+func newProtocolTransport(base http.RoundTripper, p *models.SharedProxy) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+	h2, h1 := upstreamTransportPair(t)
+	return &protocolTransport{proxy: p, h2: h2, h1: h1}
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.h1
+	if upstreamHTTP2Enabled(t.proxy) {
+		transport = t.h2
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		t.proxy.Protocols.RecordUpstream(resp.Proto)
+	}
+	return resp, err
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestProtocolTransportFollowsUpstreamOverride(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	base := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	p := &models.SharedProxy{}
+	transport := newProtocolTransport(base, p)
+
+	get := func() string {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Proto
+	}
+
+	p.Settings.UpstreamHTTP2 = models.HTTP2On
+	if proto := get(); proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 with override on, got %s", proto)
+	}
+	p.Settings.UpstreamHTTP2 = models.HTTP2Off
+	if proto := get(); proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 with override off, got %s", proto)
+	}
+
+	counts := p.Protocols.Snapshot()
+	if counts.Upstream["HTTP/2.0"] != 1 || counts.Upstream["HTTP/1.1"] != 1 {
+		t.Errorf("Unexpected upstream protocol counts: %+v", counts.Upstream)
+	}
+}
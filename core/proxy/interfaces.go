@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/utils"
+)
+
+func init() {
+	models.InterfaceURLsResolver = SharedURLs
+}
+
+var (
+	cachedInterfaces     []utils.Interface
+	cachedInterfacesAt   time.Time
+	cachedInterfacesLock sync.Mutex
+)
+
+// GetInterfaces returns the node's usable interfaces, cached briefly since it is called for
+// every proxy when listing them.
+func GetInterfaces() []utils.Interface {
+	cachedInterfacesLock.Lock()
+	defer cachedInterfacesLock.Unlock()
+	if cachedInterfaces != nil && time.Since(cachedInterfacesAt) < 10*time.Second {
+		return cachedInterfaces
+	}
+	ifaces, err := utils.GetInterfaces()
+	if err != nil {
+		log.Printf("Failed to list network interfaces: %v", err)
+		return cachedInterfaces
+	}
+	cachedInterfaces = ifaces
+	cachedInterfacesAt = time.Now()
+	return ifaces
+}
+
+// LocalIPs returns the addresses of all usable interfaces.
+func LocalIPs() []string {
+	var ips []string
+	for _, iface := range GetInterfaces() {
+		ips = append(ips, iface.IPs...)
+	}
+	return ips
+}
+
+// boundInterfaces returns the interfaces a proxy listens on: the ones selected in its
+// settings, or all of them.
+func boundInterfaces(p *models.SharedProxy) []utils.Interface {
+	ifaces := GetInterfaces()
+	p.Mu.RLock()
+	selected := p.Settings.Interfaces
+	p.Mu.RUnlock()
+	if len(selected) == 0 {
+		return ifaces
+	}
+
+	var result []utils.Interface
+	for _, iface := range ifaces {
+		if slices.Contains(selected, iface.Name) {
+			result = append(result, iface)
+		}
+	}
+	return result
+}
+
+// SharedURLs returns the proxy's shared URL on each interface it listens on.
+func SharedURLs(p *models.SharedProxy) []models.InterfaceURL {
+	var urls []models.InterfaceURL
+	for _, iface := range boundInterfaces(p) {
+		for _, ip := range iface.IPs {
+			urls = append(urls, models.InterfaceURL{
+				Interface: iface.Name,
+				IP:        ip,
+				URL:       p.SharedURL(ip),
+			})
+		}
+	}
+	return urls
+}
+
+// listenAddrs returns the addresses the proxy's server listens on. Unrestricted proxies use
+// a single wildcard listener so interfaces that come up later are served too.
+func listenAddrs(p *models.SharedProxy) []string {
+	port := strconv.Itoa(p.RemotePort)
+	p.Mu.RLock()
+	restricted := len(p.Settings.Interfaces) > 0
+	p.Mu.RUnlock()
+	if !restricted {
+		return []string{":" + port}
+	}
+
+	var addrs []string
+	for _, iface := range boundInterfaces(p) {
+		for _, ip := range iface.IPs {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/utils"
+)
+
+func TestSharedURLsAndListenAddrsFollowInterfaces(t *testing.T) {
+	cachedInterfacesLock.Lock()
+	cachedInterfaces = []utils.Interface{
+		{Name: "eth0", IPs: []string{"192.168.1.10", "fd00::10"}},
+		{Name: "wlan0", IPs: []string{"10.20.0.5"}},
+	}
+	cachedInterfacesAt = time.Now()
+	cachedInterfacesLock.Unlock()
+	defer func() {
+		cachedInterfacesLock.Lock()
+		cachedInterfaces = nil
+		cachedInterfacesLock.Unlock()
+	}()
+
+	p := &models.SharedProxy{RemotePort: 10100, Path: "/app"}
+
+	if addrs := listenAddrs(p); !slices.Equal(addrs, []string{":10100"}) {
+		t.Errorf("Expected wildcard listener, got %v", addrs)
+	}
+	if urls := SharedURLs(p); len(urls) != 3 {
+		t.Errorf("Expected 3 shared URLs on all interfaces, got %v", urls)
+	}
+
+	p.Settings.Interfaces = []string{"eth0"}
+	expectedAddrs := []string{"192.168.1.10:10100", "[fd00::10]:10100"}
+	if addrs := listenAddrs(p); !slices.Equal(addrs, expectedAddrs) {
+		t.Errorf("Expected %v, got %v", expectedAddrs, addrs)
+	}
+	urls := SharedURLs(p)
+	if len(urls) != 2 || urls[1].URL != "http://[fd00::10]:10100/app" || urls[1].Interface != "eth0" {
+		t.Errorf("Unexpected shared URLs: %+v", urls)
+	}
+}
+
+func TestStartListenerReportsListenErrors(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer taken.Close()
+
+	p := &models.SharedProxy{OriginalURL: "http://10.0.0.5", RemotePort: taken.Addr().(*net.TCPAddr).Port}
+	if err := startListener(p, http.NotFoundHandler()); err == nil {
+		t.Errorf("Expected an error when the port is taken")
+	}
+	if len(p.ListenErrors) != 1 {
+		t.Errorf("Expected the failed address in ListenErrors, got %v", p.ListenErrors)
+	}
+}
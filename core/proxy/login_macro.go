@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/cache"
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+	"github.com/soda92/vpn-share-tool/core/vault"
+)
+
+// AutoLoginCookieName marks a consumer that opted in to the proxy's login macro. Its value
+// identifies the consumer. The macro never runs without it.
+const AutoLoginCookieName = "vst_auto_login"
+
+// loginMacroPath is served by the proxy itself: it runs the login macro for opted-in consumers
+// and asks the others to opt in.
+const loginMacroPath = "/_proxy/login"
+
+// loginMacroCooldown stops redirects to the login page from re-running the macro in a loop when
+// the upstream keeps rejecting the session it created.
+const loginMacroCooldown = 30 * time.Second
+
+const (
+	defaultLoginAttempts = 3
+	maxLoginResponseSize = 4 << 20
+)
+
+var (
+	lastLoginMacro     = map[string]time.Time{} // Consumer -> last macro run
+	lastLoginMacroLock sync.Mutex
+)
+
+// loginMacro returns the proxy's enabled login macro, or nil.
+func loginMacro(p *models.SharedProxy) *models.LoginMacro {
+	p.Mu.RLock()
+	defer p.Mu.RUnlock()
+	if m := p.Settings.LoginMacro; m != nil && m.Enabled && m.LoginPath != "" {
+		macro := *m
+		return &macro
+	}
+	return nil
+}
+
+// autoLoginConsumer returns the consumer's opt-in cookie value, or "" if it did not opt in.
+// The cookie is stripped so it is never forwarded upstream.
+func autoLoginConsumer(r *http.Request) string {
+	c, err := r.Cookie(AutoLoginCookieName)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	removeCookie(r, AutoLoginCookieName)
+	return c.Value
+}
+
+// markLoginMacroRun records that the macro ran for a consumer.
+func markLoginMacroRun(consumer string) {
+	lastLoginMacroLock.Lock()
+	defer lastLoginMacroLock.Unlock()
+	now := time.Now()
+	for c, t := range lastLoginMacro {
+		if now.Sub(t) >= loginMacroCooldown {
+			delete(lastLoginMacro, c)
+		}
+	}
+	lastLoginMacro[consumer] = now
+}
+
+func recentLoginMacroRun(consumer string) bool {
+	lastLoginMacroLock.Lock()
+	defer lastLoginMacroLock.Unlock()
+	t, ok := lastLoginMacro[consumer]
+	return ok && time.Since(t) < loginMacroCooldown
+}
+
+// redirectToLoginMacro sends opted-in consumers the upstream redirects to its login page to
+// the login macro instead, which brings them back to the page they asked for.
+func redirectToLoginMacro(resp *http.Response, p *models.SharedProxy, target *url.URL) {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 || resp.Request.Method != http.MethodGet {
+		return
+	}
+	consumer, _ := resp.Request.Context().Value(models.AutoLoginKey).(string)
+	if consumer == "" || recentLoginMacroRun(consumer) {
+		return
+	}
+	macro := loginMacro(p)
+	if macro == nil {
+		return
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	loc, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return
+	}
+	loginURL, err := target.Parse(macro.LoginPath)
+	if err != nil || pipeline.HostKey(loc) != pipeline.HostKey(loginURL) || loc.Path != loginURL.Path {
+		return
+	}
+
+	next := resp.Request.URL.RequestURI()
+	resp.Header.Set("Location", loginMacroPath+"?next="+url.QueryEscape(next))
+	log.Printf("Redirecting opted-in consumer to the login macro of %s (next: %s)", p.OriginalURL, next)
+}
+
+// serveLoginMacro handles loginMacroPath. Consumers that opted in are logged in and sent on to
+// ?next=; the others get a page asking them to opt in. POSTing auto=on or auto=off sets or
+// clears the opt-in cookie.
+func serveLoginMacro(w http.ResponseWriter, r *http.Request, p *models.SharedProxy, upstream http.RoundTripper, target *url.URL) {
+	macro := loginMacro(p)
+	if macro == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	consumer, _ := r.Context().Value(models.AutoLoginKey).(string)
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	if r.Method == http.MethodPost {
+		if !sameOrigin(r) {
+			http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		switch r.FormValue("auto") {
+		case "off":
+			http.SetCookie(w, &http.Cookie{Name: AutoLoginCookieName, Value: "", Path: "/", MaxAge: -1})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		case "on":
+			if consumer == "" {
+				buf := make([]byte, 16)
+				if _, err := rand.Read(buf); err != nil {
+					http.Error(w, "Failed to create consumer ID", http.StatusInternalServerError)
+					return
+				}
+				consumer = hex.EncodeToString(buf)
+				http.SetCookie(w, &http.Cookie{
+					Name:     AutoLoginCookieName,
+					Value:    consumer,
+					Path:     "/",
+					MaxAge:   30 * 24 * 3600,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+		}
+	}
+
+	if consumer == "" {
+		username := ""
+		if cred, err := vault.Get(macro.Credential); err == nil {
+			username = cred.Username
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginMacroPages.ExecuteTemplate(w, "optin", map[string]string{
+			"Upstream": target.Host,
+			"Username": username,
+			"Next":     next,
+		})
+		return
+	}
+
+	markLoginMacroRun(consumer)
+	setCookies, err := runLoginMacro(r.Context(), p, upstream, target, *macro, "login:"+consumer, r.Cookies(), r.UserAgent())
+	// Upstream cookies are passed through as the reverse proxy does for normal responses
+	for _, c := range setCookies {
+		w.Header().Add("Set-Cookie", c)
+	}
+	if err != nil {
+		log.Printf("Login macro for %s failed: %v", p.OriginalURL, err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		loginMacroPages.ExecuteTemplate(w, "failed", map[string]string{
+			"Upstream":  target.Host,
+			"Error":     err.Error(),
+			"LoginPath": macro.LoginPath,
+			"Next":      next,
+		})
+		return
+	}
+	log.Printf("Login macro for %s succeeded", p.OriginalURL)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a POST came from a page served by this proxy, so other sites
+// cannot opt consumers in.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return err == nil && source != "" && u.Host == r.Host
+}
+
+var loginMacroPages = template.Must(template.New("optin").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Automatic login</title></head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 3rem auto">
+<h3>Log in to {{.Upstream}} automatically?</h3>
+<p>This proxy can log you in{{if .Username}} as <b>{{.Username}}</b>{{end}} with stored credentials,
+now and whenever the site asks you to log in again. It is only done in this browser, until you turn it off.</p>
+<form method="post">
+<input type="hidden" name="next" value="{{.Next}}">
+<button name="auto" value="on">Log in automatically</button>
+<a href="{{.Next}}" style="margin-left: 1rem">No, thanks</a>
+</form>
+</body></html>
+{{define "failed"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Automatic login failed</title></head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 3rem auto">
+<h3>Automatic login to {{.Upstream}} failed</h3>
+<p>{{.Error}}</p>
+<p><a href="{{.LoginPath}}">Log in manually</a></p>
+<form method="post">
+<input type="hidden" name="next" value="{{.LoginPath}}">
+<button name="auto" value="off">Turn off automatic login</button>
+</form>
+</body></html>{{end}}`))
+
+// loginClient runs a login against the upstream with its own copy of the consumer's cookies,
+// collecting the Set-Cookie headers the consumer must receive.
+type loginClient struct {
+	transport  http.RoundTripper
+	target     *url.URL
+	userAgent  string
+	cookies    map[string]string
+	order      []string
+	setCookies []string
+}
+
+type loginResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (c *loginClient) do(ctx context.Context, method, path string, form url.Values) (*loginResponse, error) {
+	u, err := c.target.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = c.target.Host
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", c.target.Scheme+"://"+c.target.Host)
+		req.Header.Set("Referer", u.String())
+	}
+	var pairs []string
+	for _, name := range c.order {
+		if value, ok := c.cookies[name]; ok {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	if len(pairs) > 0 {
+		req.Header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLoginResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	c.setCookies = append(c.setCookies, resp.Header.Values("Set-Cookie")...)
+	for _, cookie := range resp.Cookies() {
+		c.setCookie(cookie.Name, cookie.Value, cookie.MaxAge < 0 || cookie.Value == "")
+	}
+	return &loginResponse{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+func (c *loginClient) setCookie(name, value string, remove bool) {
+	if remove {
+		delete(c.cookies, name)
+		return
+	}
+	if _, ok := c.cookies[name]; !ok {
+		c.order = append(c.order, name)
+	}
+	c.cookies[name] = value
+}
+
+// runLoginMacro logs in to the upstream with the macro's stored credential, solving the
+// captcha if it has one and retrying with a fresh one up to MaxAttempts times. The credential
+// is only sent to the upstream host it was stored for. It returns the Set-Cookie headers to
+// relay to the consumer, whose upstream cookies it starts from.
+func runLoginMacro(ctx context.Context, p *models.SharedProxy, upstream http.RoundTripper, target *url.URL, macro models.LoginMacro, session string, cookies []*http.Cookie, userAgent string) ([]string, error) {
+	cred, err := vault.Get(macro.Credential)
+	if err != nil {
+		return nil, err
+	}
+	if !cred.AllowsHost(target.Host) {
+		return nil, fmt.Errorf("credential %q may not be sent to %s", macro.Credential, target.Host)
+	}
+
+	profile := config.CaptchaProfile{Name: macro.CaptchaProfile}
+	for _, candidate := range config.Get().Captcha.Profiles {
+		if candidate.Name == macro.CaptchaProfile {
+			profile = candidate
+			break
+		}
+	}
+	submitPath := macro.SubmitPath
+	if submitPath == "" {
+		submitPath = macro.LoginPath
+	}
+	attempts := macro.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultLoginAttempts
+	}
+
+	client := &loginClient{transport: upstream, target: target, userAgent: userAgent, cookies: map[string]string{}}
+	for _, c := range cookies {
+		client.setCookie(c.Name, c.Value, false)
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		page, err := client.do(ctx, http.MethodGet, macro.LoginPath, nil)
+		if err != nil {
+			return client.setCookies, fmt.Errorf("loading login page: %w", err)
+		}
+		text, _ := cache.DecodeText(page.header.Get("Content-Type"), page.body)
+		form := hiddenInputs(text)
+
+		solution := ""
+		if macro.CaptchaPath != "" {
+			img, err := client.do(ctx, http.MethodGet, macro.CaptchaPath, nil)
+			if err != nil {
+				return client.setCookies, fmt.Errorf("loading captcha: %w", err)
+			}
+			if solution = SolveCaptcha(ctx, p, session, profile, img.body); solution == "" {
+				log.Printf("Login macro for %s: captcha not solved (attempt %d/%d)", p.OriginalURL, attempt, attempts)
+				continue
+			}
+		}
+
+		replacer := strings.NewReplacer("{username}", cred.Username, "{password}", cred.Password, "{captcha}", solution)
+		for name, value := range macro.Fields {
+			form.Set(name, replacer.Replace(value))
+		}
+		resp, err := client.do(ctx, http.MethodPost, submitPath, form)
+		if err != nil {
+			return client.setCookies, fmt.Errorf("submitting login: %w", err)
+		}
+		text, _ = cache.DecodeText(resp.header.Get("Content-Type"), resp.body)
+		accepted := pipeline.LoginAccepted(macro.Failure, macro.Success, resp.status, resp.header, text)
+		if solution != "" {
+			CaptchaLoginResult(session, accepted)
+		}
+		if accepted {
+			return client.setCookies, nil
+		}
+		log.Printf("Login macro for %s: login rejected (attempt %d/%d)", p.OriginalURL, attempt, attempts)
+	}
+	return client.setCookies, fmt.Errorf("the site rejected the login %d times", attempts)
+}
+
+var (
+	reInputTag  = regexp.MustCompile(`(?i)<input\b[^>]*>`)
+	reAttribute = regexp.MustCompile(`(?i)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// hiddenInputs returns the hidden inputs of a page, such as CSRF tokens the login form needs.
+func hiddenInputs(page string) url.Values {
+	form := url.Values{}
+	for _, tag := range reInputTag.FindAllString(page, -1) {
+		attrs := map[string]string{}
+		for _, m := range reAttribute.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+		}
+		if strings.EqualFold(attrs["type"], "hidden") && attrs["name"] != "" {
+			form.Set(attrs["name"], attrs["value"])
+		}
+	}
+	return form
+}
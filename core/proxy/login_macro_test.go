@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/vault"
+)
+
+// newLoginSite serves a login page with a CSRF token and a captcha tied to the upstream
+// session, accepting only the expected form.
+func newLoginSite(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "s1", Path: "/"})
+			io.WriteString(w, `<form><input type="hidden" name="csrf" value="tok&amp;1"><input name="user"></form>`)
+		case "/captcha":
+			if c, err := r.Cookie("JSESSIONID"); err != nil || c.Value != "s1" {
+				t.Errorf("Expected the captcha to be loaded in the login page's session")
+			}
+			w.Write([]byte("login-macro-captcha"))
+		case "/submit":
+			r.ParseForm()
+			if c, err := r.Cookie("other"); err != nil || c.Value != "1" {
+				t.Errorf("Expected the consumer's own cookies to be sent")
+			}
+			if r.Form.Get("user") != "doctor" || r.Form.Get("pass") != "pw" || r.Form.Get("code") != "ab12" || r.Form.Get("csrf") != "tok&1" {
+				io.WriteString(w, "login failed")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "ok", Path: "/"})
+			http.Redirect(w, r, "/index", http.StatusFound)
+		case "/solve":
+			io.WriteString(w, "ab12")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func setupLoginMacro(t *testing.T, site *httptest.Server) models.LoginMacro {
+	debug.DebugStoragePath = t.TempDir()
+	t.Cleanup(func() { debug.DebugStoragePath = "" })
+	original := config.Get()
+	t.Cleanup(func() { config.Set(original) })
+
+	cfg := config.Get()
+	cfg.Captcha.HTTPURL = site.URL + "/solve"
+	cfg.Captcha.HumanFallback = false
+	cfg.Captcha.Profiles = append(config.DefaultCaptchaProfiles(), config.CaptchaProfile{
+		Name:          "site",
+		ImagePattern:  `^/captcha$`,
+		InputSelector: "#code",
+		Backend:       "http",
+	})
+	if err := config.Set(cfg); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := vault.Set("site", vault.Credential{Username: "doctor", Password: "pw", Host: strings.TrimPrefix(site.URL, "http://")}); err != nil {
+		t.Fatalf("Failed to store credential: %v", err)
+	}
+
+	return models.LoginMacro{
+		Enabled:        true,
+		Credential:     "site",
+		LoginPath:      "/login",
+		SubmitPath:     "/submit",
+		Fields:         map[string]string{"user": "{username}", "pass": "{password}", "code": "{captcha}"},
+		CaptchaPath:    "/captcha",
+		CaptchaProfile: "site",
+		Success:        &config.LoginRule{Status: []int{http.StatusFound}},
+		MaxAttempts:    1,
+	}
+}
+
+func TestLoginMacroLogsIn(t *testing.T) {
+	site := newLoginSite(t)
+	defer site.Close()
+	macro := setupLoginMacro(t, site)
+	target, _ := url.Parse(site.URL)
+	p := &models.SharedProxy{OriginalURL: site.URL, Ctx: context.Background()}
+
+	cookies := []*http.Cookie{{Name: "other", Value: "1"}}
+	setCookies, err := runLoginMacro(context.Background(), p, http.DefaultTransport, target, macro, "login:c1", cookies, "test")
+	if err != nil {
+		t.Fatalf("Expected the login to succeed: %v", err)
+	}
+	joined := strings.Join(setCookies, "\n")
+	if !strings.Contains(joined, "JSESSIONID=s1") || !strings.Contains(joined, "auth=ok") {
+		t.Errorf("Expected the upstream session cookies to be relayed, got %v", setCookies)
+	}
+
+	macro.Fields["pass"] = "wrong"
+	if _, err := runLoginMacro(context.Background(), p, http.DefaultTransport, target, macro, "login:c1", cookies, "test"); err == nil {
+		t.Errorf("Expected a rejected login to fail")
+	}
+}
+
+func TestLoginMacroOnlySendsCredentialToItsHost(t *testing.T) {
+	site := newLoginSite(t)
+	defer site.Close()
+	macro := setupLoginMacro(t, site)
+
+	// A proxy for another host, e.g. one a consumer shared, must not receive the password
+	requests := 0
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer other.Close()
+	target, _ := url.Parse(other.URL)
+	p := &models.SharedProxy{OriginalURL: other.URL, Ctx: context.Background()}
+
+	if _, err := runLoginMacro(context.Background(), p, http.DefaultTransport, target, macro, "login:c1", nil, "test"); err == nil {
+		t.Errorf("Expected the macro to refuse a host the credential is not stored for")
+	}
+	if requests != 0 {
+		t.Errorf("Expected no request to the other host, got %d", requests)
+	}
+}
+
+func TestLoginMacroRequiresOptIn(t *testing.T) {
+	site := newLoginSite(t)
+	defer site.Close()
+	macro := setupLoginMacro(t, site)
+	target, _ := url.Parse(site.URL)
+	p := &models.SharedProxy{OriginalURL: site.URL, Ctx: context.Background()}
+	p.Settings.LoginMacro = &macro
+
+	serve := func(r *http.Request, consumer string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), models.AutoLoginKey, consumer))
+		serveLoginMacro(w, r, p, http.DefaultTransport, target)
+		return w
+	}
+
+	w := serve(httptest.NewRequest(http.MethodGet, "http://proxy:10100/_proxy/login?next=/private", nil), "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "doctor") || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected consumers without the cookie to be asked first, got %d %v", w.Code, w.Result().Cookies())
+	}
+
+	optIn := func(origin string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "http://proxy:10100/_proxy/login", strings.NewReader("auto=on&next=/private"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", origin)
+		r.AddCookie(&http.Cookie{Name: "other", Value: "1"})
+		return r
+	}
+	if w := serve(optIn("http://evil.example"), ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin opt-in to be rejected, got %d", w.Code)
+	}
+
+	w = serve(optIn("http://proxy:10100"), "")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/private" {
+		t.Fatalf("Expected a redirect to the requested page, got %d %s", w.Code, w.Body.String())
+	}
+	names := map[string]bool{}
+	for _, c := range w.Result().Cookies() {
+		names[c.Name] = true
+	}
+	if !names[AutoLoginCookieName] || !names["auth"] {
+		t.Errorf("Expected the opt-in and upstream session cookies, got %v", w.Result().Cookies())
+	}
+}
+
+func TestRedirectToLoginMacro(t *testing.T) {
+	target, _ := url.Parse("http://10.0.0.5")
+	p := &models.SharedProxy{OriginalURL: "http://10.0.0.5"}
+	p.Settings.LoginMacro = &models.LoginMacro{Enabled: true, LoginPath: "/phis/login.jsp"}
+
+	redirect := func(consumer string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://10.0.0.5/phis/app?id=1", nil)
+		req = req.WithContext(context.WithValue(req.Context(), models.AutoLoginKey, consumer))
+		resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{}, Request: req}
+		resp.Header.Set("Location", "http://10.0.0.5/phis/login.jsp?expired=1")
+		redirectToLoginMacro(resp, p, target)
+		return resp.Header.Get("Location")
+	}
+
+	if got := redirect(""); got != "http://10.0.0.5/phis/login.jsp?expired=1" {
+		t.Errorf("Expected consumers that did not opt in to reach the login page, got %s", got)
+	}
+	if got := redirect("c2"); got != "/_proxy/login?next=%2Fphis%2Fapp%3Fid%3D1" {
+		t.Errorf("Expected opted-in consumers to be sent to the macro, got %s", got)
+	}
+	markLoginMacroRun("c3")
+	if got := redirect("c3"); !strings.HasPrefix(got, "http://10.0.0.5/phis/login.jsp") {
+		t.Errorf("Expected no macro right after one ran, got %s", got)
+	}
+}
@@ -3,8 +3,12 @@ package proxy
 import (
 	"encoding/json"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"time"
 
 	"github.com/soda92/vpn-share-tool/core/debug"
 	"github.com/soda92/vpn-share-tool/core/models"
@@ -14,6 +18,9 @@ type ProxyConfigItem struct {
 	OriginalURL string               `json:"original_url"`
 	RemotePort  int                  `json:"remote_port"`
 	Settings    models.ProxySettings `json:"settings"`
+	AutoCreated bool                 `json:"auto_created,omitempty"`
+	Parent      string               `json:"parent,omitempty"`
+	LastAccess  time.Time            `json:"last_access,omitempty"`
 	// Legacy fields for migration
 	LegacyEnableDebug   bool `json:"enable_debug,omitempty"`
 	LegacyEnableCaptcha bool `json:"enable_captcha,omitempty"`
@@ -55,6 +62,9 @@ func SaveProxies() {
 			OriginalURL: p.OriginalURL,
 			RemotePort:  p.RemotePort,
 			Settings:    p.Settings,
+			AutoCreated: p.AutoCreated,
+			Parent:      p.Parent,
+			LastAccess:  p.LastAccessTime(),
 		})
 	}
 
@@ -69,6 +79,25 @@ func SaveProxies() {
 	}
 }
 
+// migrateSettings gives settings saved before a setting existed that setting's default
+// for new proxies, so restored and newly shared proxies behave the same.
+func migrateSettings(data []byte, config []ProxyConfigItem) {
+	var raw []struct {
+		Settings map[string]json.RawMessage `json:"settings"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) != len(config) {
+		return
+	}
+	for i, item := range raw {
+		if item.Settings == nil {
+			continue // Legacy items without settings are migrated in LoadProxies
+		}
+		if _, ok := item.Settings["enable_compression"]; !ok {
+			config[i].Settings.EnableCompression = true
+		}
+	}
+}
+
 func LoadProxies() {
 	file, err := getConfigFile()
 	if err != nil {
@@ -89,42 +118,59 @@ func LoadProxies() {
 		log.Printf("Failed to unmarshal proxy config: %v", err)
 		return
 	}
+	migrateSettings(data, config)
 
 	log.Printf("Loading %d proxies from config...", len(config))
 	for _, item := range config {
+		if !item.LastAccess.IsZero() {
+			saved := &models.SharedProxy{
+				Settings:    item.Settings,
+				AutoCreated: item.AutoCreated,
+				LastAccess:  item.LastAccess.UnixNano(),
+			}
+			if expiresAt := saved.ExpiresAt(); !expiresAt.IsZero() && time.Now().After(expiresAt) {
+				log.Printf("Not restoring proxy %s: idle since %s", item.OriginalURL, item.LastAccess.Format(time.RFC3339))
+				continue
+			}
+		}
+
 		log.Printf("Restoring proxy: %s -> :%d", item.OriginalURL, item.RemotePort)
-		// We use the new requestedPort parameter (0 for now, will update ShareUrlAndGetProxy next)
-		proxy, err := ShareUrlAndGetProxy(item.OriginalURL, item.RemotePort)
+		// Check if Settings is populated, otherwise try legacy
+		settings := item.Settings
+		if reflect.DeepEqual(item.Settings, models.ProxySettings{}) {
+			// Map legacy to new settings
+			settings = defaultSettings()
+			settings.EnableContentMod = item.LegacyEnableCaptcha || item.LegacyEnableDebug
+			settings.EnableDebugScript = item.LegacyEnableDebug
+			settings.EnableUrlRewrite = true // Default true
+		}
+
+		// Listen with the saved settings from the start, so a proxy restricted to some
+		// interfaces is never reachable on the others
+		proxy, err := shareURL(item.OriginalURL, item.RemotePort, nil, &settings)
 		if err != nil {
 			log.Printf("Failed to restore proxy for %s: %v", item.OriginalURL, err)
 			continue
 		}
 
-		// Restore settings
-		// Check if Settings is populated, otherwise try legacy
-		if item.Settings == (models.ProxySettings{}) {
-			// Zero value settings, check if we should migrate legacy
-			if item.LegacyEnableDebug {
-				// Legacy EnableDebug mapped to what? Maybe EnableContentMod?
-				// Since legacy debug script is controlled by EnableDebug flag in RunPipeline...
-				// But we removed EnableDebug from SharedProxy model!
-				// So we must map it to Settings.EnableContentMod? Or ignore it?
-				// The prompt said "Legacy Debug Script" is enabled by "EnableDebug" property in Settings? No.
-				// In RunPipeline:
-				/*
-					// 2. Debug Script (Legacy Flag)
-					if ctx.Proxy.GetEnableDebug() { ... }
-				*/
-				// But I removed GetEnableDebug() method and field!
-				// So RunPipeline is broken now. I need to fix it.
-			}
+		proxy.Mu.Lock()
+		proxy.AutoCreated = item.AutoCreated
+		proxy.Parent = item.Parent
+		proxy.Mu.Unlock()
+		if !item.LastAccess.IsZero() {
+			atomic.StoreInt64(&proxy.LastAccess, item.LastAccess.UnixNano())
+		}
+	}
 
-			// Map legacy to new settings
-			proxy.Settings.EnableContentMod = item.LegacyEnableCaptcha || item.LegacyEnableDebug
-			proxy.Settings.EnableDebugScript = item.LegacyEnableDebug
-			proxy.Settings.EnableUrlRewrite = true // Default true
-		} else {
-			proxy.Settings = item.Settings
+	// Forget the ports of proxies that were not restored
+	keep := make(map[string]bool)
+	for _, p := range GetProxies() {
+		if target, err := url.Parse(p.OriginalURL); err == nil {
+			keep[proxyIdentity(target)] = true
 		}
 	}
+	prunePortReservations(keep)
+
+	// Persist the restored settings and provenance
+	SaveProxies()
 }
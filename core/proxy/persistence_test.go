@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateSettingsEnablesCompression(t *testing.T) {
+	data := []byte(`[
+		{"original_url": "http://10.0.0.5", "settings": {"enable_content_mod": true}},
+		{"original_url": "http://10.0.0.6", "settings": {"enable_compression": false}}
+	]`)
+	var config []ProxyConfigItem
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	migrateSettings(data, config)
+
+	if !config[0].Settings.EnableCompression {
+		t.Errorf("Expected compression to default to on for settings saved without it")
+	}
+	if config[1].Settings.EnableCompression {
+		t.Errorf("Expected an explicit enable_compression=false to be kept")
+	}
+}
@@ -1,9 +1,40 @@
 package proxy
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+// portReservationTTL is how long the port of a proxy that is gone, e.g. after it expired, stays
+// reserved, so the URL gets its port back when it is shared again.
+var portReservationTTL = 30 * 24 * time.Hour
+
+// portReservation is the port reserved for a proxy identity.
+type portReservation struct {
+	Port int `json:"port"`
+	// LastUsed is when a proxy last had the port: when it was claimed, restored or removed.
+	LastUsed time.Time `json:"last_used"`
+}
+
+var (
+	// portReservations maps a proxy identity (scheme://host:port of the upstream) to the
+	// port it was last assigned, so that a URL keeps its port across restarts.
+	portReservations map[string]portReservation
+	// claimedPorts holds ports handed out by SelectAvailablePort whose proxy is not in
+	// Proxies yet.
+	claimedPorts             = make(map[int]bool)
+	portReservationsLock     sync.Mutex
+	savePortReservationsLock sync.Mutex
 )
 
 // isPortAvailable checks if a TCP port is available to be listened on.
@@ -17,57 +48,235 @@ func isPortAvailable(port int) bool {
 	return true
 }
 
-func SelectAvailablePort(requestedPort int, startPort int, proxiesCount int) (int, error) {
-	remotePort := 0
+// usedPorts returns the ports taken by our proxies and the API server.
+func usedPorts() map[int]bool {
+	used := map[int]bool{APIPort: true}
+	ProxiesLock.RLock()
+	defer ProxiesLock.RUnlock()
+	for _, p := range Proxies {
+		used[p.RemotePort] = true
+	}
+	return used
+}
 
-	// Try requested port first
-	if requestedPort > 0 {
-		isUsed := false
-		ProxiesLock.RLock()
-		for _, p := range Proxies {
-			if p.RemotePort == requestedPort {
-				isUsed = true
-				break
-			}
+// hashPort returns the preferred offset of identity within a range of the given size.
+func hashPort(identity string, size int) int {
+	h := fnv.New32a()
+	h.Write([]byte(identity))
+	return int(h.Sum32() % uint32(size))
+}
+
+// proxyIdentity returns the identity ports are reserved for: scheme://host:port of the upstream.
+func proxyIdentity(target *url.URL) string {
+	return target.Scheme + "://" + pipeline.HostKey(target)
+}
+
+// SelectAvailablePort picks the listening port for the proxy with the given identity.
+// In order of preference it uses the requested port, the port reserved for the identity,
+// and then probes the configured proxy port range starting at a position derived from a
+// hash of the identity, so the same URL tends to get the same port on every node.
+// The returned port stays claimed until releasePortClaim is called.
+func SelectAvailablePort(requestedPort int, identity string) (int, error) {
+	if requestedPort < 0 || requestedPort > 65535 {
+		return 0, fmt.Errorf("invalid port %d", requestedPort)
+	}
+
+	cfg := config.Get()
+	// Ports probed outside the locks; claimPort re-checks them before handing one out
+	for _, port := range portCandidates(requestedPort, identity, cfg) {
+		if isPortAvailable(port) && claimPort(identity, port) {
+			return port, nil
 		}
-		ProxiesLock.RUnlock()
+		if port == requestedPort {
+			log.Printf("Requested port %d is not available or in use, falling back to auto-selection.", requestedPort)
+		}
+	}
+	return 0, fmt.Errorf("could not find an available port in range %d-%d", cfg.ProxyPortRange.Start, cfg.ProxyPortRange.End)
+}
 
-		if !isUsed && isPortAvailable(requestedPort) {
-			remotePort = requestedPort
+// portCandidates lists the ports to try for identity in order of preference.
+func portCandidates(requestedPort int, identity string, cfg config.NodeConfig) []int {
+	used := usedPorts()
+
+	portReservationsLock.Lock()
+	defer portReservationsLock.Unlock()
+	loadPortReservations()
+
+	taken := func(port int) bool {
+		return used[port] || claimedPorts[port]
+	}
+	free := func(port int) bool {
+		return !taken(port) && !cfg.APIPortRange.Contains(port)
+	}
+
+	var candidates []int
+	// Requested and reserved ports are kept even outside the configured ranges, so proxies
+	// saved before the ranges changed keep their ports unless the API server has one
+	if requestedPort > 0 {
+		if !taken(requestedPort) {
+			candidates = append(candidates, requestedPort)
 		} else {
 			log.Printf("Requested port %d is not available or in use, falling back to auto-selection.", requestedPort)
 		}
 	}
+	if reserved, ok := portReservations[identity]; ok && reserved.Port != requestedPort {
+		if !taken(reserved.Port) {
+			candidates = append(candidates, reserved.Port)
+		} else {
+			log.Printf("Reserved port %d for %s is in use, selecting another.", reserved.Port, identity)
+		}
+	}
+
+	reservedByOthers := make(map[int]bool)
+	for id, reserved := range portReservations {
+		if id != identity {
+			reservedByOthers[reserved.Port] = true
+		}
+	}
+
+	// Other identities' reservations come last, so they are only taken if the range is
+	// otherwise exhausted
+	portRange := cfg.ProxyPortRange
+	size := portRange.Size()
+	offset := hashPort(identity, max(size, 1))
+	var others []int
+	for i := 0; i < size; i++ {
+		port := portRange.Start + (offset+i)%size
+		if !free(port) {
+			continue
+		}
+		if reservedByOthers[port] {
+			others = append(others, port)
+		} else {
+			candidates = append(candidates, port)
+		}
+	}
+	return append(candidates, others...)
+}
+
+// claimPort claims port for identity if no other proxy took it since the candidates were
+// listed, and records the reservation.
+func claimPort(identity string, port int) bool {
+	used := usedPorts()
+
+	portReservationsLock.Lock()
+	if used[port] || claimedPorts[port] {
+		portReservationsLock.Unlock()
+		return false
+	}
+	claimedPorts[port] = true
+	// A port belongs to a single identity
+	for id, reserved := range portReservations {
+		if reserved.Port == port && id != identity {
+			delete(portReservations, id)
+		}
+	}
+	portReservations[identity] = portReservation{Port: port, LastUsed: time.Now()}
+	portReservationsLock.Unlock()
 
-	if remotePort == 0 {
-		port := startPort
-		ProxiesLock.Lock()
-		defer ProxiesLock.Unlock()
-
-		for {
-			isUsed := false
-			for _, p := range Proxies {
-				if p.RemotePort == port {
-					isUsed = true
-					break
-				}
-			}
-			// Release lock temporarily to check port availability (avoid holding lock during system call)
-			// But wait, checking usage requires lock.
-			// We can check usage in memory quickly.
-			// isPortAvailable might take a few ms.
-			// It is safer to keep lock if we want to guarantee no race condition within our own app,
-			// but we can't guarantee other apps don't take it.
-
-			if !isUsed && isPortAvailable(port) {
-				remotePort = port
-				break
-			}
-			port++
-			if port > startPort+1000 {
-				return 0, fmt.Errorf("could not find an available port")
-			}
+	savePortReservations()
+	return true
+}
+
+// releasePortClaim releases a port returned by SelectAvailablePort once its proxy is in
+// Proxies (or was not created).
+func releasePortClaim(port int) {
+	portReservationsLock.Lock()
+	delete(claimedPorts, port)
+	portReservationsLock.Unlock()
+}
+
+// touchPortReservation records that identity's proxy had its port until now, e.g. when the
+// proxy is removed. The reservation is kept for portReservationTTL from then.
+func touchPortReservation(identity string) {
+	portReservationsLock.Lock()
+	loadPortReservations()
+	reserved, ok := portReservations[identity]
+	if ok {
+		reserved.LastUsed = time.Now()
+		portReservations[identity] = reserved
+	}
+	portReservationsLock.Unlock()
+
+	if ok {
+		savePortReservations()
+	}
+}
+
+// prunePortReservations refreshes the reservations of the identities in keep, which have a
+// proxy, and drops those of other identities unused for longer than portReservationTTL.
+func prunePortReservations(keep map[string]bool) {
+	now := time.Now()
+	portReservationsLock.Lock()
+	loadPortReservations()
+	for id, reserved := range portReservations {
+		switch {
+		case keep[id]:
+			reserved.LastUsed = now
+			portReservations[id] = reserved
+		case now.Sub(reserved.LastUsed) > portReservationTTL:
+			delete(portReservations, id)
 		}
 	}
-	return remotePort, nil
+	portReservationsLock.Unlock()
+
+	savePortReservations()
+}
+
+// loadPortReservations reads the reservation table on first use.
+// The caller must hold portReservationsLock.
+func loadPortReservations() {
+	if portReservations != nil {
+		return
+	}
+	portReservations = make(map[string]portReservation)
+
+	file, err := config.FilePath("port_reservations.json")
+	if err != nil {
+		log.Printf("Failed to get port reservations path: %v", err)
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read port reservations: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &portReservations); err == nil {
+		return
+	}
+	// Older versions saved bare ports; their reservations count as used now
+	var ports map[string]int
+	if err := json.Unmarshal(data, &ports); err != nil {
+		log.Printf("Failed to unmarshal port reservations: %v", err)
+		return
+	}
+	portReservations = make(map[string]portReservation, len(ports))
+	for id, port := range ports {
+		portReservations[id] = portReservation{Port: port, LastUsed: time.Now()}
+	}
+}
+
+// savePortReservations persists the table. The file is written outside portReservationsLock;
+// savePortReservationsLock keeps concurrent saves from writing an older snapshot last.
+func savePortReservations() {
+	savePortReservationsLock.Lock()
+	defer savePortReservationsLock.Unlock()
+
+	file, err := config.FilePath("port_reservations.json")
+	if err != nil {
+		log.Printf("Failed to get port reservations path: %v", err)
+		return
+	}
+	portReservationsLock.Lock()
+	data, err := json.MarshalIndent(portReservations, "", "  ")
+	portReservationsLock.Unlock()
+	if err != nil {
+		log.Printf("Failed to marshal port reservations: %v", err)
+		return
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		log.Printf("Failed to save port reservations: %v", err)
+	}
 }
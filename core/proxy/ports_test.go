@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+	"github.com/soda92/vpn-share-tool/core/debug"
+)
+
+func TestSelectAvailablePortIsDeterministic(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	portReservations = nil
+
+	first, err := SelectAvailablePort(0, "http://10.0.0.5:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+
+	// Simulate a restart: claims are gone and the table is reloaded from disk
+	releasePortClaim(first)
+	portReservations = nil
+	second, err := SelectAvailablePort(0, "http://10.0.0.5:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	if first != second {
+		t.Errorf("Expected the same port across restarts, got %d and %d", first, second)
+	}
+
+	other, err := SelectAvailablePort(0, "http://10.0.0.6:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	if other == first {
+		t.Errorf("Expected a different identity to get a different port, both got %d", first)
+	}
+	releasePortClaim(second)
+	releasePortClaim(other)
+}
+
+func TestSelectAvailablePortValidatesRequestedPort(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	portReservations = nil
+
+	if _, err := SelectAvailablePort(70000, "http://10.0.0.5:80"); err == nil {
+		t.Errorf("Expected an out-of-range requested port to be refused")
+	}
+
+	// Ports saved before the ranges changed may lie in the API port range; they are kept
+	// unless the API server has them
+	cfg := config.Get()
+	defer func(port int) { APIPort = port }(APIPort)
+	APIPort = cfg.APIPortRange.Start
+	saved := cfg.APIPortRange.Start + 1
+	port, err := SelectAvailablePort(saved, "http://10.0.0.5:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	releasePortClaim(port)
+	if port != saved {
+		t.Errorf("Expected saved port %d to be kept, got %d", saved, port)
+	}
+
+	port, err = SelectAvailablePort(APIPort, "http://10.0.0.6:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	defer releasePortClaim(port)
+	if !cfg.ProxyPortRange.Contains(port) {
+		t.Errorf("Expected the API port %d to move into the proxy range %+v, got %d", APIPort, cfg.ProxyPortRange, port)
+	}
+}
+
+func TestSelectAvailablePortClaimsPort(t *testing.T) {
+	debug.DebugStoragePath = t.TempDir()
+	defer func() { debug.DebugStoragePath = "" }()
+	portReservations = nil
+
+	first, err := SelectAvailablePort(0, "http://10.0.0.5:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	// Not in Proxies yet, but a second selection must not hand it out again
+	second, err := SelectAvailablePort(first, "http://10.0.0.6:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	releasePortClaim(first)
+	releasePortClaim(second)
+	if first == second {
+		t.Errorf("Expected a claimed port not to be selected twice, both got %d", first)
+	}
+
+	// The proxy of 10.0.0.5 is gone, but its port stays reserved until the TTL runs out
+	touchPortReservation("http://10.0.0.5:80")
+	prunePortReservations(map[string]bool{"http://10.0.0.6:80": true})
+	if !reservedPort("http://10.0.0.5:80") || !reservedPort("http://10.0.0.6:80") {
+		t.Errorf("Expected a recently removed proxy's port to stay reserved, got %v", portReservations)
+	}
+
+	defer func(ttl time.Duration) { portReservationTTL = ttl }(portReservationTTL)
+	portReservationTTL = 0
+	prunePortReservations(map[string]bool{"http://10.0.0.6:80": true})
+	if reservedPort("http://10.0.0.5:80") || !reservedPort("http://10.0.0.6:80") {
+		t.Errorf("Expected only the kept identity to remain reserved, got %v", portReservations)
+	}
+}
+
+// reservedPort reports whether identity has a port reserved, as saved to disk.
+func reservedPort(identity string) bool {
+	portReservationsLock.Lock()
+	defer portReservationsLock.Unlock()
+	portReservations = nil
+	loadPortReservations()
+	_, ok := portReservations[identity]
+	return ok
+}
+
+func TestLoadLegacyPortReservations(t *testing.T) {
+	dir := t.TempDir()
+	debug.DebugStoragePath = dir
+	defer func() { debug.DebugStoragePath = "" }()
+	portReservations = nil
+
+	if err := os.WriteFile(filepath.Join(dir, "port_reservations.json"), []byte(`{"http://10.0.0.5:80": 10082}`), 0644); err != nil {
+		t.Fatalf("Failed to write reservations: %v", err)
+	}
+	port, err := SelectAvailablePort(0, "http://10.0.0.5:80")
+	if err != nil {
+		t.Fatalf("SelectAvailablePort failed: %v", err)
+	}
+	defer releasePortClaim(port)
+	if port != 10082 {
+		t.Errorf("Expected the port saved by an older version, got %d", port)
+	}
+}
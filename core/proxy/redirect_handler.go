@@ -1,66 +1,69 @@
 package proxy
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
+	"regexp"
 
 	"github.com/soda92/vpn-share-tool/core/models"
+	"github.com/soda92/vpn-share-tool/core/pipeline"
 )
 
-func HandleRedirect(resp *http.Response, target *url.URL) error {
-	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
-		location := resp.Header.Get("Location")
-		if location == "" {
-			return nil // No Location header, nothing to do
-		}
+// reRefreshHeader matches the URL part of a "Refresh: 5; url=..." header.
+var reRefreshHeader = regexp.MustCompile(`(?i)(^\s*\d*\s*;\s*url\s*=\s*['"]?)([^'"\s]+)`)
 
-		locationURL, err := url.Parse(location)
-		if err != nil {
-			log.Printf("Error parsing Location header: %v", err)
-			return nil
-		}
-
-		if !locationURL.IsAbs() {
-			locationURL = target.ResolveReference(locationURL)
-		}
+// HandleRedirect rewrites the Location, Content-Location and Refresh headers so they point
+// back at the proxy serving the upstream host, preserving the scheme the consumer used.
+// Proxies created for new hosts are auto-created on behalf of parent.
+func HandleRedirect(resp *http.Response, parent *models.SharedProxy, target *url.URL) error {
+	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		rewriteHeaderURL(resp, parent, target, "Location")
+	}
+	rewriteHeaderURL(resp, parent, target, "Content-Location")
 
-		ProxiesLock.RLock()
-		var existingProxy *models.SharedProxy
-		for _, p := range Proxies {
-			if p.OriginalURL == locationURL.String() {
-				existingProxy = p
-				break
+	if refresh := resp.Header.Get("Refresh"); refresh != "" {
+		if m := reRefreshHeader.FindStringSubmatchIndex(refresh); m != nil {
+			if newURL, ok := rewriteUpstreamURL(resp, parent, target, refresh[m[4]:m[5]]); ok {
+				resp.Header.Set("Refresh", refresh[:m[4]]+newURL+refresh[m[5]:])
+				log.Printf("Rewrote Refresh header to: %s", newURL)
 			}
 		}
-		ProxiesLock.RUnlock()
+	}
+	return nil
+}
 
-		originalHost, ok := resp.Request.Context().Value(models.OriginalHostKey).(string)
-		if !ok {
-			log.Println("Error: could not retrieve originalHost from context or it's not a string")
-			return nil
-		}
-		hostParts := strings.Split(originalHost, ":")
-		proxyHost := hostParts[0]
+func rewriteHeaderURL(resp *http.Response, parent *models.SharedProxy, target *url.URL, header string) {
+	value := resp.Header.Get(header)
+	if value == "" {
+		return
+	}
+	if newURL, ok := rewriteUpstreamURL(resp, parent, target, value); ok {
+		resp.Header.Set(header, newURL)
+		log.Printf("Rewrote %s header: %s -> %s", header, value, newURL)
+	}
+}
 
-		if existingProxy != nil {
-			newLocation := fmt.Sprintf("http://%s:%d%s", proxyHost, existingProxy.RemotePort, locationURL.RequestURI())
-			resp.Header.Set("Location", newLocation)
-			log.Printf("Redirecting to existing proxy: %s", newLocation)
-		} else {
-			log.Printf("Redirect location not proxied, creating new proxy for: %s", locationURL.String())
-			// Recursively call ShareUrlAndGetProxy to create a new proxy
-			newProxy, err := ShareUrlAndGetProxy(locationURL.String(), 0)
-			if err != nil {
-				log.Printf("Error creating new proxy for redirect: %v", err)
-			} else {
-				newLocation := fmt.Sprintf("http://%s:%d%s", proxyHost, newProxy.RemotePort, locationURL.RequestURI())
-				resp.Header.Set("Location", newLocation)
-				log.Printf("Redirecting to new proxy: %s", newLocation)
-			}
-		}
+// rewriteUpstreamURL resolves raw against the upstream target and maps it onto a proxy.
+// Relative URLs are left untouched since the browser resolves them against the proxy itself.
+func rewriteUpstreamURL(resp *http.Response, parent *models.SharedProxy, target *url.URL, raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		log.Printf("Error parsing redirect URL %q: %v", raw, err)
+		return raw, false
 	}
-	return nil
+	if u.Host == "" {
+		return raw, false
+	}
+	// Fills in the scheme of protocol-relative URLs
+	u = target.ResolveReference(u)
+
+	services := models.PipelineServices{
+		MyIP:       MyIP,
+		GetProxies: GetProxies,
+		CreateProxy: func(u string, _ int) (*models.SharedProxy, error) {
+			return CreateAutoProxy(u, parent)
+		},
+	}
+	return pipeline.RewriteUpstreamURL(resp.Request.Context(), services, u.String())
 }
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/models"
+)
+
+func TestHandleRedirectOwnHostname(t *testing.T) {
+	p := &models.SharedProxy{OriginalURL: "http://his.hospital.local/app", RemotePort: 10081}
+	ProxiesLock.Lock()
+	saved := Proxies
+	Proxies = []*models.SharedProxy{p}
+	ProxiesLock.Unlock()
+	defer func() {
+		ProxiesLock.Lock()
+		Proxies = saved
+		ProxiesLock.Unlock()
+	}()
+
+	target, _ := url.Parse(p.OriginalURL)
+	req := httptest.NewRequest(http.MethodGet, "http://his.hospital.local/app/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), models.OriginalHostKey, "192.168.1.2:10081"))
+	resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{}, Request: req}
+	resp.Header.Set("Location", "http://his.hospital.local/app/login.jsp")
+	resp.Header.Set("Refresh", "0; url=http://his.hospital.local/app/home.jsp")
+
+	HandleRedirect(resp, p, target)
+	if got := resp.Header.Get("Location"); got != "http://192.168.1.2:10081/app/login.jsp" {
+		t.Errorf("Expected Location on the upstream's own hostname to be rewritten, got %s", got)
+	}
+	if got := resp.Header.Get("Refresh"); got != "0; url=http://192.168.1.2:10081/app/home.jsp" {
+		t.Errorf("Expected Refresh on the upstream's own hostname to be rewritten, got %s", got)
+	}
+}
@@ -3,30 +3,40 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/soda92/vpn-share-tool/core/accesslog"
 	"github.com/soda92/vpn-share-tool/core/cache"
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/models"
 	"github.com/soda92/vpn-share-tool/core/pipeline"
 )
 
-type captchaAdapter struct{}
-
-func (c *captchaAdapter) Solve(data []byte) string { return SolveCaptcha(data) }
-func (c *captchaAdapter) Store(ip, sol string)     { StoreCaptchaSolution(ip, sol) }
-func (c *captchaAdapter) Get(ip string) string     { return GetCaptchaSolution(ip) }
-func (c *captchaAdapter) Clear(ip string)          { ClearCaptchaSolution(ip) }
+type captchaAdapter struct {
+	proxy *models.SharedProxy
+}
 
-const (
-	startPort = 10081
-)
+func (c *captchaAdapter) Solve(ctx context.Context, session string, profile config.CaptchaProfile, data []byte) string {
+	return SolveCaptcha(ctx, c.proxy, session, profile, data)
+}
+func (c *captchaAdapter) Store(session, sol string) { StoreCaptchaSolution(session, sol) }
+func (c *captchaAdapter) Wait(ctx context.Context, session string) string {
+	return WaitCaptchaSolution(ctx, session)
+}
+func (c *captchaAdapter) Clear(session string) { ClearCaptchaSolution(session) }
+func (c *captchaAdapter) LoginResult(session string, correct bool) {
+	CaptchaLoginResult(session, correct)
+}
 
 var (
 	Proxies            []*models.SharedProxy
@@ -49,7 +59,7 @@ func SetGlobalConfig(ip string, port int, discoveryURL string, clientProvider fu
 
 // removeProxy shuts down a proxy server and removes it from the list.
 func removeProxy(p *models.SharedProxy) {
-	log.Printf("Removing proxy for unreachable URL: %s", p.OriginalURL)
+	log.Printf("Removing proxy: %s", p.OriginalURL)
 
 	// 0. Cancel the context to stop background tasks (Stats, HealthCheck)
 	if p.Cancel != nil {
@@ -75,6 +85,9 @@ func removeProxy(p *models.SharedProxy) {
 	}
 	Proxies = newProxies
 	ProxiesLock.Unlock()
+	if target, err := url.Parse(p.OriginalURL); err == nil {
+		touchPortReservation(proxyIdentity(target))
+	}
 
 	// 3. Signal the UI to update
 	ProxyRemovedChan <- p
@@ -83,7 +96,53 @@ func removeProxy(p *models.SharedProxy) {
 	SaveProxies()
 }
 
+// findProxyByHost returns the proxy whose upstream has the same host as target, if any.
+func findProxyByHost(target *url.URL) *models.SharedProxy {
+	key := pipeline.HostKey(target)
+	ProxiesLock.RLock()
+	defer ProxiesLock.RUnlock()
+	for _, p := range Proxies {
+		existingURL, err := url.Parse(p.OriginalURL)
+		if err != nil {
+			continue // Skip invalid stored URL
+		}
+		if pipeline.HostKey(existingURL) == key {
+			return p
+		}
+	}
+	return nil
+}
+
+// ShareUrlAndGetProxy shares rawURL on a new proxy, or returns the existing proxy for its host.
 func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy, error) {
+	p, err := shareURL(rawURL, requestedPort, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Explicitly shared by the user, so it is no longer subject to the auto-proxy policy
+	p.Mu.Lock()
+	wasAuto := p.AutoCreated
+	p.AutoCreated = false
+	p.Mu.Unlock()
+	if wasAuto {
+		SaveProxies()
+	}
+	return p, nil
+}
+
+// defaultSettings returns the settings of newly shared proxies.
+func defaultSettings() models.ProxySettings {
+	return models.ProxySettings{
+		EnableContentMod:  true,
+		EnableUrlRewrite:  true,
+		EnableCompression: true,
+	}
+}
+
+// shareURL creates the proxy for rawURL. A non-nil parent marks the proxy as auto-created.
+// The proxy starts listening with settings, or the defaults if nil.
+func shareURL(rawURL string, requestedPort int, parent *models.SharedProxy, settings *models.ProxySettings) (*models.SharedProxy, error) {
 	if rawURL == "" {
 		return nil, fmt.Errorf("URL cannot be empty")
 	}
@@ -100,22 +159,11 @@ func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy,
 		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
-	ProxiesLock.Lock()
-
-	// Prevent adding duplicate Proxies by checking inside the lock
-	host := target.Host
-	for _, p := range Proxies {
-		existingURL, err := url.Parse(p.OriginalURL)
-		if err != nil {
-			continue // Skip invalid stored URL
-		}
-		if existingURL.Host == host {
-			log.Printf("Proxy for %s already exists, returning existing one.", rawURL)
-			ProxiesLock.Unlock()
-			return p, nil
-		}
+	// Prevent adding duplicate Proxies; any path on the same host shares one proxy
+	if p := findProxyByHost(target); p != nil {
+		log.Printf("Proxy for %s already exists, returning existing one.", rawURL)
+		return p, nil
 	}
-	ProxiesLock.Unlock()
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
 	proxy.Director = func(req *http.Request) {
@@ -124,22 +172,7 @@ func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy,
 		req.Host = target.Host
 	}
 
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		// Inject CORS/PNA headers to allow access from private/local networks
-		reqOrigin := resp.Request.Header.Get("Origin")
-		if reqOrigin != "" {
-			resp.Header.Set("Access-Control-Allow-Origin", reqOrigin)
-			resp.Header.Set("Access-Control-Allow-Credentials", "true")
-			resp.Header.Add("Vary", "Origin")
-		} else {
-			resp.Header.Set("Access-Control-Allow-Origin", "*")
-		}
-		resp.Header.Set("Access-Control-Allow-Private-Network", "true")
-
-		return HandleRedirect(resp, target)
-	}
-
-	remotePort, err := SelectAvailablePort(requestedPort, startPort, len(Proxies))
+	remotePort, err := SelectAvailablePort(requestedPort, proxyIdentity(target))
 	if err != nil {
 		return nil, err
 	}
@@ -151,41 +184,34 @@ func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy,
 		RemotePort:  remotePort,
 		Path:        target.Path,
 		Handler:     proxy,
-		Settings: models.ProxySettings{
-			EnableContentMod: true,
-			EnableUrlRewrite: true,
-		},
-		Ctx:    ctx,
-		Cancel: cancel,
+		Settings:    defaultSettings(),
+		Ctx:         ctx,
+		Cancel:      cancel,
+		LastAccess:  time.Now().UnixNano(),
 	}
-	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", remotePort),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Handle CORS/PNA Preflight (OPTIONS)
-			if r.Method == "OPTIONS" {
-				origin := r.Header.Get("Origin")
-				if origin != "" {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					w.Header().Set("Access-Control-Allow-Credentials", "true")
-					w.Header().Add("Vary", "Origin")
-				} else {
-					w.Header().Set("Access-Control-Allow-Origin", "*")
-				}
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, HEAD, PATCH")
-				w.Header().Set("Access-Control-Allow-Headers", "*")
-				w.Header().Set("Access-Control-Allow-Private-Network", "true")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
+	if settings != nil {
+		newProxy.Settings = *settings
+	}
+	if parent != nil {
+		newProxy.AutoCreated = true
+		newProxy.Parent = parent.OriginalURL
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Inject CORS/PNA headers to allow access from private/local networks
+		reqOrigin := resp.Request.Header.Get("Origin")
+		if reqOrigin != "" {
+			resp.Header.Set("Access-Control-Allow-Origin", reqOrigin)
+			resp.Header.Set("Access-Control-Allow-Credentials", "true")
+			resp.Header.Add("Vary", "Origin")
+		} else {
+			resp.Header.Set("Access-Control-Allow-Origin", "*")
+		}
+		resp.Header.Set("Access-Control-Allow-Private-Network", "true")
 
-			// Update metrics
-			atomic.AddInt64(&newProxy.ReqCounter, 1)
-			atomic.AddInt64(&newProxy.TotalRequests, 1)
-			ctx := context.WithValue(r.Context(), models.OriginalHostKey, r.Host)
-			proxy.ServeHTTP(w, r.WithContext(ctx))
-		}),
+		redirectToLoginMacro(resp, newProxy, target)
+		return HandleRedirect(resp, newProxy, target)
 	}
-	newProxy.Server = server
 
 	// Use the global transport configuration if available
 	var baseTransport http.RoundTripper
@@ -194,32 +220,92 @@ func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy,
 			baseTransport = client.Transport
 		}
 	}
+	upstream := newProtocolTransport(baseTransport, newProxy)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := accesslog.NewResponseRecorder(w)
+		defer accesslog.Record(r, rec, start, newProxy)
+		w = rec
+
+		// Handle CORS/PNA Preflight (OPTIONS)
+		if r.Method == "OPTIONS" {
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Add("Vary", "Origin")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, HEAD, PATCH")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+			w.Header().Set("Access-Control-Allow-Private-Network", "true")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Update metrics
+		atomic.AddInt64(&newProxy.ReqCounter, 1)
+		atomic.AddInt64(&newProxy.TotalRequests, 1)
+		atomic.StoreInt64(&newProxy.LastAccess, time.Now().UnixNano())
+		newProxy.Protocols.RecordConsumer(r.Proto)
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		ctx := context.WithValue(r.Context(), models.OriginalHostKey, r.Host)
+		ctx = context.WithValue(ctx, models.OriginalSchemeKey, scheme)
+		newProxy.Mu.RLock()
+		contentMod := newProxy.Settings.EnableContentMod
+		newProxy.Mu.RUnlock()
+		if contentMod {
+			ctx = context.WithValue(ctx, models.CaptchaSessionKey, captchaSession(w, r))
+		}
+		ctx = context.WithValue(ctx, models.AutoLoginKey, autoLoginConsumer(r))
+
+		if r.URL.Path == loginMacroPath {
+			serveLoginMacro(rec, r.WithContext(ctx), newProxy, upstream, target)
+		} else {
+			proxy.ServeHTTP(rec, r.WithContext(ctx))
+		}
+	})
 
 	// Assign transport here to pass the newProxy reference
-	proxy.Transport = cache.NewCachingTransport(baseTransport, newProxy, &captchaAdapter{}, func(ctx *models.ProcessingContext, body string) string {
-		// Populate Services
-		ctx.Services = models.PipelineServices{
-			CreateProxy: ShareUrlAndGetProxy,
-			MyIP:        MyIP,
-			APIPort:     APIPort,
+	services := func() models.PipelineServices {
+		return models.PipelineServices{
+			CreateProxy: func(u string, _ int) (*models.SharedProxy, error) {
+				return CreateAutoProxy(u, newProxy)
+			},
+			GetProxies: GetProxies,
+			MyIP:       MyIP,
+			APIPort:    APIPort,
+			LocalIPs:   LocalIPs,
 		}
+	}
+	transport := cache.NewCachingTransport(upstream, newProxy, &captchaAdapter{proxy: newProxy}, func(ctx *models.ProcessingContext, body string) string {
+		ctx.Services = services()
 		return pipeline.RunPipeline(ctx, body)
 	})
+	transport.StreamProcessor = func(ctx *models.ProcessingContext, r io.Reader, w io.Writer) error {
+		ctx.Services = services()
+		return pipeline.RunStreamPipeline(ctx, r, w)
+	}
+	proxy.Transport = transport
 
-	go func() {
-		log.Printf("Starting proxy for %s on port %d", rawURL, remotePort)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("Proxy for %s on port %d stopped: %v", rawURL, remotePort, err)
-		}
-		log.Printf("Proxy for %s on port %d stopped gracefully.", rawURL, remotePort)
-	}()
+	if err := startListener(newProxy, handler); err != nil {
+		cancel()
+		releasePortClaim(remotePort)
+		return nil, err
+	}
 
 	go startHealthChecker(newProxy)
 	go startStatsUpdater(newProxy)
-	go StartSystemDetector(newProxy)
+	go StartSystemDetector(newProxy, upstream)
 	ProxiesLock.Lock()
 	Proxies = append(Proxies, newProxy)
 	ProxiesLock.Unlock()
+	releasePortClaim(remotePort)
 
 	ProxyAddedChan <- newProxy
 
@@ -228,7 +314,94 @@ func ShareUrlAndGetProxy(rawURL string, requestedPort int) (*models.SharedProxy,
 	return newProxy, nil
 }
 
+// startListener starts a server for the proxy's port with the consumer protocols and
+// interfaces from its settings. Addresses that fail to bind are kept in the proxy's
+// ListenErrors; an error is returned if it could bind none of them.
+func startListener(p *models.SharedProxy, handler http.Handler) error {
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", p.RemotePort),
+		Handler:   handler,
+		Protocols: consumerProtocols(p),
+	}
+
+	addrs := listenAddrs(p)
+	var listeners []net.Listener
+	var listenErrors []string
+	if len(addrs) == 0 {
+		log.Printf("Proxy for %s has no address on its selected interfaces; not listening", p.OriginalURL)
+		listenErrors = append(listenErrors, "no address on the selected interfaces")
+	}
+	for _, addr := range addrs {
+		log.Printf("Starting proxy for %s on %s", p.OriginalURL, addr)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Printf("Proxy for %s failed to listen on %s: %v", p.OriginalURL, addr, err)
+			listenErrors = append(listenErrors, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+		listeners = append(listeners, ln)
+	}
+
+	p.Mu.Lock()
+	p.Server = server
+	p.ListenErrors = listenErrors
+	p.Mu.Unlock()
+
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			addr := ln.Addr().String()
+			if err := server.Serve(ln); err != http.ErrServerClosed {
+				log.Printf("Proxy for %s on %s stopped: %v", p.OriginalURL, addr, err)
+			}
+			log.Printf("Proxy for %s on %s stopped gracefully.", p.OriginalURL, addr)
+		}(ln)
+	}
+	if len(addrs) > 0 && len(listeners) == 0 {
+		return fmt.Errorf("proxy for %s failed to listen: %s", p.OriginalURL, strings.Join(listenErrors, "; "))
+	}
+	return nil
+}
+
+// ApplySettings reacts to a change of a proxy's settings. Listeners are restarted when the
+// effective consumer protocols or the bound interfaces changed, since they are fixed when a
+// server starts.
+func ApplySettings(p *models.SharedProxy, old models.ProxySettings) {
+	p.Mu.RLock()
+	override := p.Settings.ConsumerHTTP2
+	interfaces := p.Settings.Interfaces
+	p.Mu.RUnlock()
+	nodeDefault := config.Get().HTTP2.Consumer
+	if http2Enabled(override, nodeDefault) == http2Enabled(old.ConsumerHTTP2, nodeDefault) &&
+		slices.Equal(interfaces, old.Interfaces) {
+		return
+	}
+	restartListener(p)
+}
+
+// restartListener replaces a proxy's server with a new one on the same port.
+func restartListener(p *models.SharedProxy) {
+	p.Mu.RLock()
+	old := p.Server
+	p.Mu.RUnlock()
+	if old == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := old.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down proxy server for restart: %v", err)
+	}
+	log.Printf("Restarting listener for %s on port %d", p.OriginalURL, p.RemotePort)
+	if err := startListener(p, old.Handler); err != nil {
+		log.Printf("Failed to restart listener: %v", err)
+	}
+}
+
 func Shutdown() {
+	// Persist last access times so idle expiry carries over restarts
+	SaveProxies()
+
 	ProxiesLock.Lock()
 	proxiesToShutdown := make([]*models.SharedProxy, len(Proxies))
 	copy(proxiesToShutdown, Proxies)
@@ -142,11 +142,11 @@ func discoverServers(myIP string, cfg Config) ([]string, string) {
 
 func connectToDiscoveryServer(ip string, cfg Config) (net.Conn, error) {
 	var serverAddr string
-	// If ip already has port, don't add it again
-	if strings.Contains(ip, ":") {
+	// If ip already has port, don't add it again. Bare IPv6 addresses also contain colons.
+	if _, _, err := net.SplitHostPort(ip); err == nil {
 		serverAddr = ip
 	} else {
-		serverAddr = net.JoinHostPort(ip, cfg.DiscoverySrvPort)
+		serverAddr = net.JoinHostPort(strings.Trim(ip, "[]"), cfg.DiscoverySrvPort)
 	}
 
 	log.Printf("Trying to connect to discovery server at %s...", serverAddr)
@@ -163,7 +163,7 @@ func connectToDiscoveryServer(ip string, cfg Config) (net.Conn, error) {
 		log.Printf("Connected to discovery server at %s (TLS)", serverAddr)
 		host, _, _ := net.SplitHostPort(serverAddr)
 		if cfg.UpdateDiscoveryURL != nil {
-			url := fmt.Sprintf("https://%s:8080", host)
+			url := "https://" + net.JoinHostPort(host, "8080")
 			cfg.UpdateDiscoveryURL(url)
 		}
 		return conn, nil
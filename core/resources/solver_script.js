@@ -1,58 +1,71 @@
 (function () {
-  var checkInterval;
+  // Selectors from the captcha profile, filled in by the proxy
+  var config = __CAPTCHA_CONFIG__;
+  var generation = 0;
+  var controller = null;
+
+  function fill(code) {
+    var input = document.querySelector(config.input);
+    if (!input) return;
+    input.value = code;
+    console.log('Auto-filled Captcha: ' + code);
+
+    var event = new Event('input', { bubbles: true });
+    input.dispatchEvent(event);
+  }
 
   function startPolling() {
-    if (checkInterval) clearInterval(checkInterval);
+    // Cancel the poll for the previous image
+    generation++;
+    if (controller) controller.abort();
+    controller = typeof AbortController !== 'undefined' ? new AbortController() : null;
 
-    var attempts = 0;
-    var maxAttempts = 60; // 30 seconds (60 * 500 ms)
+    var current = generation;
+    var signal = controller ? controller.signal : undefined;
+    var deadline = Date.now() + 300000; // Give up after 5 minutes (operators may answer late)
 
     // Reset input on polling start (new image)
-    var input = document.getElementById('verifyCode');
+    var input = document.querySelector(config.input);
     if (input) input.value = '';
 
-    checkInterval = setInterval(function () {
-      attempts++;
-      if (attempts > maxAttempts) {
-        clearInterval(checkInterval);
-        return;
-      }
+    function poll() {
+      if (current !== generation || Date.now() > deadline) return;
 
-      fetch('/_proxy/captcha-solution')
+      // The proxy holds the request until the solution is ready (long-poll), answering
+      // 204 if it timed out so we ask again.
+      fetch('/_proxy/captcha-solution', { credentials: 'same-origin', cache: 'no-store', signal: signal })
         .then(function (res) {
-          if (res.ok) return res.text();
-          throw new Error('Not ready');
+          if (res.status === 200) return res.text();
+          return null;
         })
         .then(function (code) {
-          // Check if input is empty (to avoid overwriting user edits if they started typing?)
-          // But if we just started polling, we cleared it.
-          if (code && code.trim() !== "") {
-            var input = document.getElementById('verifyCode');
-            if (input) {
-              input.value = code;
-              console.log('Auto-filled Captcha: ' + code);
-
-              var event = new Event('input', { bubbles: true });
-              input.dispatchEvent(event);
-
-              clearInterval(checkInterval);
-            }
+          if (current !== generation) return;
+          if (code && code.trim() !== '') {
+            fill(code.trim());
+            return;
           }
+          poll();
         })
-        .catch(function (e) { console.error('Captcha solution fetch error:', e); });
-    }, 500); // Poll faster
+        .catch(function (e) {
+          if (current !== generation) return;
+          console.error('Captcha solution fetch error:', e);
+          setTimeout(poll, 2000);
+        });
+    }
+    poll();
   }
 
   // Start on load
   startPolling();
 
-  // Restart on image click
-  var img = document.getElementById('img');
-  if (img) {
-    img.addEventListener('click', function () {
+  // Restart when the captcha is refreshed. The listener is delegated so it keeps working if
+  // the page re-renders the refresh element.
+  if (config.refresh) {
+    document.addEventListener('click', function (e) {
+      if (!e.target || !e.target.closest || !e.target.closest(config.refresh)) return;
       console.log('Captcha refreshed, restarting solver...');
       // Wait a bit for the new request to trigger
       setTimeout(startPolling, 500);
     });
   }
-})();
\ No newline at end of file
+})();
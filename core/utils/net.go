@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,20 +40,31 @@ func IsURLReachable(targetURL string) bool {
 	return true
 }
 
-// GetLocalIPs returns a list of local non-loopback IPv4 addresses.
-// It prefers 192.168.x.x, but returns others if found.
-func GetLocalIPs() ([]string, error) {
-	var ips []string
+// Interface is a network interface that is up and has usable (non-loopback) addresses.
+type Interface struct {
+	Name string   `json:"name"`
+	IPs  []string `json:"ips"`
+}
+
+// GetInterfaces returns the usable interfaces with their IPv4 addresses followed by global and
+// unique local IPv6 addresses. Link-local IPv6 addresses are skipped since they need a zone
+// to be usable in URLs.
+func GetInterfaces() ([]Interface, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
 
+	var result []Interface
 	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
 		addrs, err := i.Addrs()
 		if err != nil {
 			continue
 		}
+		var ipv4s, ipv6s []string
 		for _, addr := range addrs {
 			var ip net.IP
 			switch v := addr.(type) {
@@ -66,21 +78,42 @@ func GetLocalIPs() ([]string, error) {
 				continue
 			}
 
-			ip = ip.To4()
-			if ip == nil {
-				continue
+			if ip4 := ip.To4(); ip4 != nil {
+				ipv4s = append(ipv4s, ip4.String())
+			} else if ip.IsGlobalUnicast() {
+				ipv6s = append(ipv6s, ip.String())
 			}
+		}
+		if ips := append(ipv4s, ipv6s...); len(ips) > 0 {
+			result = append(result, Interface{Name: i.Name, IPs: ips})
+		}
+	}
+	return result, nil
+}
 
-			// Filter logic: We generally want private IPs.
-			// For now, we just collect all valid IPv4.
-			ips = append(ips, ip.String())
+// GetLocalIPs returns the addresses of all usable interfaces, IPv4 first so existing
+// heuristics (e.g. preferring 192.168.x.x) keep working.
+func GetLocalIPs() ([]string, error) {
+	ifaces, err := GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ipv4s, ipv6s []string
+	for _, i := range ifaces {
+		for _, ip := range i.IPs {
+			if strings.Contains(ip, ":") {
+				ipv6s = append(ipv6s, ip)
+			} else {
+				ipv4s = append(ipv4s, ip)
+			}
 		}
 	}
-	return ips, nil
+	return append(ipv4s, ipv6s...), nil
 }
 
 // ScanSubnet scans the /24 subnet of the given IP for a TCP service on the specified port.
-// It skips 10.x.x.x networks as requested.
+// It skips 10.x.x.x networks as requested. IPv6 subnets are far too large to sweep, so for
+// IPv6 addresses nothing is scanned and callers rely on cached and fallback servers.
 func ScanSubnet(localIP string, port string) []string {
 	ip := net.ParseIP(localIP)
 	if ip == nil {
@@ -88,6 +121,7 @@ func ScanSubnet(localIP string, port string) []string {
 	}
 	ip4 := ip.To4()
 	if ip4 == nil {
+		log.Printf("Skipping subnet scan for IPv6 address: %s", localIP)
 		return nil
 	}
 
@@ -0,0 +1,248 @@
+// Package vault keeps the credentials used by login macros in an encrypted file in the config
+// directory. Passwords are only ever decrypted to run a macro; listings show usernames only.
+//
+// The key is stored next to the vault, so the encryption only protects the vault on its own
+// (e.g. a copied vault.json or proxies.json). Anyone who can read the whole config directory
+// can decrypt it; protect the directory with file system permissions.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/config"
+)
+
+const (
+	vaultFile = "vault.json"
+	// keyFile holds the AES-256 key, written with mode 0600. It is in the same
+	// directory as vaultFile, so a copy of the whole directory includes both.
+	keyFile = "vault.key"
+)
+
+// Credential is a stored login.
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Host is the upstream host, with the port if the URL has one, that login macros may send
+	// the credential to.
+	Host string `json:"host"`
+}
+
+// AllowsHost reports whether the credential may be sent to the upstream host (host[:port]).
+// Credentials stored without a host are sent nowhere.
+func (c Credential) AllowsHost(host string) bool {
+	return c.Host != "" && strings.EqualFold(c.Host, host)
+}
+
+// Entry describes a stored credential without its password.
+type Entry struct {
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Host      string    `json:"host"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type storedCredential struct {
+	Credential
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// sealed is the on-disk form of the vault: the JSON of all credentials, AES-GCM encrypted.
+type sealed struct {
+	Nonce string `json:"nonce"`
+	Data  string `json:"data"`
+}
+
+var lock sync.Mutex
+
+// Get returns the credential stored under name.
+func Get(name string) (Credential, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	entries, err := load()
+	if err != nil {
+		return Credential{}, err
+	}
+	stored, ok := entries[name]
+	if !ok {
+		return Credential{}, fmt.Errorf("no credential named %q", name)
+	}
+	return stored.Credential, nil
+}
+
+// Set stores a credential under name, replacing any existing one.
+func Set(name string, cred Credential) error {
+	name = strings.TrimSpace(name)
+	cred.Host = strings.TrimSpace(cred.Host)
+	if name == "" || cred.Username == "" || cred.Host == "" {
+		return fmt.Errorf("name, username and host are required")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	entries, err := load()
+	if err != nil {
+		return err
+	}
+	entries[name] = storedCredential{Credential: cred, UpdatedAt: time.Now()}
+	return save(entries)
+}
+
+// Delete removes the credential stored under name.
+func Delete(name string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	entries, err := load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return fmt.Errorf("no credential named %q", name)
+	}
+	delete(entries, name)
+	return save(entries)
+}
+
+// List returns the stored credentials without passwords, sorted by name.
+func List() ([]Entry, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	entries, err := load()
+	if err != nil {
+		return nil, err
+	}
+	list := []Entry{}
+	for name, stored := range entries {
+		list = append(list, Entry{Name: name, Username: stored.Username, Host: stored.Host, UpdatedAt: stored.UpdatedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// key returns the vault key, generating it on first use.
+func key() ([]byte, error) {
+	path, err := config.FilePath(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		k, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(k) != 32 {
+			return nil, fmt.Errorf("invalid vault key in %s", path)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	k := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, k); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(k)), 0600); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	k, err := key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load decrypts the vault. Callers hold the lock.
+func load() (map[string]storedCredential, error) {
+	entries := map[string]storedCredential{}
+	path, err := config.FilePath(vaultFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+
+	var s sealed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("corrupt vault: %w", err)
+	}
+	nonce, err := hex.DecodeString(s.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt vault: %w", err)
+	}
+	ciphertext, err := hex.DecodeString(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt vault: %w", err)
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt vault: bad nonce")
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt vault (was %s replaced?): %w", keyFile, err)
+	}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("corrupt vault: %w", err)
+	}
+	return entries, nil
+}
+
+// save encrypts the vault with a fresh nonce. Callers hold the lock.
+func save(entries map[string]storedCredential) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sealed{
+		Nonce: hex.EncodeToString(nonce),
+		Data:  hex.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := config.FilePath(vaultFile)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash cannot leave a truncated vault
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
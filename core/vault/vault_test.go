@@ -0,0 +1,73 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soda92/vpn-share-tool/core/debug"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	debug.DebugStoragePath = dir
+	defer func() { debug.DebugStoragePath = "" }()
+
+	if err := Set("phis", Credential{Username: "doctor", Password: "s3cret-pass", Host: "10.0.0.5:8080"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := Set("erp", Credential{Username: "clerk", Password: "other", Host: "erp.local"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	cred, err := Get("phis")
+	if err != nil || cred.Username != "doctor" || cred.Password != "s3cret-pass" {
+		t.Fatalf("Expected the stored credential, got %+v, %v", cred, err)
+	}
+	if !cred.AllowsHost("10.0.0.5:8080") || cred.AllowsHost("10.0.0.5") || cred.AllowsHost("evil.example:8080") {
+		t.Errorf("Expected the credential to be allowed for its host only")
+	}
+	if err := Set("nohost", Credential{Username: "u", Password: "p"}); err == nil {
+		t.Errorf("Expected a credential without a host to be rejected")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, vaultFile))
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	if strings.Contains(string(data), "s3cret-pass") || strings.Contains(string(data), "doctor") {
+		t.Errorf("Expected the vault file to be encrypted, got %s", data)
+	}
+
+	list, err := List()
+	if err != nil || len(list) != 2 || list[0].Name != "erp" || list[1].Username != "doctor" {
+		t.Errorf("Expected both entries sorted by name, got %+v, %v", list, err)
+	}
+
+	if err := Delete("erp"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := Get("erp"); err == nil {
+		t.Errorf("Expected a deleted credential to be gone")
+	}
+	if err := Delete("erp"); err == nil {
+		t.Errorf("Expected deleting a missing credential to fail")
+	}
+}
+
+func TestVaultRejectsForeignKey(t *testing.T) {
+	dir := t.TempDir()
+	debug.DebugStoragePath = dir
+	defer func() { debug.DebugStoragePath = "" }()
+
+	if err := Set("phis", Credential{Username: "doctor", Password: "pw", Host: "10.0.0.5"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, keyFile)); err != nil {
+		t.Fatalf("Failed to remove key: %v", err)
+	}
+	if _, err := Get("phis"); err == nil {
+		t.Errorf("Expected a vault sealed with another key to be unreadable")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"embed"
+	"html"
 	"io/fs"
 	"log"
 	"math/big"
@@ -155,6 +156,36 @@ func main() {
 		w.Write([]byte("Form received"))
 	})
 
+	// GBK pages, to try the conversion of forms back to the upstream charset. The form page is
+	// stored in GBK; the save handler echoes what it received without decoding it, so the
+	// values only read correctly if they arrived in GBK.
+	http.HandleFunc("/gbk/form", func(w http.ResponseWriter, r *http.Request) {
+		page, err := fs.ReadFile(fsSub, "gbk/form.html")
+		if err != nil {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=GBK")
+		w.Write(page)
+	})
+
+	http.HandleFunc("/gbk/save", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Received GBK form submission: %q", r.Form)
+
+		w.Header().Set("Content-Type", "text/html; charset=GBK")
+		w.Write([]byte("<html><body><ul>"))
+		for _, key := range []string{"q", "name", "note"} {
+			if value := r.FormValue(key); value != "" {
+				w.Write([]byte("<li>" + key + ": " + html.EscapeString(value) + "</li>"))
+			}
+		}
+		w.Write([]byte("</ul><a href=\"/gbk/form\">Back</a></body></html>"))
+	})
+
 	// Main file server
 	http.Handle("/", http.FileServer(http.FS(fsSub)))
 
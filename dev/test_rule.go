@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+	"github.com/spf13/cobra"
+)
+
+var (
+	testRuleFile        string
+	testRuleName        string
+	testRuleURL         string
+	testRuleContentType string
+	testRuleStatus      int
+	testRuleSystems     []string
+)
+
+var testRuleCmd = &cobra.Command{
+	Use:   "test-rule <sample-body-file>",
+	Short: "Run content rules against a sample response body",
+	Long: `Runs the rules from a rules.json file against a sample body and prints the rewritten body.
+The rules that matched are listed on stderr.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runTestRule(args[0])
+	},
+}
+
+func init() {
+	testRuleCmd.Flags().StringVar(&testRuleFile, "rules", "rules.json", "File with the rules to test")
+	testRuleCmd.Flags().StringVar(&testRuleName, "rule", "", "Only test the rule with this name")
+	testRuleCmd.Flags().StringVar(&testRuleURL, "url", "/", "Request path and query of the sample")
+	testRuleCmd.Flags().StringVar(&testRuleContentType, "content-type", "text/html; charset=utf-8", "Content-Type of the sample")
+	testRuleCmd.Flags().IntVar(&testRuleStatus, "status", 200, "Status code of the sample")
+	testRuleCmd.Flags().StringSliceVar(&testRuleSystems, "system", nil, "Detected system IDs (repeatable)")
+	rootCmd.AddCommand(testRuleCmd)
+}
+
+func runTestRule(samplePath string) error {
+	data, err := os.ReadFile(testRuleFile)
+	if err != nil {
+		return err
+	}
+	var set pipeline.RuleSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parsing %s: %w", testRuleFile, err)
+	}
+	rules := set.Rules
+	if testRuleName != "" {
+		rules = nil
+		for _, rule := range set.Rules {
+			if rule.Name == testRuleName {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("no rule named %q in %s", testRuleName, testRuleFile)
+		}
+	}
+
+	sample, err := os.ReadFile(samplePath)
+	if err != nil {
+		return err
+	}
+	result, err := pipeline.TestRules(rules, pipeline.RuleSample{
+		URL:         testRuleURL,
+		ContentType: testRuleContentType,
+		Status:      testRuleStatus,
+		Systems:     testRuleSystems,
+		Body:        string(sample),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Matched rules: %v\n", result.Matched)
+	if result.Dropped {
+		fmt.Fprintln(os.Stderr, "Response dropped (204 No Content)")
+		return nil
+	}
+	fmt.Print(result.Body)
+	return nil
+}
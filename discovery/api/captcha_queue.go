@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/discovery/store"
+)
+
+const (
+	defaultCaptchaTaskTTL = 2 * time.Minute
+	maxCaptchaTaskTTL     = 10 * time.Minute
+	// captchaWaitTimeout is how long a node's wait request is held before it asks again.
+	captchaWaitTimeout = 25 * time.Second
+)
+
+// handleQueueCaptcha lets a node queue an image it could not solve confidently. The image is
+// the request body; node, upstream, profile, guess and ttl (seconds) are query parameters.
+func handleQueueCaptcha(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	image, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	if len(image) == 0 {
+		http.Error(w, "Empty body", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	ttl := defaultCaptchaTaskTTL
+	if seconds, err := strconv.Atoi(query.Get("ttl")); err == nil && seconds > 0 {
+		ttl = min(time.Duration(seconds)*time.Second, maxCaptchaTaskTTL)
+	}
+	node := query.Get("node")
+	if node == "" {
+		node = r.RemoteAddr
+	}
+
+	task, err := store.AddCaptchaTask(store.CaptchaTask{
+		Node:     node,
+		Upstream: query.Get("upstream"),
+		Profile:  query.Get("profile"),
+		Guess:    query.Get("guess"),
+	}, image, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleWaitCaptcha long-polls for the answer to a queued captcha. It returns the task once it
+// is solved or expired, or still pending after captchaWaitTimeout.
+func handleWaitCaptcha(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), captchaWaitTimeout)
+	defer cancel()
+	task, ok := store.WaitCaptchaTask(ctx, r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "Captcha not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleCancelCaptcha withdraws a queued captcha whose node no longer needs the answer.
+func handleCancelCaptcha(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := store.CancelCaptchaTask(r.URL.Query().Get("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCaptchaTasks lists the captchas waiting for an operator.
+func handleCaptchaTasks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(store.GetPendingCaptchaTasks()); err != nil {
+		http.Error(w, "Failed to encode captcha tasks", http.StatusInternalServerError)
+	}
+}
+
+// handleCaptchaTaskImage serves the image of a pending captcha.
+func handleCaptchaTaskImage(w http.ResponseWriter, r *http.Request) {
+	image, ok := store.GetCaptchaTaskImage(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "Captcha not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(image))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+// handleAnswerCaptcha stores an operator's answer. The operator is recorded in the audit log
+// along with the dashboard login and address it came from.
+func handleAnswerCaptcha(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID       string `json:"id"`
+		Solution string `json:"solution"`
+		Operator string `json:"operator"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	solution := strings.TrimSpace(req.Solution)
+	if req.ID == "" || solution == "" {
+		http.Error(w, "id and solution are required", http.StatusBadRequest)
+		return
+	}
+
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	operator := strings.TrimSpace(req.Operator)
+	if user, _, ok := r.BasicAuth(); ok && user != operator {
+		if operator == "" {
+			operator = user
+		} else {
+			operator += " (" + user + ")"
+		}
+	}
+	if operator == "" {
+		operator = remoteAddr
+	}
+
+	if err := store.AnswerCaptchaTask(req.ID, solution, operator, remoteAddr); err != nil {
+		if err.Error() == "not found" {
+			http.Error(w, "Captcha not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusConflict)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCaptchaAudit returns the most recent answered and expired captchas, newest first.
+func handleCaptchaAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	entries, err := store.GetCaptchaAudit(limit)
+	if err != nil {
+		log.Printf("Failed to read captcha audit log: %v", err)
+		http.Error(w, "Failed to read captcha audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
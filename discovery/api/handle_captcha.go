@@ -1,12 +1,18 @@
 package api
 
 import (
+	"encoding/json"
 	"io"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/soda92/vpn-share-tool/common"
 )
 
+// captchaSolver solves images posted by nodes with the local Python worker.
+var captchaSolver = common.NewSolverChain(30*time.Second, common.DefaultPythonWorker())
+
 // handleSolveCaptchaRequest receives an image and returns the solved text.
 func handleSolveCaptchaRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -26,6 +32,17 @@ func handleSolveCaptchaRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	solution := common.SolveCaptchaLocal(body)
+	solution, err := captchaSolver.Solve(body)
+	if err != nil {
+		log.Printf("Failed to solve captcha: %v", err)
+	}
 	w.Write([]byte(solution))
 }
+
+// handleCaptchaStats returns the per-backend stats of the discovery server's solver.
+func handleCaptchaStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(captchaSolver.Stats()); err != nil {
+		http.Error(w, "Failed to encode stats", http.StatusInternalServerError)
+	}
+}
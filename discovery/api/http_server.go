@@ -186,6 +186,12 @@ func StartHTTPServer(insecure bool) {
 	protectedMux.HandleFunc("/update-proxy-settings", HandleUpdateProxySettings)
 	protectedMux.HandleFunc("/trigger-update-remote", handleTriggerUpdateRemote)
 	protectedMux.HandleFunc("/logs", handleGetLogs)
+	protectedMux.HandleFunc("/captcha-stats", handleCaptchaStats)
+	protectedMux.HandleFunc("/captcha-tasks", handleCaptchaTasks)
+	protectedMux.HandleFunc("/captcha-tasks/image", handleCaptchaTaskImage)
+	protectedMux.HandleFunc("/captcha-tasks/answer", handleAnswerCaptcha)
+	protectedMux.HandleFunc("/captcha-audit", handleCaptchaAudit)
+	protectedMux.HandleFunc("/rules", handleRules)
 
 	// Serve the Vue frontend (Protected)
 	fsys, err := fs.Sub(frontendDist, "dist")
@@ -208,6 +214,9 @@ func StartHTTPServer(insecure bool) {
 	rootMux.HandleFunc("/latest-version", handleLatestVersion)
 	rootMux.Handle("/download/", http.StripPrefix("/download/", http.FileServer(http.Dir(SharePath))))
 	rootMux.HandleFunc("/solve-captcha", handleSolveCaptchaRequest)
+	rootMux.HandleFunc("/captcha-queue", handleQueueCaptcha)
+	rootMux.HandleFunc("/captcha-queue/wait", handleWaitCaptcha)
+	rootMux.HandleFunc("/captcha-queue/cancel", handleCancelCaptcha)
 	rootMux.HandleFunc("/upload-logs", handleUploadLogs)
 
 	// Delegate everything else to Protected Mux
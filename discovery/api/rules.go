@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+	"github.com/soda92/vpn-share-tool/discovery/registry"
+	"github.com/soda92/vpn-share-tool/discovery/store"
+)
+
+// handleRules returns the content rules on GET. POST replaces them and pushes them to every
+// connected node; the response lists the nodes that did not accept them.
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		set := store.GetRules()
+		if set == nil {
+			set = &pipeline.RuleSet{Rules: []pipeline.Rule{}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	case http.MethodPost:
+		var set pipeline.RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := pipeline.ValidateRules(set.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.SetRules(set); err != nil {
+			log.Printf("Failed to save rules: %v", err)
+			http.Error(w, "Failed to save rules", http.StatusInternalServerError)
+			return
+		}
+
+		failed := map[string]string{}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, instance := range registry.GetActiveInstances() {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				if err := pushRules(addr, set); err != nil {
+					mu.Lock()
+					failed[addr] = err.Error()
+					mu.Unlock()
+				}
+			}(instance.Address)
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"failed": failed})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pushRules sends the content rules to a node.
+func pushRules(addr string, set pipeline.RuleSet) error {
+	body, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(fmt.Sprintf("http://%s/rules", addr), "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to push rules to %s: %v", addr, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Node %s rejected rules: %s", addr, resp.Status)
+		return fmt.Errorf("node returned %s", resp.Status)
+	}
+	log.Printf("Pushed %d content rules to %s", len(set.Rules), addr)
+	return nil
+}
+
+// PushRulesToNewInstance brings a node that just registered up to date with the rules.
+func PushRulesToNewInstance(instance registry.Instance) {
+	if set := store.GetRules(); set != nil {
+		go pushRules(instance.Address, *set)
+	}
+}
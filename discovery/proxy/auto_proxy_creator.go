@@ -1,10 +1,16 @@
 package proxy
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"time"
 
+	"github.com/soda92/vpn-share-tool/core/models"
 	"github.com/soda92/vpn-share-tool/discovery/store"
+	"github.com/soda92/vpn-share-tool/discovery/utils"
 )
 
 func StartAutoProxyCreator() {
@@ -15,15 +21,56 @@ func StartAutoProxyCreator() {
 		log.Println("Running auto-proxy creator...")
 
 		urlsToCheck := store.GetTaggedURLs()
+		proxies, allProxies := FetchAllClusterProxies()
 
+		tagged := make(map[string]bool, len(urlsToCheck))
 		// This is a simplified version. A more robust implementation would be needed here.
-		// For now, we just log the intent.
 		for _, u := range urlsToCheck {
-			log.Printf("Auto-proxy check for: %s (%s)", u.Tag, u.URL)
-			// In a real implementation, you would get all active proxies,
-			// check if a proxy for u.URL exists, and if not, call the create-proxy logic.
+			tagged[utils.NormalizeHost(u.URL)] = true
+			p, ok := proxies[utils.NormalizeHost(u.URL)]
+			if !ok {
+				// In a real implementation, you would call the create-proxy logic here.
+				log.Printf("Auto-proxy check for: %s (%s): no proxy", u.Tag, u.URL)
+				continue
+			}
+
+			// Proxies backing a tagged URL must not expire on their node
+			if !p.Settings.Pinned {
+				setPinned(p, true)
+			}
+		}
+
+		// Release pins whose tagged URL was removed; pins set by hand are left alone
+		for _, p := range allProxies {
+			if p.Settings.Pinned && p.Settings.PinnedBy == models.PinnedByTaggedURL && !tagged[utils.NormalizeHost(p.OriginalURL)] {
+				setPinned(p, false)
+			}
 		}
 
 		time.Sleep(10 * time.Minute)
 	}
 }
+
+// setPinned pins or unpins the proxy on the node serving it. Only the pin is sent, so
+// settings changed on the node since the last poll are kept.
+func setPinned(p ProxyInfo, pinned bool) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"url":       p.OriginalURL,
+		"pinned":    pinned,
+		"pinned_by": models.PinnedByTaggedURL,
+	})
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(fmt.Sprintf("http://%s/update-settings", p.Instance), "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		log.Printf("Failed to set pinned=%v on proxy %s on %s: %v", pinned, p.OriginalURL, p.Instance, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		log.Printf("Set pinned=%v on tagged proxy %s on %s", pinned, p.OriginalURL, p.Instance)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,14 +16,24 @@ import (
 )
 
 type ProxyInfo struct {
-	OriginalURL   string               `json:"original_url"`
-	RemotePort    int                  `json:"remote_port"`
-	Path          string               `json:"path"`
-	SharedURL     string               `json:"shared_url"`
-	Settings      models.ProxySettings `json:"settings"`
-	ActiveSystems []string             `json:"active_systems"`
-	RequestRate   float64              `json:"request_rate"`
-	TotalRequests int64                `json:"total_requests"`
+	OriginalURL    string                  `json:"original_url"`
+	RemotePort     int                     `json:"remote_port"`
+	Path           string                  `json:"path"`
+	SharedURL      string                  `json:"shared_url"`
+	Settings       models.ProxySettings    `json:"settings"`
+	ActiveSystems  []string                `json:"active_systems"`
+	Systems        []models.DetectedSystem `json:"systems"`
+	ProcessorChain []models.ProcessorStep  `json:"processor_chain,omitempty"` // Effective content processors, in order
+	RequestRate    float64                 `json:"request_rate"`
+	TotalRequests  int64                   `json:"total_requests"`
+	AutoCreated    bool                    `json:"auto_created"`
+	Parent         string                  `json:"parent,omitempty"`
+	LastAccess     time.Time               `json:"last_access"`
+	ExpiresAt      *time.Time              `json:"expires_at,omitempty"`
+	Protocols      models.ProtocolCounts   `json:"protocols"`
+	SharedURLs     []models.InterfaceURL   `json:"shared_urls,omitempty"`   // Per-interface URLs reported by the node
+	ListenErrors   []string                `json:"listen_errors,omitempty"` // Addresses the node failed to listen on
+	Instance       string                  `json:"instance"`                // API address of the node serving the proxy
 }
 
 // FetchAllClusterProxies queries all active instances for their proxy lists.
@@ -51,8 +62,9 @@ func FetchAllClusterProxies() (map[string]ProxyInfo, []ProxyInfo) {
 					host, _, _ := net.SplitHostPort(inst.Address)
 					mu.Lock()
 					for _, p := range proxies {
-						sharedURL := fmt.Sprintf("http://%s:%d%s", host, p.RemotePort, p.Path)
+						sharedURL := "http://" + net.JoinHostPort(host, strconv.Itoa(p.RemotePort)) + p.Path
 						p.SharedURL = sharedURL // Enrich struct
+						p.Instance = inst.Address
 
 						rawList = append(rawList, p)
 
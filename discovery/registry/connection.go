@@ -61,12 +61,17 @@ func HandleConnection(conn net.Conn) {
 			instanceAddress = net.JoinHostPort(remoteAddr, apiPort)
 
 			mutex.Lock()
-			instances[instanceAddress] = Instance{
+			_, known := instances[instanceAddress]
+			instance := Instance{
 				Address:  instanceAddress,
 				Version:  version,
 				LastSeen: time.Now(),
 			}
+			instances[instanceAddress] = instance
 			mutex.Unlock()
+			if !known && OnRegister != nil {
+				OnRegister(instance)
+			}
 
 			log.Printf("Registered instance: %s (%s)", instanceAddress, version)
 			response = []byte(fmt.Sprintf("OK %s\n", remoteAddr))
@@ -12,6 +12,9 @@ type Instance struct {
 	LastSeen time.Time `json:"last_seen"`
 }
 
+// OnRegister is called when an instance registers that was not connected before.
+var OnRegister func(Instance)
+
 var (
 	cleanupInterval = 1 * time.Minute
 	staleTimeout    = 5 * time.Minute
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const captchaAuditFilePath = "captcha_audit.jsonl"
+
+// Captcha task states.
+const (
+	CaptchaPending = "pending"
+	CaptchaSolved  = "solved"
+	CaptchaExpired = "expired"
+	// CaptchaCancelled tasks were withdrawn by their node, e.g. because the page loaded a
+	// new captcha.
+	CaptchaCancelled = "cancelled"
+)
+
+// CaptchaTask is a captcha a node could not solve confidently, waiting for an operator.
+type CaptchaTask struct {
+	ID        string    `json:"id"`
+	Node      string    `json:"node"`     // API address of the node waiting for the answer
+	Upstream  string    `json:"upstream"` // Proxied site the captcha belongs to
+	Profile   string    `json:"profile"`
+	Guess     string    `json:"guess,omitempty"` // The solver's low-confidence answer, if any
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Status    string    `json:"status"`
+	Solution  string    `json:"solution,omitempty"`
+	SolvedBy  string    `json:"solved_by,omitempty"`
+	SolvedAt  time.Time `json:"solved_at,omitzero"`
+
+	image []byte
+	done  chan struct{} // Closed when the task is solved or expires
+}
+
+// CaptchaAuditEntry records how a task ended.
+type CaptchaAuditEntry struct {
+	Time       time.Time `json:"time"`
+	TaskID     string    `json:"task_id"`
+	Node       string    `json:"node"`
+	Upstream   string    `json:"upstream"`
+	Profile    string    `json:"profile"`
+	Guess      string    `json:"guess,omitempty"`
+	Status     string    `json:"status"`
+	Solution   string    `json:"solution,omitempty"`
+	SolvedBy   string    `json:"solved_by,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	WaitMs     int64     `json:"wait_ms"`
+}
+
+// maxPendingCaptchaTasks bounds the queue so a misbehaving node cannot flood operators.
+const maxPendingCaptchaTasks = 200
+
+// How long finished tasks stay around so the waiting node can still collect the result.
+const captchaTaskRetention = time.Minute
+
+var (
+	captchaTasks      = make(map[string]*CaptchaTask)
+	captchaTasksMutex = &sync.Mutex{}
+)
+
+// AddCaptchaTask queues an image for operators. The task expires after ttl.
+func AddCaptchaTask(task CaptchaTask, image []byte, ttl time.Duration) (CaptchaTask, error) {
+	now := time.Now()
+	task.ID = uuid.New().String()
+	task.CreatedAt = now
+	task.ExpiresAt = now.Add(ttl)
+	task.Status = CaptchaPending
+	task.image = image
+	task.done = make(chan struct{})
+
+	captchaTasksMutex.Lock()
+	expired := expireCaptchaTasks(now)
+	pending := 0
+	for _, t := range captchaTasks {
+		if t.Status == CaptchaPending {
+			pending++
+		}
+	}
+	full := pending >= maxPendingCaptchaTasks
+	if !full {
+		captchaTasks[task.ID] = &task
+	}
+	captchaTasksMutex.Unlock()
+	appendCaptchaAudit(expired...)
+
+	if full {
+		return CaptchaTask{}, fmt.Errorf("captcha queue is full")
+	}
+	log.Printf("Queued captcha %s from %s (%s) for operators", task.ID, task.Node, task.Upstream)
+	return task, nil
+}
+
+// GetPendingCaptchaTasks returns the tasks waiting for an answer, oldest first.
+func GetPendingCaptchaTasks() []CaptchaTask {
+	captchaTasksMutex.Lock()
+	expired := expireCaptchaTasks(time.Now())
+	tasks := []CaptchaTask{}
+	for _, t := range captchaTasks {
+		if t.Status == CaptchaPending {
+			tasks = append(tasks, *t)
+		}
+	}
+	captchaTasksMutex.Unlock()
+	appendCaptchaAudit(expired...)
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.Before(tasks[j].CreatedAt) })
+	return tasks
+}
+
+// GetCaptchaTaskImage returns the image of a pending task.
+func GetCaptchaTaskImage(id string) ([]byte, bool) {
+	captchaTasksMutex.Lock()
+	defer captchaTasksMutex.Unlock()
+	t, ok := captchaTasks[id]
+	if !ok || t.Status != CaptchaPending {
+		return nil, false
+	}
+	return t.image, true
+}
+
+// AnswerCaptchaTask stores an operator's answer and wakes the waiting node.
+func AnswerCaptchaTask(id, solution, operator, remoteAddr string) error {
+	if solution == "" {
+		return fmt.Errorf("solution is required")
+	}
+
+	captchaTasksMutex.Lock()
+	now := time.Now()
+	expired := expireCaptchaTasks(now)
+	t, ok := captchaTasks[id]
+	if !ok || t.Status != CaptchaPending {
+		err := fmt.Errorf("not found")
+		if ok {
+			err = fmt.Errorf("captcha already %s", t.Status)
+		}
+		captchaTasksMutex.Unlock()
+		appendCaptchaAudit(expired...)
+		return err
+	}
+	t.Status = CaptchaSolved
+	t.Solution = solution
+	t.SolvedBy = operator
+	t.SolvedAt = now
+	t.image = nil
+	close(t.done)
+	entry := auditEntry(t, now)
+	entry.RemoteAddr = remoteAddr
+	captchaTasksMutex.Unlock()
+
+	log.Printf("Captcha %s solved by %s", id, operator)
+	appendCaptchaAudit(append(expired, entry)...)
+	return nil
+}
+
+// CancelCaptchaTask withdraws a pending task, e.g. when its node no longer needs the answer.
+func CancelCaptchaTask(id string) error {
+	captchaTasksMutex.Lock()
+	now := time.Now()
+	expired := expireCaptchaTasks(now)
+	t, ok := captchaTasks[id]
+	if !ok || t.Status != CaptchaPending {
+		err := fmt.Errorf("not found")
+		if ok {
+			err = fmt.Errorf("captcha already %s", t.Status)
+		}
+		captchaTasksMutex.Unlock()
+		appendCaptchaAudit(expired...)
+		return err
+	}
+	t.Status = CaptchaCancelled
+	t.SolvedAt = now
+	t.image = nil
+	close(t.done)
+	entry := auditEntry(t, now)
+	captchaTasksMutex.Unlock()
+
+	log.Printf("Captcha %s cancelled by %s", id, entry.Node)
+	appendCaptchaAudit(append(expired, entry)...)
+	return nil
+}
+
+// WaitCaptchaTask blocks until the task is solved or expires, or ctx is done. It returns the
+// task as last seen and false if the task is unknown.
+func WaitCaptchaTask(ctx context.Context, id string) (CaptchaTask, bool) {
+	captchaTasksMutex.Lock()
+	expired := expireCaptchaTasks(time.Now())
+	t, ok := captchaTasks[id]
+	var done chan struct{}
+	var expiresAt time.Time
+	if ok {
+		done, expiresAt = t.done, t.ExpiresAt
+	}
+	captchaTasksMutex.Unlock()
+	appendCaptchaAudit(expired...)
+	if !ok {
+		return CaptchaTask{}, false
+	}
+
+	timer := time.NewTimer(time.Until(expiresAt))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	captchaTasksMutex.Lock()
+	expired = expireCaptchaTasks(time.Now())
+	task := *t
+	captchaTasksMutex.Unlock()
+	appendCaptchaAudit(expired...)
+	return task, true
+}
+
+// expireCaptchaTasks ends overdue tasks and forgets finished ones. Callers hold the mutex and
+// write the returned audit entries once they released it.
+func expireCaptchaTasks(now time.Time) []CaptchaAuditEntry {
+	var expired []CaptchaAuditEntry
+	for id, t := range captchaTasks {
+		switch {
+		case t.Status == CaptchaPending && !now.Before(t.ExpiresAt):
+			t.Status = CaptchaExpired
+			t.image = nil
+			close(t.done)
+			log.Printf("Captcha %s from %s expired unanswered", id, t.Node)
+			expired = append(expired, auditEntry(t, now))
+		case t.Status != CaptchaPending && now.Sub(t.ExpiresAt) > captchaTaskRetention && now.Sub(t.SolvedAt) > captchaTaskRetention:
+			delete(captchaTasks, id)
+		}
+	}
+	return expired
+}
+
+func auditEntry(t *CaptchaTask, now time.Time) CaptchaAuditEntry {
+	return CaptchaAuditEntry{
+		Time:     now,
+		TaskID:   t.ID,
+		Node:     t.Node,
+		Upstream: t.Upstream,
+		Profile:  t.Profile,
+		Guess:    t.Guess,
+		Status:   t.Status,
+		Solution: t.Solution,
+		SolvedBy: t.SolvedBy,
+		WaitMs:   now.Sub(t.CreatedAt).Milliseconds(),
+	}
+}
+
+var captchaAuditMutex = &sync.Mutex{}
+
+func appendCaptchaAudit(entries ...CaptchaAuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	captchaAuditMutex.Lock()
+	defer captchaAuditMutex.Unlock()
+
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		data = append(append(data, line...), '\n')
+	}
+	f, err := os.OpenFile(captchaAuditFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening captcha audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		log.Printf("Error writing captcha audit log: %v", err)
+	}
+}
+
+// GetCaptchaAudit returns up to limit of the most recent audit entries, newest first.
+func GetCaptchaAudit(limit int) ([]CaptchaAuditEntry, error) {
+	captchaAuditMutex.Lock()
+	defer captchaAuditMutex.Unlock()
+
+	entries := []CaptchaAuditEntry{}
+	f, err := os.Open(captchaAuditFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry CaptchaAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCaptchaTaskAnsweredByOperator(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	task, err := AddCaptchaTask(CaptchaTask{Node: "10.0.0.2:10081", Upstream: "http://10.0.0.5", Guess: "a?"}, []byte("img"), time.Minute)
+	if err != nil {
+		t.Fatalf("AddCaptchaTask failed: %v", err)
+	}
+	if pending := GetPendingCaptchaTasks(); len(pending) != 1 || pending[0].ID != task.ID {
+		t.Fatalf("Expected the task to be pending, got %+v", pending)
+	}
+
+	result := make(chan CaptchaTask)
+	go func() {
+		solved, _ := WaitCaptchaTask(context.Background(), task.ID)
+		result <- solved
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := AnswerCaptchaTask(task.ID, "ab12", "alice", "192.168.1.20"); err != nil {
+		t.Fatalf("AnswerCaptchaTask failed: %v", err)
+	}
+	if solved := <-result; solved.Status != CaptchaSolved || solved.Solution != "ab12" || solved.SolvedBy != "alice" {
+		t.Errorf("Expected the waiting node to get the answer, got %+v", solved)
+	}
+	if err := AnswerCaptchaTask(task.ID, "cd34", "bob", "192.168.1.21"); err == nil {
+		t.Errorf("Expected a second answer to be rejected")
+	}
+	if pending := GetPendingCaptchaTasks(); len(pending) != 0 {
+		t.Errorf("Expected no pending tasks, got %+v", pending)
+	}
+
+	audit, err := GetCaptchaAudit(10)
+	if err != nil {
+		t.Fatalf("GetCaptchaAudit failed: %v", err)
+	}
+	if len(audit) != 1 || audit[0].SolvedBy != "alice" || audit[0].RemoteAddr != "192.168.1.20" || audit[0].Solution != "ab12" {
+		t.Errorf("Expected the answer in the audit log, got %+v", audit)
+	}
+}
+
+func TestCaptchaTaskExpires(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	task, err := AddCaptchaTask(CaptchaTask{Node: "10.0.0.2:10081"}, []byte("img"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AddCaptchaTask failed: %v", err)
+	}
+	expired, ok := WaitCaptchaTask(context.Background(), task.ID)
+	if !ok || expired.Status != CaptchaExpired {
+		t.Errorf("Expected the task to expire, got %+v", expired)
+	}
+	if _, ok := GetCaptchaTaskImage(task.ID); ok {
+		t.Errorf("Expected the image of an expired task to be gone")
+	}
+	if err := AnswerCaptchaTask(task.ID, "ab12", "alice", ""); err == nil {
+		t.Errorf("Expected an answer to an expired task to be rejected")
+	}
+
+	audit, _ := GetCaptchaAudit(10)
+	if len(audit) != 1 || audit[0].Status != CaptchaExpired {
+		t.Errorf("Expected the expiry in the audit log, got %+v", audit)
+	}
+}
+
+func TestCaptchaTaskCancelled(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	task, err := AddCaptchaTask(CaptchaTask{Node: "10.0.0.2:10081"}, []byte("img"), time.Minute)
+	if err != nil {
+		t.Fatalf("AddCaptchaTask failed: %v", err)
+	}
+	if err := CancelCaptchaTask(task.ID); err != nil {
+		t.Fatalf("CancelCaptchaTask failed: %v", err)
+	}
+	if pending := GetPendingCaptchaTasks(); len(pending) != 0 {
+		t.Errorf("Expected no pending tasks, got %+v", pending)
+	}
+	if cancelled, ok := WaitCaptchaTask(context.Background(), task.ID); !ok || cancelled.Status != CaptchaCancelled {
+		t.Errorf("Expected the waiting node to see the cancellation, got %+v", cancelled)
+	}
+	if err := AnswerCaptchaTask(task.ID, "ab12", "alice", ""); err == nil {
+		t.Errorf("Expected an answer to a cancelled task to be rejected")
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/soda92/vpn-share-tool/core/pipeline"
+)
+
+const rulesFilePath = "rules.json"
+
+var (
+	rules      *pipeline.RuleSet // nil until rules are pushed, so nodes keep their local ones
+	rulesMutex = &sync.Mutex{}
+)
+
+// LoadRules reads the content rules pushed to nodes.
+func LoadRules() {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	data, err := os.ReadFile(rulesFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading rules file: %v", err)
+		}
+		return
+	}
+	var set pipeline.RuleSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		log.Printf("Error unmarshaling rules: %v", err)
+		return
+	}
+	rules = &set
+	log.Printf("Loaded %d content rules from %s", len(set.Rules), rulesFilePath)
+}
+
+// GetRules returns the content rules for nodes, or nil if none were set.
+func GetRules() *pipeline.RuleSet {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	return rules
+}
+
+// SetRules replaces the content rules for nodes.
+func SetRules(set pipeline.RuleSet) error {
+	if set.Rules == nil {
+		set.Rules = []pipeline.Rule{}
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	if err := os.WriteFile(rulesFilePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write rules file: %w", err)
+	}
+	rules = &set
+	return nil
+}
@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"fmt"
+	"net"
 	"net/url"
 	"strings"
 )
@@ -31,7 +31,11 @@ func NormalizeHost(u string) string {
 	}
 
 	if port != "" {
-		return fmt.Sprintf("%s:%s", host, port)
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		// Keep IPv6 literals bracketed so they can't be confused with host:port
+		return "[" + host + "]"
 	}
 	return host
 }
@@ -15,6 +15,7 @@ import (
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/soda92/vpn-share-tool/core"
+	"github.com/soda92/vpn-share-tool/core/config"
 	"github.com/soda92/vpn-share-tool/core/proxy"
 )
 
@@ -26,10 +27,6 @@ var versionFile string
 
 var Version = "dev"
 
-const (
-	startPort = 10081
-)
-
 func Run() {
 	// Setup Logging
 	setupLogging()
@@ -64,8 +61,10 @@ func Run() {
 		return nil
 	})
 
-	// Find an available port for the API server
-	apiPort, err := findAvailablePort(startPort)
+	// Find an available port for the API server. It has its own range so it
+	// cannot race the proxy listeners restored on startup.
+	config.Load()
+	apiPort, err := findAvailablePort(config.Get().APIPortRange)
 	if err != nil {
 		log.Fatalf("Failed to find available API port: %v", err)
 	}
@@ -116,7 +115,7 @@ func Run() {
 			}
 
 			// Print the shared URL to the console
-			sharedURL := fmt.Sprintf("http://%s:%d%s", ip, newProxy.RemotePort, newProxy.Path)
+			sharedURL := newProxy.SharedURL(ip)
 			log.Println("--- SHARED URL ---")
 			log.Println(sharedURL)
 			log.Println("------------------")
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -89,7 +91,7 @@ func (r *remoteWriter) send(logLines []string) {
 	// Prepare payload
 	address := core.MyIP
 	if core.APIPort != 0 {
-		address = fmt.Sprintf("%s:%d", core.MyIP, core.APIPort)
+		address = net.JoinHostPort(core.MyIP, strconv.Itoa(core.APIPort))
 	}
 
 	data := map[string]string{
@@ -3,11 +3,13 @@ package gui
 import (
 	"fmt"
 	"net"
+
+	"github.com/soda92/vpn-share-tool/core/config"
 )
 
-// findAvailablePort checks for an available TCP port starting from a given port.
-func findAvailablePort(startPort int) (int, error) {
-	for port := startPort; port < startPort+100; port++ { // Try up to 100 ports
+// findAvailablePort checks for an available TCP port in the given range.
+func findAvailablePort(portRange config.PortRange) (int, error) {
+	for port := portRange.Start; port <= portRange.End; port++ {
 		address := fmt.Sprintf(":%d", port)
 		ln, err := net.Listen("tcp", address)
 		if err == nil {
@@ -15,5 +17,5 @@ func findAvailablePort(startPort int) (int, error) {
 			return port, nil
 		}
 	}
-	return 0, fmt.Errorf("no available port found in range %d-%d", startPort, startPort+99)
+	return 0, fmt.Errorf("no available port found in range %d-%d", portRange.Start, portRange.End)
 }
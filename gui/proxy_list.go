@@ -1,8 +1,8 @@
 package gui
 
 import (
-	"fmt"
 	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/data/binding"
@@ -16,41 +16,64 @@ import (
 // Ideally we avoid globals. But sharedListData was local to Run.
 var sharedListData = binding.NewStringList()
 
-func addProxyToUI(newProxy *models.SharedProxy) {
-	fyne.Do(func() {
-		if core.MyIP != "" {
-			sharedURL := fmt.Sprintf("http://%s:%d%s", core.MyIP, newProxy.RemotePort, newProxy.Path)
-			displayString := l("sharedUrlFormat", map[string]interface{}{
-				"originalUrl": newProxy.OriginalURL,
-				"sharedUrl":   sharedURL,
-			})
-			sharedListData.Append(displayString)
-		}
+// proxyDisplayString formats a proxy for the list, including its last access and expiry.
+func proxyDisplayString(p *models.SharedProxy) string {
+	sharedURL := p.SharedURL(core.MyIP)
+	displayString := l("sharedUrlFormat", map[string]interface{}{
+		"originalUrl": p.OriginalURL,
+		"sharedUrl":   sharedURL,
 	})
+
+	lastAccess := p.LastAccessTime().Format("15:04")
+	if expiresAt := p.ExpiresAt(); !expiresAt.IsZero() {
+		displayString += "  " + l("proxyExpiryFormat", map[string]interface{}{
+			"lastAccess": lastAccess,
+			"expiresAt":  expiresAt.Format("01-02 15:04"),
+		})
+	} else {
+		displayString += "  " + l("proxyLastAccessFormat", map[string]interface{}{
+			"lastAccess": lastAccess,
+		})
+	}
+	return displayString
 }
 
-func removeProxyFromUI(p *models.SharedProxy) {
+// refreshProxyList rebuilds the list from the current proxies.
+func refreshProxyList() {
 	fyne.Do(func() {
-		currentList, _ := sharedListData.Get()
-		newList := []string{}
-		for _, item := range currentList {
-			if !strings.Contains(item, p.OriginalURL) {
-				newList = append(newList, item)
-			}
+		if core.MyIP == "" {
+			return
 		}
-		sharedListData.Set(newList)
+		items := []string{}
+		for _, p := range proxy.GetProxies() {
+			items = append(items, proxyDisplayString(p))
+		}
+		sharedListData.Set(items)
 	})
 }
 
+func addProxyToUI(newProxy *models.SharedProxy) {
+	refreshProxyList()
+}
+
+func removeProxyFromUI(p *models.SharedProxy) {
+	refreshProxyList()
+}
+
 func setupProxyList(w fyne.Window) *widget.List {
 	// Goroutine to handle UI updates from any part of the application
 	go func() {
+		// Periodically refresh so last access and expiry times stay current
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case newProxy := <-proxy.ProxyAddedChan:
 				addProxyToUI(newProxy)
 			case removedProxy := <-proxy.ProxyRemovedChan:
 				removeProxyFromUI(removedProxy)
+			case <-ticker.C:
+				refreshProxyList()
 			}
 		}
 	}()
@@ -75,7 +98,12 @@ func setupProxyList(w fyne.Window) *widget.List {
 		if len(parts) < 2 {
 			return
 		}
-		urlToCopy := parts[1]
+		// The shared URL is followed by the access/expiry info
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			return
+		}
+		urlToCopy := fields[0]
 
 		w.Clipboard().SetContent(urlToCopy)
 		fyne.CurrentApp().SendNotification(&fyne.Notification{
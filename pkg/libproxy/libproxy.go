@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -157,7 +158,7 @@ func scanSubnet(localIP string, port int) []string {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ipStr, port), 200*time.Millisecond)
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ipStr, strconv.Itoa(port)), 200*time.Millisecond)
 			if err == nil {
 				conn.Close()
 				mu.Lock()
@@ -227,7 +228,7 @@ func getInstanceList(timeout time.Duration) []string {
 
 	for _, host := range candidateHosts {
 		// Connect TCP/TLS
-		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", fmt.Sprintf("%s:%d", host, DiscoveryServerPort), tlsConfig)
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", net.JoinHostPort(host, strconv.Itoa(DiscoveryServerPort)), tlsConfig)
 		if err != nil {
 			continue
 		}